@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/jessevdk/go-flags"
 )
@@ -12,61 +14,258 @@ import (
 // Config stores the handler's configuration and UI interface parameters
 type Config struct {
 	Version             bool     `short:"V" long:"version" description:"Display version."`
+	ConfigFile          string   `long:"config" description:"YAML config file setting options by their long name, e.g. 'engine: restic'. Environment variables and flags override it." env:"CONPLICITY_CONFIG"`
 	Loglevel            string   `short:"l" long:"loglevel" description:"Set loglevel ('debug', 'info', 'warn', 'error', 'fatal', 'panic')." env:"CONPLICITY_LOG_LEVEL" default:"info"`
 	VolumesBlacklist    []string `short:"b" long:"blacklist" description:"Volumes to blacklist in backups." env:"CONPLICITY_VOLUMES_BLACKLIST" env-delim:","`
+	VolumeWhitelist     []string `long:"volume-whitelist" description:"Regexes of the volume names to back up (all volumes by default)." env:"CONPLICITY_VOLUME_WHITELIST" env-delim:","`
+	ExtraPaths          []string `long:"extra-path" description:"Host path to back up like a volume, as 'name:/path'. Can be repeated." env:"CONPLICITY_EXTRA_PATHS" env-delim:","`
+	VolumeBlacklist     []string `long:"volume-blacklist" description:"Regexes of the volume names not to back up, taking precedence over the whitelist." env:"CONPLICITY_VOLUME_BLACKLIST" env-delim:","`
 	Manpage             bool     `short:"m" long:"manpage" description:"Output manpage."`
 	NoVerify            bool     `long:"no-verify" description:"Do not verify backup." env:"CONPLICITY_NO_VERIFY"`
-	JSON                bool     `short:"j" long:"json" description:"Log as JSON (to stderr)." env:"CONPLICITY_JSON_OUTPUT"`
+	LogFormat           string   `long:"log-format" description:"Format of the logs, 'json' to ship them to log collectors." env:"CONPLICITY_LOG_FORMAT" default:"text" choice:"text" choice:"json"`
+	ContainerLogLevel   string   `long:"container-log-level" description:"Level of the output of backup containers in the logs, 'info', or 'debug' to only show it when debugging." env:"CONPLICITY_CONTAINER_LOG_LEVEL" default:"info" choice:"info" choice:"debug"`
+	JSON                bool     `short:"j" long:"json" description:"Log as JSON (to stderr), same as --log-format=json." env:"CONPLICITY_JSON_OUTPUT"`
 	Engine              string   `short:"E" long:"engine" description:"Backup engine to use." env:"CONPLICITY_ENGINE" default:"duplicity"`
+	SkipUnchanged       bool     `long:"skip-unchanged" description:"Skip volumes whose files did not change since their last backup (based on modification times)." env:"CONPLICITY_SKIP_UNCHANGED"`
+	BackupEmpty         bool     `long:"backup-empty" description:"Back up volumes containing no file instead of skipping them." env:"CONPLICITY_BACKUP_EMPTY"`
+	AllowEngineChange   bool     `long:"allow-engine-change" description:"Allow backing up volumes with another engine than their last backup." env:"CONPLICITY_ALLOW_ENGINE_CHANGE"`
+	BackupSelf          bool     `long:"backup-self" description:"Back up conplicity's own state (run summary, volume settings and state files) after the volumes." env:"CONPLICITY_BACKUP_SELF"`
+	SelfVolume          string   `long:"self-volume" description:"The volume storing conplicity's own state." env:"CONPLICITY_SELF_VOLUME" default:"conplicity_self"`
+	QuiesceMode         string   `long:"quiesce-mode" description:"How the containers using a volume with stop_containers are quiesced during its backup: 'pause' or 'stop'." env:"CONPLICITY_QUIESCE_MODE" default:"pause"`
+	StateDir            string   `long:"state-dir" description:"Directory storing the state shared by volumes, such as the date of the last check of each repository (the self volume when empty)." env:"CONPLICITY_STATE_DIR"`
+	PauseProjects       bool     `long:"pause-projects" description:"Back up the volumes of each Docker Compose project together, with the project's containers paused." env:"CONPLICITY_PAUSE_PROJECTS"`
 	TargetURL           string   `short:"u" long:"target-url" description:"The target URL to push to." env:"CONPLICITY_TARGET_URL"`
 	HostnameFromRancher bool     `short:"H" long:"hostname-from-rancher" description:"Retrieve hostname from Rancher metadata." env:"CONPLICITY_HOSTNAME_FROM_RANCHER"`
+	Strategy            string   `long:"strategy" description:"Order of volume backups: 'sequential', or 'priority-then-parallel' to back up priority and database volumes one by one, then all other volumes in parallel." env:"CONPLICITY_STRATEGY" default:"sequential" choice:"sequential" choice:"priority-then-parallel"`
+	DryRun              bool     `long:"dry-run" description:"Log the backup commands instead of running them, without writing to repositories nor volumes." env:"CONPLICITY_DRY_RUN"`
+	Schedule            string   `long:"schedule" description:"Keep running and back up volumes on this schedule, either an interval such as '6h' or a cron expression such as '0 2 * * *' (run once by default)." env:"CONPLICITY_SCHEDULE"`
+	Once                bool     `long:"once" description:"Back up volumes once and exit, even when a schedule is set." env:"CONPLICITY_ONCE"`
+	Parallelism         int      `long:"parallelism" description:"Maximum number of volumes backed up at the same time." env:"CONPLICITY_PARALLELISM" default:"1"`
 	CheckEvery          string   `long:"check-every" description:"Time between backup checks." env:"CONPLICITY_CHECK_EVERY" default:"24h"`
+	Frequency           string   `long:"frequency" description:"Minimum time between two backups of a volume, e.g. '168h' (every run by default)." env:"CONPLICITY_FREQUENCY"`
+	Comment             string   `long:"backup-comment" description:"Description attached to the backups of this run, e.g. 'before upgrade' (restic only)." env:"CONPLICITY_BACKUP_COMMENT"`
+	GPGPassphrase       string   `long:"gpg-passphrase" description:"Passphrase encrypting duplicity backups (backups are not encrypted when empty)." env:"CONPLICITY_GPG_PASSPHRASE"`
+	EncryptKey          string   `long:"encrypt-key" description:"GPG key ID encrypting duplicity backups asymmetrically, with --gpg-passphrase unlocking it." env:"CONPLICITY_ENCRYPT_KEY"`
+	Timeout             string   `long:"timeout" description:"Maximum run time of each backup container, including its creation, e.g. '2h' (no limit by default)." env:"CONPLICITY_TIMEOUT"`
+	PreBackupCommand    string   `long:"pre-backup-cmd" description:"Shell command run before the backup of each volume, in a container with the volume mounted. The volume is skipped if it fails." env:"CONPLICITY_PRE_BACKUP_CMD"`
+	PostBackupCommand   string   `long:"post-backup-cmd" description:"Shell command run after the backup of each volume, in a container with the volume mounted." env:"CONPLICITY_POST_BACKUP_CMD"`
+	HookImage           string   `long:"hook-image" description:"The docker image running the pre and post-backup commands." env:"CONPLICITY_HOOK_IMAGE" default:"alpine:latest"`
+	MountByNameDrivers  []string `long:"mount-by-name-drivers" description:"Volume drivers whose volumes are mounted by name instead of by host path." env:"CONPLICITY_MOUNT_BY_NAME_DRIVERS" env-delim:","`
 
 	Duplicity struct {
-		Image           string `long:"duplicity-image" description:"The duplicity docker image." env:"DUPLICITY_DOCKER_IMAGE" default:"camptocamp/duplicity:latest"`
-		FullIfOlderThan string `long:"full-if-older-than" description:"The number of days after which a full backup must be performed." env:"CONPLICITY_FULL_IF_OLDER_THAN" default:"15D"`
-		RemoveOlderThan string `long:"remove-older-than" description:"The number days after which backups must be removed." env:"CONPLICITY_REMOVE_OLDER_THAN" default:"30D"`
+		Image           string   `long:"duplicity-image" description:"The duplicity docker image." env:"DUPLICITY_DOCKER_IMAGE" default:"camptocamp/duplicity:latest"`
+		FullIfOlderThan string   `long:"full-if-older-than" description:"The number of days after which a full backup must be performed." env:"CONPLICITY_FULL_IF_OLDER_THAN" default:"15D"`
+		RemoveOlderThan string   `long:"remove-older-than" description:"The number days after which backups must be removed." env:"CONPLICITY_REMOVE_OLDER_THAN" default:"30D"`
+		ExtraArgs       []string `long:"duplicity-extra-args" description:"Extra arguments of duplicity commands, e.g. '--volsize 100'." env:"DUPLICITY_EXTRA_ARGS" env-delim:" "`
 	} `group:"Duplicity Options"`
 
 	RClone struct {
-		Image string `long:"rclone-image" description:"The rclone docker image." env:"RCLONE_DOCKER_IMAGE" default:"camptocamp/rclone:1.33-1"`
+		Image      string `long:"rclone-image" description:"The rclone docker image." env:"RCLONE_DOCKER_IMAGE" default:"camptocamp/rclone:1.33-1"`
+		ConfigPath string `long:"rclone-config-path" description:"Host path of the rclone config file used by restic for rclone: targets." env:"RCLONE_CONFIG_PATH"`
 	} `group:"RClone Options"`
 
 	Restic struct {
-		Image    string `long:"restic-image" description:"The restic docker image." env:"RESTIC_DOCKER_IMAGE" default:"restic/restic:latest"`
-		Password string `long:"restic-password" description:"The restic backup password." env:"RESTIC_PASSWORD"`
+		Image                string `long:"restic-image" description:"The restic docker image." env:"RESTIC_DOCKER_IMAGE" default:"restic/restic:latest"`
+		CacheVolume          string `long:"restic-cache-volume" description:"The volume persisting the restic cache between runs (no cache when empty)." env:"RESTIC_CACHE_VOLUME" default:"restic_cache"`
+		Password             string `long:"restic-password" description:"The restic backup password." env:"RESTIC_PASSWORD"`
+		PasswordFile         string `long:"restic-password-file" description:"Host path of a file containing the restic backup password, used instead of --restic-password." env:"RESTIC_PASSWORD_FILE"`
+		RepositoryFile       string `long:"restic-repository-file" description:"Host path of a file containing the restic repository, used instead of the target URL." env:"RESTIC_REPOSITORY_FILE"`
+		KeepLast             string `long:"restic-keep-last" description:"Number of last snapshots to keep when removing old snapshots." env:"RESTIC_KEEP_LAST"`
+		KeepDaily            string `long:"restic-keep-daily" description:"Number of daily snapshots to keep when removing old snapshots." env:"RESTIC_KEEP_DAILY"`
+		KeepWeekly           string `long:"restic-keep-weekly" description:"Number of weekly snapshots to keep when removing old snapshots." env:"RESTIC_KEEP_WEEKLY"`
+		KeepMonthly          string `long:"restic-keep-monthly" description:"Number of monthly snapshots to keep when removing old snapshots." env:"RESTIC_KEEP_MONTHLY"`
+		KeepWithin           string `long:"restic-keep-within" description:"Remove the snapshots older than this duration, e.g. '30d' or '1y6m' (disabled by default)." env:"RESTIC_KEEP_WITHIN"`
+		CheckEvery           string `long:"restic-check-every" description:"Time between checks of restic repositories, instead of --check-every." env:"RESTIC_CHECK_EVERY" default:"168h"`
+		DeepCheckEvery       string `long:"restic-deep-check-every" description:"Time between checks reading all backed up data, instead of the repository structure only (disabled by default)." env:"RESTIC_DEEP_CHECK_EVERY"`
+		CheckReadDataPercent int    `long:"restic-check-read-data-percent" description:"Percentage of the backed up data read by checks, instead of the repository structure only (0 by default)." env:"RESTIC_CHECK_READ_DATA_PERCENT" default:"0"`
+		CheckNoCacheEvery    string `long:"restic-check-no-cache-every" description:"Time between checks reading metadata from the backend instead of the local cache (disabled by default)." env:"RESTIC_CHECK_NO_CACHE"`
+		PackSize             int    `long:"restic-pack-size" description:"Target size of the restic pack files in MiB, larger packs speeding up high-latency backends (restic's default when 0)." env:"RESTIC_PACK_SIZE" default:"0"`
+		Compression          string `long:"restic-compression" description:"Compression of restic repositories: 'auto', 'max' or 'off', requires repository format version 2 (restic's default when empty)." env:"RESTIC_COMPRESSION"`
+		Retries              int    `long:"restic-retries" description:"Number of attempts of restic operations (init, backup and check)." env:"RESTIC_RETRIES" default:"3"`
+		RetryDelay           string `long:"restic-retry-delay" description:"Delay before retrying a failed restic operation, doubled after each attempt." env:"RESTIC_RETRY_DELAY" default:"2s"`
 	} `group:"Restic Options"`
 
+	Borg struct {
+		Image          string `long:"borg-image" description:"The borg docker image." env:"BORG_DOCKER_IMAGE" default:"camptocamp/borg:1.2"`
+		Passphrase     string `long:"borg-passphrase" description:"The passphrase of borg repositories." env:"BORG_PASSPHRASE"`
+		PassphraseFile string `long:"borg-passphrase-file" description:"Host path of a file containing the passphrase of borg repositories, used instead of --borg-passphrase." env:"BORG_PASSPHRASE_FILE"`
+		Encryption     string `long:"borg-encryption" description:"Encryption mode of new borg repositories." env:"BORG_ENCRYPTION" default:"repokey"`
+		KeepLast       string `long:"borg-keep-last" description:"Number of last archives to keep when pruning old archives." env:"BORG_KEEP_LAST"`
+		KeepDaily      string `long:"borg-keep-daily" description:"Number of daily archives to keep when pruning old archives." env:"BORG_KEEP_DAILY"`
+		KeepWeekly     string `long:"borg-keep-weekly" description:"Number of weekly archives to keep when pruning old archives." env:"BORG_KEEP_WEEKLY"`
+		KeepMonthly    string `long:"borg-keep-monthly" description:"Number of monthly archives to keep when pruning old archives." env:"BORG_KEEP_MONTHLY"`
+		KeepWithin     string `long:"borg-keep-within" description:"Keep all the archives within this interval, e.g. '7d' or '2w' (disabled by default)." env:"BORG_KEEP_WITHIN"`
+	} `group:"Borg Options"`
+
+	Tar struct {
+		Image string `long:"tar-image" description:"The docker image creating tar archives." env:"TAR_DOCKER_IMAGE" default:"alpine:3.6"`
+	} `group:"Tar Options"`
+
+	PostRun struct {
+		Command string `long:"post-run-cmd" description:"Shell command to run once all backups are done. The run summary is passed as JSON on stdin and in $CONPLICITY_RUN_SUMMARY." env:"CONPLICITY_POST_RUN_CMD"`
+		Image   string `long:"post-run-image" description:"Run the post-run command in a container of this image instead of on the host." env:"CONPLICITY_POST_RUN_IMAGE"`
+	} `group:"Post-run Options"`
+
+	Slack struct {
+		WebhookURL string `long:"slack-webhook-url" description:"Slack incoming webhook notified of the result of each run." env:"CONPLICITY_SLACK_WEBHOOK_URL"`
+	} `group:"Slack Options"`
+
+	Email struct {
+		Host            string   `long:"email-host" description:"SMTP server sending run summaries by email (no email is sent when empty)." env:"CONPLICITY_EMAIL_HOST"`
+		Port            int      `long:"email-port" description:"Port of the SMTP server." env:"CONPLICITY_EMAIL_PORT" default:"25"`
+		From            string   `long:"email-from" description:"Sender of the emails." env:"CONPLICITY_EMAIL_FROM"`
+		To              []string `long:"email-to" description:"Recipients of the emails." env:"CONPLICITY_EMAIL_TO" env-delim:","`
+		Username        string   `long:"email-username" description:"User name authenticating to the SMTP server (no authentication when empty)." env:"CONPLICITY_EMAIL_USERNAME"`
+		Password        string   `long:"email-password" description:"Password authenticating to the SMTP server." env:"CONPLICITY_EMAIL_PASSWORD"`
+		NotifyOnSuccess bool     `long:"email-notify-on-success" description:"Also send an email when all backups succeeded." env:"CONPLICITY_EMAIL_NOTIFY_ON_SUCCESS"`
+	} `group:"Email Options"`
+
 	Metrics struct {
-		PushgatewayURL string `short:"g" long:"gateway-url" description:"The prometheus push gateway URL to use." env:"PUSHGATEWAY_URL"`
+		PushgatewayURL string   `short:"g" long:"gateway-url" description:"The prometheus push gateway URL to use." env:"PUSHGATEWAY_URL"`
+		ListenAddr     string   `long:"metrics-listen-addr" description:"Address serving the metrics at /metrics during the run, e.g. ':9095' (not served when empty)." env:"CONPLICITY_METRICS_LISTEN_ADDR"`
+		GracePeriod    string   `long:"metrics-grace-period" description:"Time to keep serving the metrics after the run, so they can be scraped." env:"CONPLICITY_METRICS_GRACE_PERIOD" default:"30s"`
+		TextfilePath   string   `long:"metrics-textfile-path" description:"Path of a .prom file written with the metrics at the end of each backup run, for the node exporter textfile collector." env:"CONPLICITY_METRICS_TEXTFILE_PATH"`
+		DropLabels     []string `long:"metrics-drop-labels" description:"Labels to remove from pushed metrics to limit their cardinality, e.g. 'repo_id,level'. Metrics are still grouped by volume in the push gateway." env:"CONPLICITY_METRICS_DROP_LABELS" env-delim:","`
 	} `group:"Metrics Options"`
 
+	Influx struct {
+		URL      string `long:"influx-url" description:"URL of the InfluxDB server receiving the metrics at the end of each backup run (not written when empty)." env:"CONPLICITY_INFLUX_URL"`
+		Database string `long:"influx-database" description:"The InfluxDB 1.x database, or the InfluxDB 2.x bucket, of the metrics." env:"CONPLICITY_INFLUX_DATABASE" default:"conplicity"`
+		Org      string `long:"influx-org" description:"The InfluxDB 2.x organization, selecting the 2.x write API." env:"CONPLICITY_INFLUX_ORG"`
+		Token    string `long:"influx-token" description:"The token authenticating to InfluxDB." env:"CONPLICITY_INFLUX_TOKEN"`
+	} `group:"InfluxDB Options"`
+
 	AWS struct {
 		AccessKeyID     string `long:"aws-access-key-id" description:"The AWS access key ID." env:"AWS_ACCESS_KEY_ID"`
 		SecretAccessKey string `long:"aws-secret-key-id" description:"The AWS secret access key." env:"AWS_SECRET_ACCESS_KEY"`
 	} `group:"AWS Options"`
 
 	Swift struct {
-		Username   string `long:"swift-username" description:"The Swift user name." env:"SWIFT_USERNAME"`
-		Password   string `long:"swift-password" description:"The Swift password." env:"SWIFT_PASSWORD"`
-		AuthURL    string `long:"swift-auth_url" description:"The Swift auth URL." env:"SWIFT_AUTHURL"`
-		TenantName string `long:"swift-tenant-name" description:"The Swift tenant name." env:"SWIFT_TENANTNAME"`
-		RegionName string `long:"swift-region-name" description:"The Swift region name." env:"SWIFT_REGIONNAME"`
+		Username                    string `long:"swift-username" description:"The Swift user name." env:"SWIFT_USERNAME"`
+		Password                    string `long:"swift-password" description:"The Swift password." env:"SWIFT_PASSWORD"`
+		AuthURL                     string `long:"swift-auth_url" description:"The Swift auth URL." env:"SWIFT_AUTHURL"`
+		TenantName                  string `long:"swift-tenant-name" description:"The Swift tenant name." env:"SWIFT_TENANTNAME"`
+		RegionName                  string `long:"swift-region-name" description:"The Swift region name." env:"SWIFT_REGIONNAME"`
+		AuthVersion                 int    `long:"swift-auth-version" description:"The Keystone authentication version, 2 or 3." env:"SWIFT_AUTHVERSION" default:"2"`
+		ProjectName                 string `long:"swift-project-name" description:"The Keystone v3 project name." env:"SWIFT_PROJECT_NAME"`
+		ProjectID                   string `long:"swift-project-id" description:"The Keystone v3 project ID, instead of the project name." env:"SWIFT_PROJECT_ID"`
+		UserDomainName              string `long:"swift-user-domain-name" description:"The Keystone v3 domain of the user." env:"SWIFT_USER_DOMAIN_NAME"`
+		ProjectDomainName           string `long:"swift-project-domain-name" description:"The Keystone v3 domain of the project." env:"SWIFT_PROJECT_DOMAIN_NAME"`
+		ApplicationCredentialID     string `long:"swift-application-credential-id" description:"The Keystone v3 application credential ID, used instead of the user name and password (restic and rclone only)." env:"SWIFT_APPLICATION_CREDENTIAL_ID"`
+		ApplicationCredentialSecret string `long:"swift-application-credential-secret" description:"The Keystone v3 application credential secret." env:"SWIFT_APPLICATION_CREDENTIAL_SECRET"`
 	} `group:"Swift Options"`
 
+	B2 struct {
+		AccountID  string `long:"b2-account-id" description:"The Backblaze B2 account ID." env:"B2_ACCOUNT_ID"`
+		AccountKey string `long:"b2-account-key" description:"The Backblaze B2 account key." env:"B2_ACCOUNT_KEY"`
+	} `group:"Backblaze B2 Options"`
+
+	Azure struct {
+		AccountName string `long:"azure-account-name" description:"The Azure Blob Storage account name." env:"AZURE_ACCOUNT_NAME"`
+		AccountKey  string `long:"azure-account-key" description:"The Azure Blob Storage account key." env:"AZURE_ACCOUNT_KEY"`
+	} `group:"Azure Blob Storage Options"`
+
+	SSH struct {
+		PrivateKeyPath        string `long:"ssh-private-key-path" description:"Host path of the private key authenticating to SFTP and SSH targets." env:"SSH_PRIVATE_KEY_PATH"`
+		KnownHostsPath        string `long:"ssh-known-hosts-path" description:"Host path of the known_hosts file checking the host keys of SFTP and SSH targets." env:"SSH_KNOWN_HOSTS_PATH"`
+		StrictHostKeyChecking bool   `long:"ssh-strict-host-key-checking" description:"Check the host keys of duplicity SFTP and SSH targets against the known_hosts file (unchecked by default, which is insecure)." env:"SSH_STRICT_HOST_KEY_CHECKING"`
+	} `group:"SSH Options"`
+
+	GCS struct {
+		ProjectID   string `long:"gcs-project-id" description:"The Google Cloud Storage project ID." env:"GOOGLE_PROJECT_ID"`
+		Credentials string `long:"gcs-credentials" description:"Host path of the Google service account JSON file." env:"GOOGLE_APPLICATION_CREDENTIALS"`
+	} `group:"Google Cloud Storage Options"`
+
+	Secrets struct {
+		File       string `long:"secrets-file" description:"File of KEY=value secrets named after the environment variables they provide, e.g. RESTIC_PASSWORD." env:"CONPLICITY_SECRETS_FILE"`
+		VaultAddr  string `long:"vault-addr" description:"The Vault server address." env:"VAULT_ADDR"`
+		VaultToken string `long:"vault-token" description:"The Vault token." env:"VAULT_TOKEN"`
+		VaultPath  string `long:"vault-path" description:"The Vault path of the secrets, named after the environment variables they provide." env:"CONPLICITY_VAULT_PATH"`
+	} `group:"Secrets Options"`
+
 	Docker struct {
-		Endpoint string `short:"e" long:"docker-endpoint" description:"The Docker endpoint." env:"DOCKER_ENDPOINT" default:"unix:///var/run/docker.sock"`
+		Endpoint     string   `short:"e" long:"docker-endpoint" description:"The Docker endpoint." env:"DOCKER_ENDPOINT" default:"unix:///var/run/docker.sock"`
+		Host         string   `long:"docker-host" description:"The remote Docker daemon, used instead of the Docker endpoint." env:"DOCKER_HOST"`
+		TLSVerify    string   `long:"docker-tls-verify" description:"Verify the Docker daemon's certificate when not empty." env:"DOCKER_TLS_VERIFY"`
+		CertPath     string   `long:"docker-cert-path" description:"Directory of the ca.pem, cert.pem and key.pem files used to connect to the Docker daemon with TLS (default: ~/.docker)." env:"DOCKER_CERT_PATH"`
+		PollInterval string   `long:"docker-poll-interval" description:"Time between two checks of whether a backup container exited." env:"CONPLICITY_DOCKER_POLL_INTERVAL" default:"1s"`
+		NoTTY        bool     `long:"docker-no-tty" description:"Keep stdout and stderr of backup containers separate (default with backup --results-json)." env:"CONPLICITY_DOCKER_NO_TTY"`
+		ForcePull    bool     `long:"docker-force-pull" description:"Pull images at the start of each run even when they are present, to refresh their tags." env:"CONPLICITY_DOCKER_FORCE_PULL"`
+		Network      string   `long:"docker-network" description:"Network mode of backup containers: bridge, host, none or a network name (default: Docker's default bridge)." env:"CONPLICITY_DOCKER_NETWORK"`
+		Capabilities []string `long:"docker-capabilities" description:"Capabilities kept in backup containers, all others are dropped." env:"CONPLICITY_DOCKER_CAPABILITIES" env-delim:"," default:"CHOWN" default:"DAC_OVERRIDE" default:"DAC_READ_SEARCH" default:"FOWNER"`
 	} `group:"Docker Options"`
+
+	Registry struct {
+		Username   string `long:"registry-username" description:"User name authenticating to the registry of the images." env:"CONPLICITY_REGISTRY_USERNAME"`
+		Password   string `long:"registry-password" description:"Password authenticating to the registry of the images." env:"CONPLICITY_REGISTRY_PASSWORD"`
+		Host       string `long:"registry-host" description:"Host of the registry the user name and password authenticate to, Docker Hub when empty." env:"CONPLICITY_REGISTRY_HOST"`
+		ConfigPath string `long:"registry-config-path" description:"Path of a docker config.json file holding the registry credentials, used when no user name is set." env:"CONPLICITY_REGISTRY_CONFIG_PATH"`
+	} `group:"Registry Options"`
+
+	Resources struct {
+		Memory    string  `long:"memory-limit" description:"Memory limit of backup containers, such as '512m' (no limit when empty)." env:"CONPLICITY_MEMORY_LIMIT"`
+		CPUShares int64   `long:"cpu-shares" description:"CPU shares of backup containers, their weight relative to other containers (default weight when 0)." env:"CONPLICITY_CPU_SHARES"`
+		CPUs      float64 `long:"cpus" description:"Number of CPUs backup containers may use, such as 1.5 (no limit when 0)." env:"CONPLICITY_CPUS"`
+	} `group:"Resource Options"`
+
+	// Command is the name of the command to run, "backup" when none is passed
+	Command string
+
+	Backup struct {
+		ResultsJSON bool `long:"results-json" description:"Stream backup results to stdout as JSON lines (unlike the global --json, which formats the logs)."`
+	} `command:"backup" description:"Backup Docker volumes (default command)."`
+
+	Restore struct {
+		Volume   string   `long:"volume" description:"The volume to restore." required:"true"`
+		Snapshot string   `long:"snapshot" description:"The ID of the snapshot to restore." default:"latest"`
+		Target   string   `long:"target" description:"The path to restore to in the restic container, where the volume is mounted at its backup path." default:"/"`
+		Include  []string `long:"include" description:"Only restore this absolute path of the volume. Can be repeated."`
+		Time     string   `long:"time" description:"The time of the duplicity backup to restore, e.g. '3D' or '2017-03-01T02:00:00' (latest by default)."`
+	} `command:"restore" description:"Restore a volume from a restic snapshot or a duplicity backup."`
+
+	Verify struct {
+		Volume string `long:"volume" description:"The volume whose backup to check." required:"true"`
+	} `command:"verify" description:"Check the backup of a volume now, regardless of the check schedule."`
+
+	Init struct {
+	} `command:"init" description:"Initialize the restic repositories and check the duplicity targets of all volumes, without backing them up."`
+
+	RetentionPreview struct {
+	} `command:"retention-preview" description:"List the backups the retention policy of each volume would remove, without removing them."`
+
+	ForgetSnapshot struct {
+		Volume string `long:"volume" description:"The volume whose restic repository holds the snapshot." required:"true"`
+		Yes    bool   `long:"yes" description:"Confirm the snapshot removal, which cannot be undone."`
+		Args   struct {
+			SnapshotID string `positional-arg-name:"id"`
+		} `positional-args:"yes" required:"yes"`
+	} `command:"forget-snapshot" description:"Remove a snapshot from a volume's restic repository and prune its data."`
 }
 
-// LoadConfig loads the config from flags & environment
+// LoadConfig loads the config from flags, environment & config file
 func LoadConfig(version string) *Config {
 	var c Config
 	parser := flags.NewParser(&c, flags.Default)
+	parser.SubcommandsOptional = true
+
+	path, err := configFilePath()
+	if err == nil && path != "" {
+		err = loadConfigFile(parser, path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	if _, err := parser.Parse(); err != nil {
 		os.Exit(1)
 	}
 
+	c.Command = "backup"
+	if parser.Active != nil {
+		c.Command = parser.Active.Name
+	}
+
 	if c.Version {
 		fmt.Printf("Conplicity v%v\n", version)
 		os.Exit(0)
@@ -84,12 +283,36 @@ Conplicity supports multiple engines for performing the backup:
 * RClone: use for heavy data that Duplicity cannot manage efficiently
 
 * Restic
+
+* Borg
+
+* Tar
 `
 		parser.WriteManPage(&buf)
-		fmt.Printf(buf.String())
+		fmt.Print(buf.String())
 		os.Exit(0)
 	}
 
 	sort.Strings(c.VolumesBlacklist)
 	return &c
 }
+
+// ExtraPath is a host path backed up like a volume named Name
+type ExtraPath struct {
+	Name string
+	Path string
+}
+
+// ParseExtraPath parses an extra path given as 'name:/path'
+func ParseExtraPath(s string) (p ExtraPath, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || !filepath.IsAbs(parts[1]) {
+		err = fmt.Errorf("invalid extra path %s, expected 'name:/path'", s)
+		return
+	}
+	p = ExtraPath{
+		Name: parts[0],
+		Path: filepath.Clean(parts[1]),
+	}
+	return
+}
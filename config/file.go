@@ -0,0 +1,197 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// configFileValue is an option set in the config file
+type configFileValue struct {
+	name  string
+	value string
+	line  int
+}
+
+// configFilePath returns the config file given with --config
+// or CONPLICITY_CONFIG, before the options are parsed
+func configFilePath() (string, error) {
+	var opts struct {
+		ConfigFile string `long:"config" env:"CONPLICITY_CONFIG"`
+	}
+	_, err := flags.NewParser(&opts, flags.IgnoreUnknown).Parse()
+	return opts.ConfigFile, err
+}
+
+// loadConfigFile sets the options of the config file as defaults of the
+// parser's options, so that the environment and flags override them
+func loadConfigFile(parser *flags.Parser, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	values, err := readConfigFile(f)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	return setConfigDefaults(parser, path, values)
+}
+
+// readConfigFile reads the options of a YAML config file: a mapping of
+// options to scalar values, or to lists of values for repeated options.
+// Nested mappings are not supported, options are named by their long flag.
+func readConfigFile(r io.Reader) (values []configFileValue, err error) {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	list := "" // the option whose list items follow
+	listLine := 0
+	for scanner.Scan() {
+		line++
+		raw := strings.TrimRight(scanner.Text(), " \t\r")
+		text := strings.TrimSpace(raw)
+		if text == "" || text[0] == '#' || text == "---" {
+			continue
+		}
+
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			if list == "" {
+				return nil, fmt.Errorf("line %d: list item without an option", line)
+			}
+			value, err := yamlScalar(strings.TrimSpace(strings.TrimPrefix(text, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			values = append(values, configFileValue{name: list, value: value, line: line})
+			listLine = 0
+			continue
+		}
+		if raw[0] == ' ' || raw[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested mappings are not supported, set options by their long name", line)
+		}
+		if listLine != 0 {
+			return nil, fmt.Errorf("line %d: no value for option %s", listLine, list)
+		}
+		list = ""
+
+		var name, value string
+		if i := strings.Index(text, ": "); i > 0 {
+			name, value = text[:i], strings.TrimSpace(text[i+2:])
+		} else if strings.HasSuffix(text, ":") {
+			name = strings.TrimSuffix(text, ":")
+		} else {
+			return nil, fmt.Errorf("line %d: expected option: value, got %q", line, text)
+		}
+
+		switch {
+		case value == "" || value[0] == '#':
+			list, listLine = name, line
+		case value[0] == '[':
+			items, err := yamlFlowList(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			for _, item := range items {
+				values = append(values, configFileValue{name: name, value: item, line: line})
+			}
+		default:
+			value, err = yamlScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			values = append(values, configFileValue{name: name, value: value, line: line})
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if listLine != 0 {
+		return nil, fmt.Errorf("line %d: no value for option %s", listLine, list)
+	}
+	return values, nil
+}
+
+// yamlScalar returns the value of a plain, single-quoted or double-quoted
+// YAML scalar. Comments are removed from plain scalars.
+func yamlScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := strings.LastIndex(s, `"`)
+		if end == 0 || !isYAMLComment(s[end+1:]) {
+			return "", fmt.Errorf("invalid double-quoted value %s", s)
+		}
+		value, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted value %s: %v", s, err)
+		}
+		return value, nil
+	case strings.HasPrefix(s, "'"):
+		end := strings.LastIndex(s, "'")
+		if end == 0 || !isYAMLComment(s[end+1:]) {
+			return "", fmt.Errorf("invalid single-quoted value %s", s)
+		}
+		return strings.Replace(s[1:end], "''", "'", -1), nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// isYAMLComment tells whether s, following a value, is blank or a comment
+func isYAMLComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// yamlFlowList returns the items of a YAML flow sequence such as [a, b]
+func yamlFlowList(s string) (items []string, err error) {
+	end := strings.LastIndex(s, "]")
+	if end < 0 || !isYAMLComment(s[end+1:]) {
+		return nil, fmt.Errorf("invalid list %s", s)
+	}
+	content := strings.TrimSpace(s[1:end])
+	if content == "" {
+		return nil, nil
+	}
+	for _, item := range strings.Split(content, ",") {
+		value, err := yamlScalar(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return
+}
+
+// setConfigDefaults sets the values as defaults of the parser's options.
+// Options repeated in the file are lists.
+func setConfigDefaults(parser *flags.Parser, path string, values []configFileValue) error {
+	defaults := make(map[*flags.Option][]string)
+	var options []*flags.Option
+	for _, v := range values {
+		option := parser.FindOptionByLongName(v.name)
+		if option == nil {
+			return fmt.Errorf("%s:%d: unknown option %s", path, v.line, v.name)
+		}
+		if _, ok := defaults[option]; !ok {
+			options = append(options, option)
+		}
+		if option.EnvDefaultDelim != "" {
+			defaults[option] = append(defaults[option], strings.Split(v.value, option.EnvDefaultDelim)...)
+		} else {
+			defaults[option] = append(defaults[option], v.value)
+		}
+	}
+
+	for _, option := range options {
+		option.Default = defaults[option]
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	file := `# Conplicity settings
+---
+engine: restic
+target-url: s3:s3.amazonaws.com/backups # the repository
+
+restic-keep-daily: "7"
+# volumes not to back up
+volume-blacklist:
+  - ^tmp
+  - 'it''s'
+extra-path: [data:/srv/data, "logs:/var/log"]
+`
+	values, err := readConfigFile(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var got []string
+	for _, v := range values {
+		got = append(got, fmt.Sprintf("%d:%s=%s", v.line, v.name, v.value))
+	}
+	expected := "3:engine=restic 4:target-url=s3:s3.amazonaws.com/backups 6:restic-keep-daily=7 " +
+		"9:volume-blacklist=^tmp 10:volume-blacklist=it's 11:extra-path=data:/srv/data 11:extra-path=logs:/var/log"
+	if strings.Join(got, " ") != expected {
+		t.Fatalf("Expected %s, got %s", expected, strings.Join(got, " "))
+	}
+
+	for file, problem := range map[string]string{
+		"engine: restic\nrestic\n":                     "line 2: expected option: value",
+		"engine = restic\n":                            "line 1: expected option: value",
+		"restic:\n  restic-keep-daily: 7\n":            "line 2: nested mappings are not supported",
+		"- foo\n":                                      "line 1: list item without an option",
+		"volume-blacklist:\nengine: restic\n":          "line 1: no value for option volume-blacklist",
+		"engine: \"restic\n":                           "line 1: invalid double-quoted value",
+		"volume-blacklist: [^tmp\n":                    "line 1: invalid list",
+		"engine: restic\nvolume-blacklist:\n  - foo\n": "",
+	} {
+		_, err := readConfigFile(strings.NewReader(file))
+		if problem == "" {
+			if err != nil {
+				t.Fatalf("Expected no error for %q, got %v", file, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Expected %q for %q, got %v", problem, file, err)
+		}
+	}
+}
+
+func TestSetConfigDefaults(t *testing.T) {
+	var c Config
+	parser := flags.NewParser(&c, flags.None)
+	parser.SubcommandsOptional = true
+
+	values := []configFileValue{
+		{name: "engine", value: "restic", line: 1},
+		{name: "restic-keep-daily", value: "7", line: 2},
+		{name: "blacklist", value: "foo,bar", line: 3},
+	}
+	if err := setConfigDefaults(parser, "conplicity.yml", values); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	os.Setenv("RESTIC_KEEP_DAILY", "14")
+	defer os.Unsetenv("RESTIC_KEEP_DAILY")
+
+	if _, err := parser.ParseArgs([]string{"--restic-keep-weekly", "4"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if c.Engine != "restic" {
+		t.Fatalf("Expected engine from the config file, got %s", c.Engine)
+	}
+	if c.Restic.KeepDaily != "14" {
+		t.Fatalf("Expected the environment to override the config file, got %s", c.Restic.KeepDaily)
+	}
+	if c.Restic.KeepWeekly != "4" {
+		t.Fatalf("Expected the flag value, got %s", c.Restic.KeepWeekly)
+	}
+	if got := strings.Join(c.VolumesBlacklist, " "); got != "foo bar" {
+		t.Fatalf("Expected blacklist foo bar, got %s", got)
+	}
+
+	err := setConfigDefaults(parser, "conplicity.yml", []configFileValue{
+		{name: "engnie", value: "restic", line: 4},
+	})
+	expected := "conplicity.yml:4: unknown option engnie"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected %s, got %v", expected, err)
+	}
+}
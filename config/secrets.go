@@ -0,0 +1,111 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// LoadSecrets resolves credentials from the secrets file and Vault into the config.
+// Secrets are named after the environment variable of the option they set
+// and only fill options which were not set from flags or the environment.
+func (c *Config) LoadSecrets() (err error) {
+	secrets := make(map[string]string)
+
+	if c.Secrets.File != "" {
+		err = readSecretsFile(c.Secrets.File, secrets)
+		if err != nil {
+			return fmt.Errorf("failed to read secrets file: %v", err)
+		}
+	}
+
+	if c.Secrets.VaultPath != "" {
+		err = readVaultSecrets(c.Secrets.VaultAddr, c.Secrets.VaultToken, c.Secrets.VaultPath, secrets)
+		if err != nil {
+			return fmt.Errorf("failed to read secrets from Vault: %v", err)
+		}
+	}
+
+	setSecrets(reflect.ValueOf(c).Elem(), secrets)
+	return
+}
+
+// readSecretsFile reads KEY=value secrets from file
+func readSecretsFile(file string, secrets map[string]string) error {
+	f, err := ini.Load(file)
+	if err != nil {
+		return err
+	}
+	for _, key := range f.Section("").Keys() {
+		secrets[key.Name()] = key.String()
+	}
+	return nil
+}
+
+// readVaultSecrets reads the secrets stored at path in Vault,
+// using either the KV version 1 or version 2 format
+func readVaultSecrets(addr, token, path string, secrets map[string]string) error {
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	data := body.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	for k, v := range data {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("secret %s is not a string", k)
+		}
+		secrets[k] = s
+	}
+	return nil
+}
+
+// setSecrets sets the empty string options whose environment variable is a secret
+func setSecrets(ref reflect.Value, secrets map[string]string) {
+	for i := 0; i < ref.NumField(); i++ {
+		field := ref.Field(i)
+		tag := ref.Type().Field(i).Tag
+
+		if field.Kind() == reflect.Struct {
+			setSecrets(field, secrets)
+			continue
+		}
+
+		if field.Kind() != reflect.String || field.String() != "" {
+			continue
+		}
+		if secret, ok := secrets[tag.Get("env")]; ok && tag.Get("env") != "" {
+			field.SetString(secret)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLoadSecretsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	fmt.Fprintf(f, "RESTIC_PASSWORD=secret\nAWS_SECRET_ACCESS_KEY=fromfile\n")
+	f.Close()
+
+	c := Config{}
+	c.Secrets.File = f.Name()
+	c.AWS.SecretAccessKey = "fromenv"
+
+	if err := c.LoadSecrets(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if c.Restic.Password != "secret" {
+		t.Fatalf("Expected secret, got %s", c.Restic.Password)
+	}
+	if c.AWS.SecretAccessKey != "fromenv" {
+		t.Fatalf("Expected fromenv, got %s", c.AWS.SecretAccessKey)
+	}
+}
+
+func TestLoadSecretsVault(t *testing.T) {
+	for _, body := range []string{
+		`{"data": {"RESTIC_PASSWORD": "secret"}}`,
+		`{"data": {"data": {"RESTIC_PASSWORD": "secret"}, "metadata": {}}}`,
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != "token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.URL.Path != "/v1/secret/conplicity" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, body)
+		}))
+
+		c := Config{}
+		c.Secrets.VaultAddr = ts.URL
+		c.Secrets.VaultToken = "token"
+		c.Secrets.VaultPath = "secret/conplicity"
+
+		err := c.LoadSecrets()
+		ts.Close()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if c.Restic.Password != "secret" {
+			t.Fatalf("Expected secret, got %s", c.Restic.Password)
+		}
+	}
+}
+
+func TestLoadSecretsVaultForbidden(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	c := Config{}
+	c.Secrets.VaultAddr = ts.URL
+	c.Secrets.VaultPath = "secret/conplicity"
+
+	if err := c.LoadSecrets(); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
@@ -0,0 +1,285 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/camptocamp/conplicity/schedule"
+	"github.com/docker/distribution/reference"
+	units "github.com/docker/go-units"
+)
+
+// duplicityTimeRx matches duplicity time strings: intervals such as '15D'
+// or '1h30m', dates, epoch seconds and 'now'
+var duplicityTimeRx = regexp.MustCompile(`^((\d+[smhDWMY])+|\d{4}-\d{2}-\d{2}(T\d{2}:\d{2}:\d{2})?|\d+|now)$`)
+
+// resticDurationRx matches restic durations such as '30d' or '1y6m'
+var resticDurationRx = regexp.MustCompile(`^(\d+[ymdh])+$`)
+
+// borgIntervalRx matches borg intervals such as '7d' or '2w'
+var borgIntervalRx = regexp.MustCompile(`^\d+[Hdwmy]$`)
+
+// option is the value of an option, named after its long flag
+type option struct {
+	name  string
+	value string
+}
+
+// Validate checks that the config is usable, reporting all problems at once
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.TargetURL == "" {
+		if c.Restic.RepositoryFile == "" {
+			add("no target URL set, use --target-url or CONPLICITY_TARGET_URL")
+		}
+	} else if u, err := url.Parse(c.TargetURL); err != nil {
+		add("invalid target URL %s: %v", c.TargetURL, err)
+	} else if u.Scheme == "" {
+		add("invalid target URL %s: missing scheme", c.TargetURL)
+	} else {
+		for _, p := range c.backendProblems(u.Scheme) {
+			add("%s", p)
+		}
+	}
+
+	if c.Email.Host != "" && (c.Email.From == "" || len(c.Email.To) == 0) {
+		add("email host set without sender or recipients, use CONPLICITY_EMAIL_FROM and CONPLICITY_EMAIL_TO")
+	}
+
+	for _, p := range c.ExtraPaths {
+		if _, err := ParseExtraPath(p); err != nil {
+			add("%v", err)
+		}
+	}
+
+	if c.Schedule != "" {
+		if _, err := schedule.Parse(c.Schedule); err != nil {
+			add("%v", err)
+		}
+	}
+
+	if c.Parallelism < 1 {
+		add("invalid --parallelism value %d, expected at least 1 volume at a time", c.Parallelism)
+	}
+
+	if !IsQuiesceMode(c.QuiesceMode) {
+		add("invalid --quiesce-mode value %s, expected pause or stop", c.QuiesceMode)
+	}
+
+	switch c.Engine {
+	case "duplicity", "rclone":
+	case "restic":
+		if c.Restic.Password == "" && c.Restic.PasswordFile == "" {
+			add("no restic password set, use RESTIC_PASSWORD or RESTIC_PASSWORD_FILE")
+		}
+	case "borg":
+		if c.Borg.Passphrase == "" && c.Borg.PassphraseFile == "" && c.Borg.Encryption != "none" {
+			add("no borg passphrase set, use BORG_PASSPHRASE or BORG_PASSPHRASE_FILE")
+		}
+		if u, err := url.Parse(c.TargetURL); err == nil && u.Scheme != "" && u.Scheme != "ssh" {
+			add("borg target %s is not supported, expected ssh://[user@]host[:port]/path", c.TargetURL)
+		}
+	case "tar":
+		if u, err := url.Parse(c.TargetURL); err == nil && u.Scheme != "" && u.Scheme != "file" {
+			add("tar target %s is not supported, expected file:///path", c.TargetURL)
+		}
+	default:
+		add("unknown engine %s, expected duplicity, rclone, restic, borg or tar", c.Engine)
+	}
+
+	for _, o := range []option{
+		{"full-if-older-than", c.Duplicity.FullIfOlderThan},
+		{"remove-older-than", c.Duplicity.RemoveOlderThan},
+	} {
+		if o.value != "" && !duplicityTimeRx.MatchString(o.value) {
+			add("invalid --%s value %s, expected a duplicity time such as '15D'", o.name, o.value)
+		}
+	}
+
+	for _, o := range []option{
+		{"restic-keep-last", c.Restic.KeepLast},
+		{"restic-keep-daily", c.Restic.KeepDaily},
+		{"restic-keep-weekly", c.Restic.KeepWeekly},
+		{"restic-keep-monthly", c.Restic.KeepMonthly},
+	} {
+		if n, err := strconv.Atoi(o.value); o.value != "" && (err != nil || n < 0) {
+			add("invalid --%s value %s, expected a number of snapshots", o.name, o.value)
+		}
+	}
+	if v := c.Restic.KeepWithin; v != "" && !resticDurationRx.MatchString(v) {
+		add("invalid --restic-keep-within value %s, expected a restic duration such as '30d' or '1y6m'", v)
+	}
+	if v := c.Restic.CheckReadDataPercent; v < 0 || v > 100 {
+		add("invalid --restic-check-read-data-percent value %d, expected a percentage between 0 and 100", v)
+	}
+	if v := c.Restic.PackSize; v < 0 {
+		add("invalid --restic-pack-size value %d, expected a size in MiB", v)
+	}
+	switch c.Restic.Compression {
+	case "", "auto", "max", "off":
+	default:
+		add("invalid --restic-compression value %s, expected auto, max or off", c.Restic.Compression)
+	}
+
+	for _, o := range []option{
+		{"borg-keep-last", c.Borg.KeepLast},
+		{"borg-keep-daily", c.Borg.KeepDaily},
+		{"borg-keep-weekly", c.Borg.KeepWeekly},
+		{"borg-keep-monthly", c.Borg.KeepMonthly},
+	} {
+		if n, err := strconv.Atoi(o.value); o.value != "" && (err != nil || n < 0) {
+			add("invalid --%s value %s, expected a number of archives", o.name, o.value)
+		}
+	}
+	if v := c.Borg.KeepWithin; v != "" && !borgIntervalRx.MatchString(v) {
+		add("invalid --borg-keep-within value %s, expected a borg interval such as '7d' or '2w'", v)
+	}
+	switch c.Borg.Encryption {
+	case "", "none", "repokey", "keyfile", "repokey-blake2", "keyfile-blake2", "authenticated", "authenticated-blake2":
+	default:
+		add("invalid --borg-encryption value %s, expected a borg encryption mode such as repokey", c.Borg.Encryption)
+	}
+
+	for _, o := range c.images() {
+		if _, err := reference.Parse(o.value); o.value != "" && err != nil {
+			add("invalid --%s value %s: %v", o.name, o.value, err)
+		}
+	}
+
+	if v := c.Resources.Memory; v != "" {
+		if _, err := units.RAMInBytes(v); err != nil {
+			add("invalid --memory-limit value %s, expected a size such as '512m'", v)
+		}
+	}
+	if v := c.Resources.CPUShares; v < 0 {
+		add("invalid --cpu-shares value %d, expected a positive weight", v)
+	}
+	if v := c.Resources.CPUs; v < 0 {
+		add("invalid --cpus value %v, expected a positive number of CPUs", v)
+	}
+
+	for _, o := range []option{
+		{"check-every", c.CheckEvery},
+		{"frequency", c.Frequency},
+		{"timeout", c.Timeout},
+		{"docker-poll-interval", c.Docker.PollInterval},
+		{"restic-check-every", c.Restic.CheckEvery},
+		{"restic-deep-check-every", c.Restic.DeepCheckEvery},
+		{"restic-check-no-cache-every", c.Restic.CheckNoCacheEvery},
+		{"restic-retry-delay", c.Restic.RetryDelay},
+		{"metrics-grace-period", c.Metrics.GracePeriod},
+	} {
+		if _, err := time.ParseDuration(o.value); o.value != "" && err != nil {
+			add("invalid --%s value %s, expected a duration such as '24h'", o.name, o.value)
+		}
+	}
+
+	for _, o := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"volume-whitelist", c.VolumeWhitelist},
+		{"volume-blacklist", c.VolumeBlacklist},
+	} {
+		for _, p := range o.patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				add("invalid --%s pattern %s: %v", o.name, p, err)
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+// images returns the images of the containers launched by conplicity
+func (c *Config) images() []option {
+	return []option{
+		{"duplicity-image", c.Duplicity.Image},
+		{"rclone-image", c.RClone.Image},
+		{"restic-image", c.Restic.Image},
+		{"borg-image", c.Borg.Image},
+		{"tar-image", c.Tar.Image},
+		{"hook-image", c.HookImage},
+		{"post-run-image", c.PostRun.Image},
+	}
+}
+
+// UnpinnedImages returns the images referenced by the latest tag or
+// without tag, which make backups non-reproducible
+func (c *Config) UnpinnedImages() (images []string) {
+	for _, o := range c.images() {
+		ref, err := reference.Parse(o.value)
+		if err != nil {
+			continue
+		}
+		if _, ok := ref.(reference.Digested); ok {
+			continue
+		}
+		if t, ok := ref.(reference.Tagged); ok && t.Tag() != "latest" {
+			continue
+		}
+		images = append(images, o.value)
+	}
+	return
+}
+
+// backendProblems returns the missing credentials of the storage backend
+// of the target URL scheme
+func (c *Config) backendProblems(scheme string) (problems []string) {
+	switch strings.SplitN(scheme, "+", 2)[0] {
+	case "s3":
+		if c.AWS.AccessKeyID == "" || c.AWS.SecretAccessKey == "" {
+			problems = append(problems, "S3 target without AWS credentials, use AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+	case "swift":
+		appCredential := c.Swift.ApplicationCredentialID != "" && c.Swift.ApplicationCredentialSecret != ""
+		switch {
+		case c.Swift.AuthVersion != 2 && c.Swift.AuthVersion != 3:
+			problems = append(problems, fmt.Sprintf("invalid --swift-auth-version value %d, expected 2 or 3", c.Swift.AuthVersion))
+		case appCredential && c.Swift.AuthVersion != 3:
+			problems = append(problems, "Swift application credentials require Keystone v3, use SWIFT_AUTHVERSION=3")
+		case appCredential && c.Engine == "duplicity":
+			problems = append(problems, "Swift application credentials are not supported by duplicity, use SWIFT_USERNAME and SWIFT_PASSWORD")
+		case !appCredential && (c.Swift.Username == "" || c.Swift.Password == ""):
+			problems = append(problems, "Swift target without Swift credentials, use SWIFT_USERNAME and SWIFT_PASSWORD")
+		}
+	case "b2":
+		if c.B2.AccountID == "" || c.B2.AccountKey == "" {
+			problems = append(problems, "B2 target without B2 credentials, use B2_ACCOUNT_ID and B2_ACCOUNT_KEY")
+		}
+	case "azure":
+		if c.Azure.AccountName == "" || c.Azure.AccountKey == "" {
+			problems = append(problems, "Azure target without Azure credentials, use AZURE_ACCOUNT_NAME and AZURE_ACCOUNT_KEY")
+		}
+	case "rclone":
+		if c.RClone.ConfigPath == "" {
+			problems = append(problems, "rclone target without rclone config, use RCLONE_CONFIG_PATH")
+		}
+	case "gs":
+		if c.GCS.Credentials == "" {
+			problems = append(problems, "Google Cloud Storage target without credentials, use GOOGLE_APPLICATION_CREDENTIALS")
+		}
+	}
+	return
+}
+
+// IsQuiesceMode tells whether mode is a valid way of quiescing containers,
+// empty meaning pause
+func IsQuiesceMode(mode string) bool {
+	switch mode {
+	case "", "pause", "stop":
+		return true
+	}
+	return false
+}
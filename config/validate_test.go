@@ -0,0 +1,236 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// validConfig returns a valid restic config
+func validConfig() *Config {
+	c := &Config{
+		Engine:      "restic",
+		TargetURL:   "s3:s3.amazonaws.com/backups",
+		CheckEvery:  "24h",
+		Parallelism: 1,
+	}
+	c.AWS.AccessKeyID = "foo"
+	c.AWS.SecretAccessKey = "bar"
+	c.Restic.Password = "secret"
+	c.Duplicity.FullIfOlderThan = "15D"
+	c.Duplicity.RemoveOlderThan = "30D"
+	c.Docker.PollInterval = "1s"
+	c.Swift.AuthVersion = 2
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	c := validConfig()
+	c.TargetURL = ""
+	c.Restic.RepositoryFile = "/etc/restic/repository"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected a repository file to replace the target URL, got %v", err)
+	}
+
+	c = validConfig()
+	c.TargetURL = "swift://backups"
+	c.Restic.Password = ""
+	c.Duplicity.RemoveOlderThan = "30 days"
+	c.Restic.KeepDaily = "-1"
+	c.Restic.KeepWithin = "30D"
+	c.Restic.CheckReadDataPercent = 150
+	c.Restic.Compression = "zstd"
+	c.Restic.Image = "Restic/Restic"
+	c.Borg.KeepWithin = "7 days"
+	c.Borg.Encryption = "aes"
+	c.Resources.Memory = "lots"
+	c.CheckEvery = "1d"
+	c.VolumeBlacklist = []string{"^tmp", "(foo"}
+	c.Email.Host = "smtp.example.com"
+	c.Schedule = "daily"
+	c.Parallelism = 0
+	c.QuiesceMode = "freeze"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+
+	expected := []string{
+		"Swift target without Swift credentials",
+		"email host set without sender or recipients",
+		"invalid schedule daily",
+		"invalid --parallelism value 0",
+		"invalid --quiesce-mode value freeze",
+		"no restic password set",
+		"invalid --remove-older-than value 30 days",
+		"invalid --restic-keep-daily value -1",
+		"invalid --restic-keep-within value 30D",
+		"invalid --restic-check-read-data-percent value 150",
+		"invalid --restic-compression value zstd",
+		"invalid --borg-keep-within value 7 days",
+		"invalid --borg-encryption value aes",
+		"invalid --restic-image value Restic/Restic",
+		"invalid --memory-limit value lots",
+		"invalid --check-every value 1d",
+		"invalid --volume-blacklist pattern (foo",
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != len(expected)+1 {
+		t.Fatalf("Expected %d problems, got %s", len(expected), err)
+	}
+	for i, e := range expected {
+		if !strings.Contains(lines[i+1], e) {
+			t.Fatalf("Expected problem %q, got %q", e, lines[i+1])
+		}
+	}
+}
+
+func TestUnpinnedImages(t *testing.T) {
+	c := validConfig()
+	c.Duplicity.Image = "camptocamp/duplicity"
+	c.RClone.Image = "camptocamp/rclone:1.33-1"
+	c.Restic.Image = "restic/restic:latest"
+	c.HookImage = "alpine@sha256:" + strings.Repeat("a", 64)
+
+	if got, expected := strings.Join(c.UnpinnedImages(), ","), "camptocamp/duplicity,restic/restic:latest"; got != expected {
+		t.Fatalf("Expected unpinned images %s, got %s", expected, got)
+	}
+}
+
+func TestValidateTargetURL(t *testing.T) {
+	for _, target := range []string{"", "/backups", "%gh&%ij"} {
+		c := validConfig()
+		c.TargetURL = target
+		if err := c.Validate(); err == nil {
+			t.Fatalf("Expected an error for target URL %q, got no error", target)
+		}
+	}
+}
+
+func TestValidateBackendCredentials(t *testing.T) {
+	for target, problem := range map[string]string{
+		"swift://backups":         "Swift target without Swift credentials",
+		"b2:bucket:backups":       "B2 target without B2 credentials",
+		"azure:backups:/":         "Azure target without Azure credentials",
+		"azure://backups":         "Azure target without Azure credentials",
+		"gs:bucket:/backups":      "Google Cloud Storage target without credentials",
+		"rclone:onedrive:backups": "rclone target without rclone config",
+		"s3:s3.amazonaws.com/foo": "",
+	} {
+		c := validConfig()
+		c.TargetURL = target
+		err := c.Validate()
+		if problem == "" {
+			if err != nil {
+				t.Fatalf("Expected no error for target %s, got %v", target, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Expected problem %q for target %s, got %v", problem, target, err)
+		}
+	}
+
+	c := validConfig()
+	c.TargetURL = "azure:backups:/"
+	c.Azure.AccountName = "foo"
+	c.Azure.AccountKey = "bar"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected no error with Azure credentials, got %v", err)
+	}
+}
+
+func TestValidateBorg(t *testing.T) {
+	c := validConfig()
+	c.Engine = "borg"
+	c.TargetURL = "ssh://backup@example.com:2222/srv/borg"
+	c.Borg.Passphrase = "secret"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	c.Borg.Passphrase = ""
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "no borg passphrase set") {
+		t.Fatalf("Expected a missing passphrase error, got %v", err)
+	}
+	c.Borg.Encryption = "none"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected no passphrase to be needed without encryption, got %v", err)
+	}
+
+	c.TargetURL = "s3:s3.amazonaws.com/backups"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "borg target s3:s3.amazonaws.com/backups is not supported") {
+		t.Fatalf("Expected an unsupported target error, got %v", err)
+	}
+}
+
+func TestValidateTar(t *testing.T) {
+	c := validConfig()
+	c.Engine = "tar"
+	c.TargetURL = "file:///srv/backups"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	c.TargetURL = "ssh://backup@example.com/srv/backups"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "tar target ssh://backup@example.com/srv/backups is not supported") {
+		t.Fatalf("Expected an unsupported target error, got %v", err)
+	}
+}
+
+func TestValidateSwiftAuth(t *testing.T) {
+	c := validConfig()
+	c.TargetURL = "swift://backups"
+	c.Swift.ApplicationCredentialID = "id"
+	c.Swift.ApplicationCredentialSecret = "secret"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "Swift application credentials require Keystone v3") {
+		t.Fatalf("Expected a Keystone version error, got %v", err)
+	}
+
+	c.Swift.AuthVersion = 3
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	c.Engine = "duplicity"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "not supported by duplicity") {
+		t.Fatalf("Expected an unsupported credentials error, got %v", err)
+	}
+
+	c.Swift.AuthVersion = 1
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "invalid --swift-auth-version value 1") {
+		t.Fatalf("Expected an invalid version error, got %v", err)
+	}
+}
+
+func TestDuplicityTimeRx(t *testing.T) {
+	for _, v := range []string{"15D", "1h30m", "2W", "1Y", "2017-03-01", "2017-03-01T02:00:00", "now", "1488333612"} {
+		if !duplicityTimeRx.MatchString(v) {
+			t.Fatalf("Expected %s to be a valid duplicity time", v)
+		}
+	}
+	for _, v := range []string{"", "D", "15 days", "15d"} {
+		if duplicityTimeRx.MatchString(v) {
+			t.Fatalf("Expected %s to be an invalid duplicity time", v)
+		}
+	}
+}
+
+func TestParseExtraPath(t *testing.T) {
+	p, err := ParseExtraPath("etc:/etc/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if p.Name != "etc" || p.Path != "/etc" {
+		t.Fatalf("Expected etc:/etc, got %+v", p)
+	}
+
+	for _, s := range []string{"/etc", "etc", ":/etc", "etc:relative/path"} {
+		if _, err := ParseExtraPath(s); err == nil {
+			t.Fatalf("Expected an error for %s, got nil", s)
+		}
+	}
+}
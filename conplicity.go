@@ -1,13 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/camptocamp/conplicity/engines"
 	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
 	"github.com/camptocamp/conplicity/providers"
+	"github.com/camptocamp/conplicity/report"
+	"github.com/camptocamp/conplicity/schedule"
 	"github.com/camptocamp/conplicity/util"
 	"github.com/camptocamp/conplicity/volume"
 )
@@ -16,35 +34,702 @@ var version = "undefined"
 
 func main() {
 	var err error
-	var exitCode int
 
 	c, err := handler.NewConplicity(version)
 	util.CheckErr(err, "Failed to setup Conplicity handler: %v", "fatal")
+	c.HandleSignals()
+
+	if c.Config.Command == "restore" {
+		err = restore(c)
+		util.CheckErr(err, "Failed to restore volume: %v", "fatal")
+		os.Exit(0)
+	}
+
+	if c.Config.Command == "forget-snapshot" {
+		err = forgetSnapshot(c)
+		util.CheckErr(err, "Failed to forget snapshot: %v", "fatal")
+		os.Exit(0)
+	}
+
+	if c.Config.Command == "verify" {
+		err = verify(c)
+		util.CheckErr(err, "Failed to verify volume: %v", "fatal")
+		os.Exit(0)
+	}
+
+	if c.Config.Command == "init" {
+		failures, err := initTargets(c, os.Stdout)
+		util.CheckErr(err, "Failed to initialize targets: %v", "fatal")
+		os.Exit(exitCode(failures))
+	}
+
+	if c.Config.Command == "retention-preview" {
+		err = retentionPreview(c, os.Stdout)
+		util.CheckErr(err, "Failed to preview retention: %v", "fatal")
+		os.Exit(0)
+	}
+
+	var server *http.Server
+	if addr := c.Config.Metrics.ListenAddr; addr != "" {
+		server, err = metrics.Serve(addr)
+		util.CheckErr(err, "Failed to serve metrics: %v", "fatal")
+	}
+
+	if c.Config.Schedule != "" && !c.Config.Once {
+		sched, err := schedule.Parse(c.Config.Schedule)
+		util.CheckErr(err, "Failed to parse schedule: %v", "fatal")
+		runDaemon(c, sched)
+		if server != nil {
+			shutdownMetrics(server)
+		}
+		os.Exit(0)
+	}
+
+	failures, err := backupRun(c)
+	util.CheckErr(err, "%v", "fatal")
+	if server != nil {
+		stopMetrics(c, server)
+	}
+	os.Exit(exitCode(failures))
+}
+
+// runDaemon backs up volumes on schedule until conplicity is asked to
+// stop. Runs never overlap: the next run is scheduled once the previous
+// one is over, skipping the runs it overlapped.
+func runDaemon(c *handler.Conplicity, sched schedule.Schedule) {
+	for {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			log.Error("No backup run left to schedule")
+			return
+		}
+		log.WithFields(log.Fields{
+			"next_run": next,
+		}).Info("Waiting for the next backup run")
+
+		timer := time.NewTimer(next.Sub(time.Now()))
+		select {
+		case <-c.Context().Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		_, err := backupRun(c)
+		util.CheckErr(err, "%v", "error")
+
+		if missed := sched.Next(next); !missed.IsZero() && time.Now().After(missed) {
+			log.WithFields(log.Fields{
+				"missed_run": missed,
+			}).Warning("Backup run lasted longer than the schedule interval, skipping the runs it overlapped")
+		}
+	}
+}
 
+// backupRun backs up all volumes and returns the number of failed backups
+func backupRun(c *handler.Conplicity) (failures int, err error) {
 	log.Infof("Conplicity v%s starting backup...", version)
+	c.ResetRun()
+	metrics.Reset()
+
+	vols, err := c.GetVolumes()
+	if err != nil {
+		err = fmt.Errorf("Failed to get Docker volumes: %v", err)
+		return
+	}
+
+	run := report.NewRun(c.Hostname)
+	all := vols
+	if c.Config.PauseProjects {
+		projects, projectVols, others := groupByProject(vols)
+		for _, p := range projects {
+			backupProject(c, run, p, projectVols[p])
+		}
+		vols = others
+	}
+
+	backup := func(vol *volume.Volume) {
+		runBackup(c, run, vol)
+	}
+	forEachByStrategy(c, vols, backup)
+
+	if c.Config.BackupSelf {
+		util.CheckErr(backupSelf(c, run, all), "Failed to backup conplicity state: %v", "error")
+	}
+
+	run.Finish()
+	log.WithFields(log.Fields{
+		"volumes":  len(run.Results),
+		"failures": run.Failures,
+		"failed":   strings.Join(run.FailedVolumes(), ", "),
+	}).Info("Backup run summary")
+	util.CheckErr(metrics.PushAll(), "Failed to push metrics: %v", "warn")
+	if f := c.Config.Metrics.TextfilePath; f != "" {
+		util.CheckErr(metrics.WriteTextfile(f), "Failed to write metrics file: %v", "warn")
+	}
+	if i := c.Config.Influx; i.URL != "" {
+		util.CheckErr(metrics.WriteInflux(&metrics.InfluxDB{
+			URL:      i.URL,
+			Database: i.Database,
+			Org:      i.Org,
+			Token:    i.Token,
+		}), "Failed to write metrics to InfluxDB: %v", "warn")
+	}
+	notify(c, run)
+
+	if c.Config.PostRun.Command != "" {
+		util.CheckErr(postRun(c, run), "Failed to run post-run command: %v", "error")
+	}
+
+	log.Infof("End backup...")
+	return run.Failures, nil
+}
+
+// maxExitCode is the highest exit code not reserved by shells
+const maxExitCode = 125
+
+// exitCode returns the exit code of a backup run: the number of volumes
+// whose backup failed, capped so it cannot be mistaken for a signal
+func exitCode(failures int) int {
+	if failures > maxExitCode {
+		return maxExitCode
+	}
+	return failures
+}
+
+// notify sends the summary of the run to Slack and by email.
+// Notifications are best-effort and do not change the exit code.
+func notify(c *handler.Conplicity, run *report.Run) {
+	if c.Config.Slack.WebhookURL != "" {
+		util.CheckErr(run.NotifySlack(c.Config.Slack.WebhookURL), "Failed to notify Slack: %v", "warn")
+	}
+
+	// Emails are only sent on failure unless asked otherwise
+	if e := c.Config.Email; e.Host != "" && (run.Failures > 0 || e.NotifyOnSuccess) {
+		err := run.SendEmail(&report.Mailer{
+			Addr:     net.JoinHostPort(e.Host, strconv.Itoa(e.Port)),
+			From:     e.From,
+			To:       e.To,
+			Username: e.Username,
+			Password: e.Password,
+		})
+		util.CheckErr(err, "Failed to send email: %v", "warn")
+	}
+}
+
+// stopMetrics stops serving the metrics after the grace period,
+// leaving Prometheus time to scrape the metrics of the run
+func stopMetrics(c *handler.Conplicity, server *http.Server) {
+	grace, err := time.ParseDuration(c.Config.Metrics.GracePeriod)
+	if err != nil {
+		log.Errorf("Failed to parse the parameter 'metrics-grace-period': %v", err)
+	} else {
+		log.Infof("Serving metrics for %v before exiting", grace)
+		time.Sleep(grace)
+	}
+
+	shutdownMetrics(server)
+}
+
+// shutdownMetrics stops serving the metrics
+func shutdownMetrics(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	util.CheckErr(server.Shutdown(ctx), "Failed to stop serving metrics: %v", "error")
+}
+
+// outputMutex serializes the JSON results of concurrent backups on stdout
+var outputMutex sync.Mutex
+
+// runBackup backs up a volume and adds its result to the run
+func runBackup(c *handler.Conplicity, run *report.Run, vol *volume.Volume) {
+	res := newBackupResult(vol)
+	// Do not start new backups once asked to stop
+	if c.Context().Err() != nil {
+		finishBackup(c, run, vol, res, errors.New("interrupted before backup"))
+		return
+	}
+	err := backupVolume(c, vol, res)
+	finishBackup(c, run, vol, res, err)
+}
+
+// newBackupResult starts the backup of a volume
+func newBackupResult(vol *volume.Volume) *report.BackupResult {
+	res := report.NewBackupResult(vol.Name)
+	res.Project = vol.ComposeProject()
+	vol.LogTime("backupStartTime")
+	return res
+}
+
+// finishBackup ends the backup of a volume and adds its result to the run
+func finishBackup(c *handler.Conplicity, run *report.Run, vol *volume.Volume, res *report.BackupResult, err error) {
+	vol.LogTime("backupEndTime")
+	vol.LogResult(err == nil)
+	res.Finish(err)
+	run.Add(res)
+	if c.Config.Backup.ResultsJSON {
+		outputMutex.Lock()
+		err := res.WriteJSON(os.Stdout)
+		outputMutex.Unlock()
+		util.CheckErr(err, "Failed to write backup result: %v", "error")
+	}
+	if err != nil {
+		vol.Log().Errorf("Failed to backup volume: %v", err)
+	}
+}
+
+// forEachByStrategy calls fn on each volume in the order and with the
+// parallelism required by the backup strategy
+func forEachByStrategy(c *handler.Conplicity, vols []*volume.Volume, fn func(*volume.Volume)) {
+	switch c.Config.Strategy {
+	case "priority-then-parallel":
+		priority, others := splitByPriority(c, vols)
+		forEachVolume(priority, 1, fn)
+		forEachVolume(others, c.Config.Parallelism, fn)
+	default:
+		forEachVolume(vols, c.Config.Parallelism, fn)
+	}
+}
+
+// forEachVolume calls fn for each volume with at most workers calls at the
+// same time, or all at once if workers is 0. Volumes are handled in order
+// with a single worker.
+func forEachVolume(vols []*volume.Volume, workers int, fn func(*volume.Volume)) {
+	if workers <= 0 || workers > len(vols) {
+		workers = len(vols)
+	}
+
+	queue := make(chan *volume.Volume)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for vol := range queue {
+				fn(vol)
+			}
+		}()
+	}
+	for _, vol := range vols {
+		queue <- vol
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// groupByProject separates the volumes of Docker Compose projects,
+// grouped by project, from the other volumes
+func groupByProject(vols []*volume.Volume) (projects []string, projectVols map[string][]*volume.Volume, others []*volume.Volume) {
+	projectVols = make(map[string][]*volume.Volume)
+	for _, vol := range vols {
+		p := vol.ComposeProject()
+		if p == "" {
+			others = append(others, vol)
+			continue
+		}
+		if _, ok := projectVols[p]; !ok {
+			projects = append(projects, p)
+		}
+		projectVols[p] = append(projectVols[p], vol)
+	}
+	return
+}
+
+// backupProject backs up the volumes of a Docker Compose project together,
+// with all the project's containers paused once their data is prepared
+func backupProject(c *handler.Conplicity, run *report.Run, project string, vols []*volume.Volume) {
+	type pending struct {
+		res *report.BackupResult
+		bkp *preparedBackup
+	}
+
+	var backups []pending
+	for _, vol := range vols {
+		res := newBackupResult(vol)
+		bkp, err := prepareBackup(c, vol, res)
+		if err != nil || bkp == nil {
+			finishBackup(c, run, vol, res, err)
+			continue
+		}
+		backups = append(backups, pending{res, bkp})
+	}
+	if len(backups) == 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"project": project,
+	}).Info("Pausing Docker Compose project")
+	paused, err := c.PauseProject(project)
+	if err != nil {
+		err = fmt.Errorf("failed to pause project %s: %v", project, err)
+		for _, b := range backups {
+			finishBackup(c, run, b.bkp.vol, b.res, err)
+		}
+		return
+	}
+
+	for _, b := range backups {
+		finishBackup(c, run, b.bkp.vol, b.res, b.bkp.run())
+	}
+
+	err = c.UnpauseContainers(paused)
+	util.CheckErr(err, "Failed to unpause project containers: %v", "error")
+}
+
+// splitByPriority separates the volumes labeled as priority and the database
+// volumes, which are backed up first, from the other volumes
+func splitByPriority(c *handler.Conplicity, vols []*volume.Volume) (priority, others []*volume.Volume) {
+	for _, vol := range vols {
+		if vol.Config.Priority || providers.GetProvider(c, vol).GetName() != "Default" {
+			priority = append(priority, vol)
+		} else {
+			others = append(others, vol)
+		}
+	}
+	return
+}
+
+// selfState is conplicity's own state, backed up for disaster recovery
+type selfState struct {
+	Run     *report.Run   `json:"run"`
+	Volumes []volumeState `json:"volumes"`
+}
+
+// volumeState is the resolved configuration and state of a volume
+type volumeState struct {
+	Name       string               `json:"name"`
+	Config     *volume.Config       `json:"config"`
+	StateFiles map[string]time.Time `json:"state_files"`
+}
+
+// backupSelf writes conplicity's state to its own volume and backs it up
+func backupSelf(c *handler.Conplicity, run *report.Run, vols []*volume.Volume) (err error) {
+	if c.Config.DryRun {
+		log.Info("Dry run, not backing up conplicity's state")
+		return
+	}
+
+	self, err := c.GetSelfVolume()
+	if err != nil {
+		return
+	}
+	if self.MountByName {
+		return fmt.Errorf("volume %s has no local mountpoint to write the state to", self.Name)
+	}
+
+	state := selfState{
+		Run: run,
+	}
+	for _, vol := range vols {
+		state.Volumes = append(state.Volumes, volumeState{
+			Name:       vol.Name,
+			Config:     vol.Config,
+			StateFiles: vol.StateFiles(),
+		})
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+	err = ioutil.WriteFile(self.Mountpoint+"/conplicity.json", data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+
+	runBackup(c, run, self)
+	return
+}
+
+// postRun runs the post-run command, on the host or in a container,
+// passing it the run summary and recording its exit code in the run
+func postRun(c *handler.Conplicity, run *report.Run) (err error) {
+	summary, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("failed to encode run summary: %v", err)
+	}
+
+	cmd := c.Config.PostRun.Command
+	env := []string{"CONPLICITY_RUN_SUMMARY=" + string(summary)}
+	log.WithFields(log.Fields{
+		"command": cmd,
+		"image":   c.Config.PostRun.Image,
+	}).Info("Running post-run command")
+
+	var state int
+	var stdout string
+	if c.Config.PostRun.Image != "" {
+		var stderr string
+		state, stdout, stderr, err = engines.LaunchContainer(c, nil, c.Config.PostRun.Image, []string{"sh", "-c", cmd}, nil, env)
+		if err != nil {
+			return fmt.Errorf("failed to launch post-run container: %v", err)
+		}
+		stdout += stderr
+	} else if c.Config.DryRun {
+		log.WithFields(log.Fields{
+			"command": cmd,
+		}).Info("Dry run, not running post-run command on the host")
+		return
+	} else {
+		command := exec.Command("sh", "-c", cmd)
+		command.Env = append(os.Environ(), env...)
+		command.Stdin = bytes.NewReader(summary)
+		out, err := command.CombinedOutput()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			return fmt.Errorf("failed to run post-run command: %v", err)
+		}
+		state = command.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+		stdout = string(out)
+	}
 
+	run.PostRunExitCode = &state
+	log.WithFields(log.Fields{
+		"exit_code": state,
+	}).Debug(stdout)
+	if state != 0 {
+		err = fmt.Errorf("post-run command exited with state %v", state)
+	}
+	return
+}
+
+// retentionPreview prints the backups the retention policy
+// of each volume would remove
+func retentionPreview(c *handler.Conplicity, w io.Writer) (err error) {
 	vols, err := c.GetVolumes()
-	util.CheckErr(err, "Failed to get Docker volumes: %v", "fatal")
+	if err != nil {
+		return
+	}
 
 	for _, vol := range vols {
-		vol.LogTime("backupStartTime")
-		err = backupVolume(c, vol)
-		vol.LogTime("backupEndTime")
+		e := engines.GetEngine(c, vol)
+		if e == nil {
+			fmt.Fprintf(w, "%s: unknown engine %s\n", vol.Name, vol.Config.Engine)
+			continue
+		}
+		p, ok := e.(engines.RetentionPreviewer)
+		if !ok {
+			fmt.Fprintf(w, "%s: no retention with engine %s\n", vol.Name, e.GetName())
+			continue
+		}
+
+		var backups []string
+		backups, err = p.PreviewRetention()
+		if err == engines.ErrNoRetentionPolicy {
+			fmt.Fprintf(w, "%s: %v, backups are kept forever\n", vol.Name, err)
+			err = nil
+			continue
+		}
 		if err != nil {
-			log.Errorf("Failed to backup volume %s: %v", vol.Name, err)
-			exitCode = 1
+			return fmt.Errorf("failed to preview retention of volume %s: %v", vol.Name, err)
+		}
+		fmt.Fprintf(w, "%s: %d backups would be removed\n", vol.Name, len(backups))
+		for _, b := range backups {
+			fmt.Fprintf(w, "  %s\n", b)
+		}
+	}
+	return
+}
+
+// initTargets initializes the targets of all volumes without backing them
+// up, reporting the result of each volume to w. It returns the number of
+// volumes whose target could not be initialized.
+func initTargets(c *handler.Conplicity, w io.Writer) (failures int, err error) {
+	vols, err := c.GetVolumes()
+	if err != nil {
+		return
+	}
+
+	for _, vol := range vols {
+		e := engines.GetEngine(c, vol)
+		if e == nil {
+			fmt.Fprintf(w, "%s: unknown engine %s\n", vol.Name, vol.Config.Engine)
+			continue
+		}
+		i, ok := e.(engines.Initializer)
+		if !ok {
+			fmt.Fprintf(w, "%s: nothing to initialize with engine %s\n", vol.Name, e.GetName())
 			continue
 		}
+
+		vol.Log().Info("Initializing target")
+		if err := i.Init(); err != nil {
+			failures++
+			vol.Log().Errorf("Failed to initialize target: %v", err)
+			fmt.Fprintf(w, "%s: failed: %v\n", vol.Name, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s: initialized\n", vol.Name)
+	}
+	return
+}
+
+// restore restores a volume from a restic snapshot or a duplicity backup
+func restore(c *handler.Conplicity) (err error) {
+	opts := c.Config.Restore
+
+	vol, err := c.GetVolume(opts.Volume)
+	if err != nil {
+		return
 	}
 
-	log.Infof("End backup...")
-	os.Exit(exitCode)
+	e := engines.GetEngine(c, vol)
+	if e == nil {
+		return fmt.Errorf("unknown engine %s for volume %s", vol.Config.Engine, vol.Name)
+	}
+
+	fields := log.Fields{
+		"engine": e.GetName(),
+	}
+	if _, ok := e.(*engines.ResticEngine); ok {
+		fields["snapshot"] = opts.Snapshot
+		fields["target"] = opts.Target
+	} else {
+		fields["time"] = opts.Time
+		// Database dumps are restored to their dump directory
+		providers.GetProvider(c, vol).SetVolumeBackupDir()
+	}
+	vol.Log().WithFields(fields).Info("Restoring volume")
+
+	err = e.Restore(engines.RestoreOptions{
+		Snapshot: opts.Snapshot,
+		Target:   opts.Target,
+		Include:  opts.Include,
+		Time:     opts.Time,
+	})
+	util.CheckErr(vol.MetricsHandler.Push(), "Failed to push metrics: %v", "error")
+	return
+}
+
+// forgetSnapshot removes a single snapshot from a volume's restic repository
+func forgetSnapshot(c *handler.Conplicity) (err error) {
+	opts := c.Config.ForgetSnapshot
+	if !opts.Yes {
+		return fmt.Errorf("refusing to forget snapshot %s of volume %s without --yes", opts.Args.SnapshotID, opts.Volume)
+	}
+
+	vol, err := c.GetVolume(opts.Volume)
+	if err != nil {
+		return
+	}
+
+	r, ok := engines.GetEngine(c, vol).(*engines.ResticEngine)
+	if !ok {
+		return fmt.Errorf("volume %s is not backed up with restic", vol.Name)
+	}
+	return r.ForgetSnapshot(opts.Args.SnapshotID)
 }
 
-func backupVolume(c *handler.Conplicity, vol *volume.Volume) (err error) {
+// runHook runs a backup command of the volume with sh -c in a container,
+// with the volume mounted at its path in backup containers, and logs its output
+func runHook(c *handler.Conplicity, vol *volume.Volume, hook, command string) (err error) {
+	if command == "" {
+		return
+	}
+
+	vol.Log().WithFields(log.Fields{
+		"hook":    hook,
+		"command": command,
+	}).Info("Running backup hook")
+	// LaunchContainer logs the output of the hook as it runs
+	state, _, stderr, err := engines.LaunchContainer(
+		c, vol, c.Config.HookImage,
+		[]string{"sh", "-c", command},
+		[]string{vol.MountSource() + ":" + vol.ContainerPath()},
+		[]string{
+			"CONPLICITY_VOLUME=" + vol.Name,
+			"CONPLICITY_VOLUME_PATH=" + vol.ContainerPath(),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to launch %s command: %v", hook, err)
+	}
+
+	if state != 0 {
+		err = fmt.Errorf("%s command exited with state %v: %s", hook, state, strings.TrimSpace(stderr))
+	}
+	return
+}
+
+// runPostHook runs the post-backup command of the volume, logging its failure
+func runPostHook(c *handler.Conplicity, vol *volume.Volume) {
+	err := runHook(c, vol, "post-backup", vol.Config.PostBackupCommand)
+	util.CheckErr(err, "Failed to run post-backup command: %v", "error")
+}
+
+// verify checks the backup of a volume on demand
+func verify(c *handler.Conplicity) (err error) {
+	vol, err := c.GetVolume(c.Config.Verify.Volume)
+	if err != nil {
+		return
+	}
+
+	e := engines.GetEngine(c, vol)
+	if e == nil {
+		return fmt.Errorf("unknown engine %s for volume %s", vol.Config.Engine, vol.Name)
+	}
+
+	vol.Log().WithFields(log.Fields{
+		"engine": e.GetName(),
+	}).Info("Verifying backup")
+	err = e.Verify()
+	util.CheckErr(vol.MetricsHandler.Push(), "Failed to push metrics: %v", "error")
+	return
+}
+
+// preparedBackup is a volume backup whose data is ready to be backed up by its engine
+type preparedBackup struct {
+	handler   *handler.Conplicity
+	vol       *volume.Volume
+	engine    engines.Engine
+	signature string
+	dryRun    bool
+}
+
+func backupVolume(c *handler.Conplicity, vol *volume.Volume, res *report.BackupResult) (err error) {
+	bkp, err := prepareBackup(c, vol, res)
+	if err != nil || bkp == nil {
+		return
+	}
+	return bkp.run()
+}
+
+// prepareBackup prepares the data of a volume for its backup,
+// or returns a nil backup if the volume must be skipped
+func prepareBackup(c *handler.Conplicity, vol *volume.Volume, res *report.BackupResult) (bkp *preparedBackup, err error) {
+	e := engines.GetEngine(c, vol)
+	if e == nil {
+		// A typo in the engine label must not leave the volume silently unprotected
+		err = fmt.Errorf("unknown engine %s, expected duplicity, rclone, restic, borg or tar", vol.Config.Engine)
+		return
+	}
+
+	due, err := vol.IsDue()
+	if err != nil {
+		return
+	}
+	if !due {
+		vol.Log().WithFields(log.Fields{
+			"frequency": vol.Config.Frequency,
+		}).Info("Backup not due yet, skipping")
+		return
+	}
+
+	// The pre-backup command may change the data, e.g. flush it to the volume
+	err = runHook(c, vol, "pre-backup", vol.Config.PreBackupCommand)
+	if err != nil {
+		return
+	}
+	// The post-backup command runs after the backup, or now if there is none
+	defer func() {
+		if bkp == nil {
+			runPostHook(c, vol)
+		}
+	}()
+
 	p := providers.GetProvider(c, vol)
-	log.WithFields(log.Fields{
-		"volume":   vol.Name,
+	res.Provider = p.GetName()
+	vol.Log().WithFields(log.Fields{
 		"provider": p.GetName(),
 	}).Info("Found data provider")
 	err = providers.PrepareBackup(p)
@@ -53,16 +738,82 @@ func backupVolume(c *handler.Conplicity, vol *volume.Volume) (err error) {
 		return
 	}
 
-	e := engines.GetEngine(c, vol)
-	log.WithFields(log.Fields{
-		"volume": vol.Name,
+	if !vol.Config.BackupEmpty {
+		var empty bool
+		empty, err = vol.IsEmpty()
+		if err != nil {
+			err = fmt.Errorf("failed to check whether volume is empty: %v", err)
+			return
+		}
+		if empty {
+			vol.Log().Info("Nothing to back up, skipping empty volume")
+			return
+		}
+	}
+
+	res.Engine = e.GetName()
+	vol.Log().WithFields(log.Fields{
 		"engine": e.GetName(),
 	}).Info("Found backup engine")
 
-	err = e.Backup()
+	err = vol.CheckEngine()
+	if err != nil {
+		return
+	}
+
+	var signature string
+	if vol.Config.SkipUnchanged {
+		var unchanged bool
+		unchanged, signature, err = vol.IsUnchanged()
+		if err != nil {
+			err = fmt.Errorf("failed to check volume for changes: %v", err)
+			return
+		}
+		if unchanged {
+			vol.Log().Info("Volume unchanged since last backup, skipping")
+			return
+		}
+	}
+
+	bkp = &preparedBackup{
+		handler:   c,
+		vol:       vol,
+		engine:    e,
+		signature: signature,
+		dryRun:    c.Config.DryRun,
+	}
+	return
+}
+
+// run backs up the prepared data with the engine and records the backup.
+// The containers using the volume are quiesced during the backup if requested.
+// The post-backup command runs even if the backup failed, and its failure
+// does not fail the backup.
+func (b *preparedBackup) run() (err error) {
+	defer runPostHook(b.handler, b.vol)
+
+	if b.vol.Config.StopContainers {
+		var ids []string
+		ids, err = b.handler.QuiesceContainers(b.vol)
+		if err != nil {
+			err = fmt.Errorf("failed to quiesce containers: %v", err)
+			return
+		}
+		defer b.handler.ResumeContainers(b.vol, ids)
+	}
+
+	err = b.engine.Backup()
 	if err != nil {
 		err = fmt.Errorf("failed to backup volume: %v", err)
 		return
 	}
+	if b.dryRun {
+		return
+	}
+
+	util.CheckErr(b.vol.SetLastBackup(), "Failed to record last backup date: %v", "error")
+	if b.signature != "" {
+		util.CheckErr(b.vol.SetSignature(b.signature), "Failed to record backup signature: %v", "error")
+	}
 	return
 }
@@ -1,10 +1,354 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/engines"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/report"
+	"github.com/camptocamp/conplicity/volume"
+	"github.com/docker/docker/api/types"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
+
+func TestForgetSnapshotRequiresConfirmation(t *testing.T) {
+	c := &handler.Conplicity{
+		Config: &config.Config{},
+	}
+	c.Config.ForgetSnapshot.Volume = "foo"
+	c.Config.ForgetSnapshot.Args.SnapshotID = "40dc1520"
+
+	if err := forgetSnapshot(c); err == nil {
+		t.Fatal("Expected an error without --yes, got nil")
+	}
+}
+
+func TestSplitByPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(dir+"/mysql", 0755)
+	os.Mkdir(dir+"/mysql/mysql", 0755)
+	os.Mkdir(dir+"/files", 0755)
+	os.Mkdir(dir+"/labeled", 0755)
+
+	newVolume := func(name string, priority bool) *volume.Volume {
+		return &volume.Volume{
+			Volume: &types.Volume{
+				Name:       name,
+				Mountpoint: dir + "/" + name,
+			},
+			Config: &volume.Config{
+				Priority: priority,
+			},
+		}
+	}
+	vols := []*volume.Volume{
+		newVolume("files", false),
+		newVolume("mysql", false),
+		newVolume("labeled", true),
+	}
+
+	priority, others := splitByPriority(&handler.Conplicity{}, vols)
+	if len(priority) != 2 || priority[0].Name != "mysql" || priority[1].Name != "labeled" {
+		t.Fatalf("Expected mysql and labeled priority volumes, got %v", priority)
+	}
+	if len(others) != 1 || others[0].Name != "files" {
+		t.Fatalf("Expected files volume only, got %v", others)
+	}
+}
+
+func TestGroupByProject(t *testing.T) {
+	newVolume := func(name, project string) *volume.Volume {
+		v := &volume.Volume{
+			Volume: &types.Volume{
+				Name:   name,
+				Labels: map[string]string{},
+			},
+		}
+		if project != "" {
+			v.Labels["com.docker.compose.project"] = project
+		}
+		return v
+	}
+	vols := []*volume.Volume{
+		newVolume("web_data", "web"),
+		newVolume("files", ""),
+		newVolume("wiki_db", "wiki"),
+		newVolume("web_db", "web"),
+	}
+
+	projects, projectVols, others := groupByProject(vols)
+	if len(projects) != 2 || projects[0] != "web" || projects[1] != "wiki" {
+		t.Fatalf("Expected web and wiki projects, got %v", projects)
+	}
+	if web := projectVols["web"]; len(web) != 2 || web[0].Name != "web_data" || web[1].Name != "web_db" {
+		t.Fatalf("Unexpected web volumes %v", web)
+	}
+	if len(others) != 1 || others[0].Name != "files" {
+		t.Fatalf("Expected files volume only, got %v", others)
+	}
+}
+
+func TestForEachVolume(t *testing.T) {
+	var vols []*volume.Volume
+	for _, name := range []string{"foo", "bar", "baz", "qux"} {
+		vols = append(vols, &volume.Volume{
+			Volume: &types.Volume{
+				Name: name,
+			},
+		})
+	}
+
+	// A single worker keeps the order of the volumes
+	var names []string
+	forEachVolume(vols, 1, func(vol *volume.Volume) {
+		names = append(names, vol.Name)
+	})
+	if got := strings.Join(names, ","); got != "foo,bar,baz,qux" {
+		t.Fatalf("Expected foo,bar,baz,qux, got %s", got)
+	}
+
+	for _, workers := range []int{0, 2, 10} {
+		var mutex sync.Mutex
+		var running, maxRunning, done int
+		forEachVolume(vols, workers, func(vol *volume.Volume) {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mutex.Lock()
+			running--
+			done++
+			mutex.Unlock()
+		})
+		if done != len(vols) {
+			t.Fatalf("Expected %d volumes backed up with %d workers, got %d", len(vols), workers, done)
+		}
+		if workers == 2 && maxRunning > 2 {
+			t.Fatalf("Expected at most 2 concurrent backups, got %d", maxRunning)
+		}
+	}
+}
+
+func TestForEachByStrategy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var vols []*volume.Volume
+	for _, name := range []string{"foo", "bar", "baz", "qux", "quux", "corge"} {
+		os.Mkdir(dir+"/"+name, 0755)
+		vols = append(vols, &volume.Volume{
+			Volume: &types.Volume{
+				Name:       name,
+				Mountpoint: dir + "/" + name,
+			},
+			Config: &volume.Config{
+				Priority: name == "foo",
+			},
+		})
+	}
+
+	for _, workers := range []int{1, 2, 3} {
+		c := &handler.Conplicity{
+			Config: &config.Config{
+				Strategy:    "priority-then-parallel",
+				Parallelism: workers,
+			},
+		}
+		var mutex sync.Mutex
+		var running, maxRunning, done int
+		forEachByStrategy(c, vols, func(vol *volume.Volume) {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mutex.Lock()
+			running--
+			done++
+			mutex.Unlock()
+		})
+		if done != len(vols) {
+			t.Fatalf("Expected %d volumes backed up with %d workers, got %d", len(vols), workers, done)
+		}
+		if maxRunning > workers {
+			t.Fatalf("Expected at most %d concurrent backups, got %d", workers, maxRunning)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for failures, expected := range map[int]int{
+		0:   0,
+		1:   1,
+		3:   3,
+		125: 125,
+		300: 125,
+	} {
+		if got := exitCode(failures); got != expected {
+			t.Fatalf("Expected exit code %d for %d failures, got %d", expected, failures, got)
+		}
+	}
+}
+
+// fakeEngine records its backups, failing them if err is set
+type fakeEngine struct {
+	backups int
+	err     error
+}
+
+func (e *fakeEngine) Backup() error {
+	e.backups++
+	return e.err
+}
+
+func (e *fakeEngine) Verify() error {
+	return nil
+}
+
+func (e *fakeEngine) Restore(engines.RestoreOptions) error {
+	return nil
+}
+
+func (e *fakeEngine) GetName() string {
+	return "fake"
+}
+
+func TestRunHooks(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	c := &handler.Conplicity{
+		Config: &config.Config{
+			DryRun:    true,
+			HookImage: "alpine:latest",
+		},
+	}
+	vol := &volume.Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: "/var/lib/docker/volumes/foo/_data",
+		},
+		Config: &volume.Config{
+			PreBackupCommand:  "echo pre",
+			PostBackupCommand: "echo post",
+		},
+	}
+	e := &fakeEngine{
+		err: errors.New("backup failed"),
+	}
+	b := &preparedBackup{
+		handler: c,
+		vol:     vol,
+		engine:  e,
+		dryRun:  true,
+	}
+
+	if err := b.run(); err == nil || e.backups != 1 {
+		t.Fatalf("Expected a failed backup, got %v after %d backups", err, e.backups)
+	}
+	// The pre-backup command ran when the backup was prepared
+	if strings.Contains(out.String(), "sh -c echo pre") {
+		t.Fatalf("Expected the pre-backup command not to run with the backup, got %s", out.String())
+	}
+	if !strings.Contains(out.String(), "sh -c echo post") {
+		t.Fatalf("Expected the post-backup command even after a failure, got %s", out.String())
+	}
+	if !strings.Contains(out.String(), "CONPLICITY_VOLUME=foo") {
+		t.Fatalf("Expected the volume name in the hook environment, got %s", out.String())
+	}
+}
+
+func TestPrepareBackupUnknownEngine(t *testing.T) {
+	c := &handler.Conplicity{
+		Config: &config.Config{},
+	}
+	vol := &volume.Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		Config: &volume.Config{
+			Engine: "resitc",
+		},
+	}
+
+	bkp, err := prepareBackup(c, vol, &report.BackupResult{})
+	if err == nil || bkp != nil {
+		t.Fatalf("Expected the backup of a volume with an unknown engine to fail, got %v and %v", bkp, err)
+	}
+}
+
+func TestPrepareBackupHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	c := &handler.Conplicity{
+		Config: &config.Config{
+			DryRun:    true,
+			HookImage: "alpine:latest",
+		},
+	}
+	vol := &volume.Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: dir,
+		},
+		Config: &volume.Config{
+			Engine:            "tar",
+			PreCommand:        "echo prepare",
+			PreBackupCommand:  "echo pre",
+			PostBackupCommand: "echo post",
+		},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	// The pre-backup command may fill the empty volume
+	bkp, err := prepareBackup(c, vol, &report.BackupResult{})
+	if err != nil || bkp != nil {
+		t.Fatalf("Expected the empty volume to be skipped, got %v and %v", bkp, err)
+	}
+	pre := strings.Index(out.String(), "sh -c echo pre")
+	empty := strings.Index(out.String(), "Nothing to back up")
+	post := strings.Index(out.String(), "sh -c echo post")
+	if pre < 0 || empty < pre || post < empty {
+		t.Fatalf("Expected the pre-backup command before the empty check, then the post-backup command, got %s", out.String())
+	}
+}
@@ -0,0 +1,411 @@
+package engines
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/volume"
+)
+
+// BorgEngine implements a backup engine with BorgBackup
+type BorgEngine struct {
+	Handler *handler.Conplicity
+	Volume  *volume.Volume
+}
+
+// borgPassphrasePath is where the passphrase file is mounted in borg containers
+const borgPassphrasePath = "/run/conplicity/borg-passphrase"
+
+// borgArchiveTimeFormat is the format of the timestamp of archive names
+const borgArchiveTimeFormat = "2006-01-02T15:04:05"
+
+// borgRepositoryExistsRx matches the output of borg init on existing repositories
+var borgRepositoryExistsRx = regexp.MustCompile(`A repository already exists at`)
+
+// borgIntervalRx matches borg intervals, e.g. 7d
+var borgIntervalRx = regexp.MustCompile(`^[0-9]+[Hdwmy]$`)
+
+// borgWarningState is the exit code of borg operations which succeeded with
+// warnings, e.g. when files changed while they were backed up
+const borgWarningState = 1
+
+// GetName returns the engine name
+func (*BorgEngine) GetName() string {
+	return "Borg"
+}
+
+// Backup performs the backup of the passed volume
+func (b *BorgEngine) Backup() (err error) {
+	v := b.Volume
+
+	err = b.setupTarget()
+	if err != nil {
+		return
+	}
+
+	paths, err := v.BackupPaths()
+	if err != nil {
+		return
+	}
+	v.Mount = v.MountSource() + ":" + v.ContainerPath() + ":ro"
+
+	err = b.init()
+	if err != nil {
+		err = fmt.Errorf("failed to initialize the repository: %v", err)
+		return
+	}
+
+	err = timeBackup(b.Handler, v, b.Handler.Config.Borg.Image, func() error {
+		return b.create(paths)
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to backup the volume: %v", err)
+		return
+	}
+
+	err = b.prune()
+	if err != nil {
+		err = fmt.Errorf("failed to prune old archives: %v", err)
+		return
+	}
+
+	scheduled, err := b.Handler.IsCheckScheduled(v)
+	if err != nil {
+		return
+	}
+	if scheduled {
+		err = b.check()
+		if err != nil {
+			err = fmt.Errorf("failed to verify backup: %v", err)
+		}
+	}
+	return
+}
+
+// Verify checks the consistency of the volume's repository and archives
+func (b *BorgEngine) Verify() (err error) {
+	err = b.setupTarget()
+	if err != nil {
+		return
+	}
+	return b.check()
+}
+
+// Restore extracts an archive of the volume, the latest one by default.
+// Borg extracts to its working directory, set to the root of the borg
+// container, where the volume is mounted read-write at its original path.
+// When includes are passed, only these paths are restored.
+func (b *BorgEngine) Restore(opts RestoreOptions) (err error) {
+	v := b.Volume
+
+	err = b.setupTarget()
+	if err != nil {
+		return
+	}
+
+	includeArgs, err := restoreIncludeArgs(v.ContainerPath(), opts.Include)
+	if err != nil {
+		return
+	}
+
+	archive := opts.Snapshot
+	if archive == "" || archive == "latest" {
+		archive, err = b.latestArchive()
+		if err != nil {
+			return
+		}
+	}
+
+	cmd := []string{
+		"extract",
+		v.Target + "::" + archive,
+	}
+	// Borg stores paths without their leading slash
+	for i := 1; i < len(includeArgs); i += 2 {
+		cmd = append(cmd, strings.TrimPrefix(includeArgs[i], "/"))
+	}
+
+	state, _, stderr, err := b.launchBorg(
+		cmd,
+		[]string{
+			v.MountSource() + ":" + v.ContainerPath(),
+		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Borg to restore the volume: %v", err)
+		return
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_restoreExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+
+	if state > borgWarningState {
+		err = fmt.Errorf("Borg exited with state %v while restoring the volume: %s", state, strings.TrimSpace(stderr))
+	}
+	return
+}
+
+// Init initializes the volume's repository without backing it up
+func (b *BorgEngine) Init() (err error) {
+	err = b.setupTarget()
+	if err != nil {
+		return
+	}
+	return b.init()
+}
+
+// setupTarget sets the volume target to the volume's repository,
+// under the host's directory of the target URL
+func (b *BorgEngine) setupTarget() (err error) {
+	v := b.Volume
+	targetURL, err := v.TargetURL()
+	if err != nil {
+		return
+	}
+	v.Target = strings.TrimRight(targetURL.String(), "/") + "/" + b.Handler.Hostname + "/" + v.Name
+	return
+}
+
+// archiveName returns the name of a new archive of the volume
+func (b *BorgEngine) archiveName(t time.Time) string {
+	return b.Handler.Hostname + "-" + b.Volume.Name + "-" + t.UTC().Format(borgArchiveTimeFormat)
+}
+
+// init initializes the volume's repository, unless it exists already
+func (b *BorgEngine) init() (err error) {
+	v := b.Volume
+	state, stdout, stderr, err := b.launchBorg(
+		[]string{
+			"init",
+			"--encryption", b.Handler.Config.Borg.Encryption,
+			"--make-parent-dirs",
+			v.Target,
+		},
+		[]string{},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Borg to initialize the repository: %v", err)
+		return
+	}
+	if state != 0 && !borgRepositoryExistsRx.MatchString(stdout+stderr) {
+		err = fmt.Errorf("Borg exited with state %v while initializing the repository: %s", state, strings.TrimSpace(stderr))
+	}
+	return
+}
+
+// create creates a new archive of the paths of the volume
+func (b *BorgEngine) create(paths []string) (err error) {
+	v := b.Volume
+	archive := b.archiveName(time.Now())
+	v.Log().WithFields(log.Fields{
+		"repository": v.Target,
+		"archive":    archive,
+	}).Info("Starting volume backup")
+
+	cmd := []string{
+		"create",
+		"--stats",
+		v.Target + "::" + archive,
+	}
+	state, _, stderr, err := b.launchBorg(
+		append(cmd, paths...),
+		[]string{
+			v.Mount,
+		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Borg to backup the volume: %v", err)
+		return
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_backupExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+
+	switch {
+	case state == borgWarningState:
+		v.Log().Warningf("Backup completed with warnings: %s", strings.TrimSpace(stderr))
+	case state != 0:
+		err = fmt.Errorf("Borg exited with state %v while backuping the volume: %s", state, strings.TrimSpace(stderr))
+	}
+	return
+}
+
+// prune removes the archives outside of the volume's retention policy.
+// It does nothing when no policy is set.
+func (b *BorgEngine) prune() (err error) {
+	v := b.Volume
+
+	keepArgs, err := pruneKeepArgs(v.Config)
+	if err != nil || len(keepArgs) == 0 {
+		return
+	}
+
+	cmd := append([]string{"prune"}, keepArgs...)
+	state, _, stderr, err := b.launchBorg(
+		append(cmd, v.Target),
+		[]string{},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Borg to prune archives: %v", err)
+		return
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_pruneExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+
+	if state > borgWarningState {
+		err = fmt.Errorf("Borg exited with state %v while pruning archives: %s", state, strings.TrimSpace(stderr))
+	}
+	return
+}
+
+// check checks the consistency of the repository and its archives
+func (b *BorgEngine) check() (err error) {
+	v := b.Volume
+	state, _, stderr, err := b.launchBorg(
+		[]string{
+			"check",
+			v.Target,
+		},
+		[]string{},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Borg to check the repository: %v", err)
+		return
+	}
+
+	if state == 0 {
+		b.Handler.SetLastCheck(v)
+	} else {
+		err = fmt.Errorf("Borg exited with state %v while checking the repository: %s", state, strings.TrimSpace(stderr))
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_verifyExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+	return
+}
+
+// latestArchive returns the name of the latest archive of the volume
+func (b *BorgEngine) latestArchive() (archive string, err error) {
+	v := b.Volume
+	if b.Handler.Config.DryRun {
+		// No archives to list
+		return "latest", nil
+	}
+
+	state, stdout, stderr, err := b.launchBorg(
+		[]string{
+			"list",
+			"--short",
+			"--last", "1",
+			v.Target,
+		},
+		[]string{},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Borg to list archives: %v", err)
+		return
+	}
+	if state != 0 {
+		err = fmt.Errorf("Borg exited with state %v while listing archives: %s", state, strings.TrimSpace(stderr))
+		return
+	}
+	archive = strings.TrimSpace(stdout)
+	if archive == "" {
+		err = fmt.Errorf("no archive found in repository %s", v.Target)
+	}
+	return
+}
+
+// pruneKeepArgs returns the borg prune arguments of the volume's
+// retention policy. No arguments are returned when no policy is set.
+func pruneKeepArgs(c *volume.Config) (args []string, err error) {
+	keeps := []struct {
+		flag  string
+		value string
+	}{
+		{"--keep-last", c.Borg.KeepLast},
+		{"--keep-daily", c.Borg.KeepDaily},
+		{"--keep-weekly", c.Borg.KeepWeekly},
+		{"--keep-monthly", c.Borg.KeepMonthly},
+	}
+	for _, k := range keeps {
+		if k.value == "" || k.value == "0" {
+			continue
+		}
+		if n, e := strconv.Atoi(k.value); e != nil || n < 0 {
+			err = fmt.Errorf("invalid %s value %s, expected a number of archives", k.flag, k.value)
+			return
+		}
+		args = append(args, k.flag, k.value)
+	}
+
+	if c.Borg.KeepWithin != "" {
+		if !borgIntervalRx.MatchString(c.Borg.KeepWithin) {
+			err = fmt.Errorf("invalid keep-within interval %s, expected e.g. '7d' or '2w'", c.Borg.KeepWithin)
+			return
+		}
+		args = append(args, "--keep-within", c.Borg.KeepWithin)
+	}
+	return
+}
+
+// borgEnv returns the environment and binds passing the repository
+// passphrase and the ssh options to borg containers. A passphrase file
+// is preferred, as environment variables are visible when inspecting containers.
+func borgEnv(c *config.Config) (env, binds []string) {
+	if f := c.Borg.PassphraseFile; f != "" {
+		env = append(env, "BORG_PASSCOMMAND=cat "+borgPassphrasePath)
+		binds = append(binds, f+":"+borgPassphrasePath+":ro")
+	} else {
+		env = append(env, "BORG_PASSPHRASE="+c.Borg.Passphrase)
+	}
+
+	opts, sshBinds := sshOptions(c)
+	env = append(env, "BORG_RSH="+strings.Join(append([]string{"ssh"}, opts...), " "))
+	binds = append(binds, sshBinds...)
+	return
+}
+
+// launchBorg starts a borg container with the given command and binds.
+// It runs from the root of the container, where borg extract restores
+// the archived paths.
+func (b *BorgEngine) launchBorg(cmd, binds []string) (state int, stdout, stderr string, err error) {
+	env, borgBinds := borgEnv(b.Handler.Config)
+	return launchContainer(b.Handler, b.Volume, b.Handler.Config.Borg.Image, "/", cmd, append(binds, borgBinds...), env)
+}
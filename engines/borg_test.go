@@ -0,0 +1,113 @@
+package engines
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/volume"
+	"github.com/docker/docker/api/types"
+)
+
+// fakeBorgEngine returns a borg engine running in dry run
+func fakeBorgEngine() *BorgEngine {
+	c := &config.Config{
+		DryRun: true,
+	}
+	c.Borg.Encryption = "repokey"
+	return &BorgEngine{
+		Handler: &handler.Conplicity{
+			Config:   c,
+			Hostname: "host",
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name:       "foo",
+				Mountpoint: "/var/lib/docker/volumes/foo/_data",
+			},
+			Config: &volume.Config{
+				TargetURL: "ssh://backup@example.com:2222/srv/borg/",
+				NoVerify:  true,
+			},
+			MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+		},
+	}
+}
+
+func TestBorgBackupDryRun(t *testing.T) {
+	b := fakeBorgEngine()
+	if err := b.Backup(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if expected := "ssh://backup@example.com:2222/srv/borg/host/foo"; b.Volume.Target != expected {
+		t.Fatalf("Expected target %s, got %s", expected, b.Volume.Target)
+	}
+	for _, name := range []string{"conplicity_backupExitCode", "conplicity_backupDuration"} {
+		if _, ok := b.Volume.MetricsHandler.Metrics[name]; !ok {
+			t.Fatalf("Expected metric %s", name)
+		}
+	}
+	if err := b.Restore(RestoreOptions{Include: []string{"/etc"}}); err == nil {
+		t.Fatal("Expected an error restoring a path outside of the volume, got no error")
+	}
+	if err := b.Restore(RestoreOptions{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestBorgArchiveName(t *testing.T) {
+	b := fakeBorgEngine()
+	d := time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)
+	if got, expected := b.archiveName(d), "host-foo-2017-03-01T02:00:00"; got != expected {
+		t.Fatalf("Expected archive %s, got %s", expected, got)
+	}
+}
+
+func TestPruneKeepArgs(t *testing.T) {
+	c := &volume.Config{}
+	args, err := pruneKeepArgs(c)
+	if err != nil || len(args) != 0 {
+		t.Fatalf("Expected no arguments and no error, got %v, %v", args, err)
+	}
+
+	c.Borg.KeepDaily = "7"
+	c.Borg.KeepWeekly = "0"
+	c.Borg.KeepWithin = "2w"
+	args, err = pruneKeepArgs(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if strings.Join(args, " ") != "--keep-daily 7 --keep-within 2w" {
+		t.Fatalf("Unexpected arguments %v", args)
+	}
+
+	c.Borg.KeepWithin = "1y6m"
+	if _, err := pruneKeepArgs(c); err == nil {
+		t.Fatal("Expected an error for keep-within 1y6m, got no error")
+	}
+}
+
+func TestBorgEnv(t *testing.T) {
+	c := &config.Config{}
+	c.Borg.Passphrase = "secret"
+	c.SSH.PrivateKeyPath = "/root/.ssh/id_rsa"
+	env, binds := borgEnv(c)
+	if got, expected := strings.Join(env, ","), "BORG_PASSPHRASE=secret,BORG_RSH=ssh -oIdentityFile="+sshKeyPath; got != expected {
+		t.Fatalf("Expected environment %s, got %s", expected, got)
+	}
+	if len(binds) != 1 {
+		t.Fatalf("Expected the private key bind, got %v", binds)
+	}
+
+	c.Borg.PassphraseFile = "/etc/borg/passphrase"
+	env, binds = borgEnv(c)
+	if env[0] != "BORG_PASSCOMMAND=cat "+borgPassphrasePath {
+		t.Fatalf("Expected the passphrase to be read from its file, got %v", env)
+	}
+	if binds[0] != "/etc/borg/passphrase:"+borgPassphrasePath+":ro" {
+		t.Fatalf("Expected the passphrase file bind, got %v", binds)
+	}
+}
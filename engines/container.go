@@ -0,0 +1,479 @@
+package engines
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/util"
+	"github.com/camptocamp/conplicity/volume"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	units "github.com/docker/go-units"
+)
+
+// LaunchContainer starts a container from image with the given command,
+// binds and environment, waits for it to exit and returns its exit code
+// and output. Unless a TTY is used, stdout and stderr are kept separate,
+// otherwise all the output is returned in stdout.
+// The volume's timeout applies when v is not nil.
+func LaunchContainer(h *handler.Conplicity, v *volume.Volume, image string, cmd, binds, env []string) (state int, stdout, stderr string, err error) {
+	return launchContainer(h, v, image, "", cmd, binds, env)
+}
+
+// launchContainer is LaunchContainer running the command in workingDir,
+// or in the image's working directory when workingDir is empty
+func launchContainer(h *handler.Conplicity, v *volume.Volume, image, workingDir string, cmd, binds, env []string) (state int, stdout, stderr string, err error) {
+	// Keep stdout clean for JSON parsing when JSON output is requested
+	tty := !h.Config.Docker.NoTTY && !h.Config.Backup.ResultsJSON
+
+	if h.Config.DryRun {
+		log.WithFields(containerLogFields(image, cmd, binds, env)).Info("Dry run, not launching container")
+		return
+	}
+
+	_, err = h.PullImage(image)
+	if err != nil {
+		err = fmt.Errorf("failed to pull image: %v", err)
+		return
+	}
+
+	interval, err := time.ParseDuration(h.Config.Docker.PollInterval)
+	if err != nil {
+		err = fmt.Errorf("failed to parse the parameter 'docker-poll-interval': %v", err)
+		return
+	}
+
+	// The run context is canceled when conplicity is asked to stop,
+	// and all container calls are bounded by the volume's timeout
+	runCtx := h.Context()
+	ctx := runCtx
+	var timeout time.Duration
+	if v != nil {
+		timeout, err = v.Timeout()
+		if err != nil {
+			return
+		}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// interrupted returns the error of an interrupted or timed out run,
+	// after stopping the container if it was created, or err otherwise
+	interrupted := func(id string, err error) error {
+		switch {
+		case runCtx.Err() == context.Canceled:
+			log.WithFields(log.Fields{
+				"container": id,
+			}).Warning("Interrupted, stopping container")
+			err = fmt.Errorf("interrupted")
+		case ctx.Err() == context.DeadlineExceeded:
+			err = timedOut(v, timeout)
+		default:
+			return err
+		}
+		if id != "" {
+			util.CheckErr(stopContainer(h, id), "Failed to stop container: %v", "error")
+		}
+		return err
+	}
+
+	log.WithFields(containerLogFields(image, cmd, binds, env)).Debug("Creating container")
+	container, err := h.ContainerCreate(
+		ctx,
+		&container.Config{
+			Cmd:          cmd,
+			Env:          env,
+			Image:        image,
+			WorkingDir:   workingDir,
+			OpenStdin:    true,
+			StdinOnce:    true,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+			Tty:          tty,
+		},
+		hostConfig(h, binds), nil, "",
+	)
+	if err != nil {
+		err = interrupted("", fmt.Errorf("failed to create container: %v", err))
+		return
+	}
+	defer util.RemoveContainer(h.Client, container.ID)
+
+	log.Debugf("Launching '%v'...", strings.Join(cmd, " "))
+	err = h.ContainerStart(ctx, container.ID, types.ContainerStartOptions{})
+	if err != nil {
+		err = interrupted(container.ID, fmt.Errorf("failed to start container: %v", err))
+		return
+	}
+
+	// Stream the logs while the container runs, so long backups show progress
+	body, err := h.ContainerLogs(ctx, container.ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Details:    true,
+		Follow:     true,
+	})
+	if err != nil {
+		err = interrupted(container.ID, fmt.Errorf("failed to retrieve logs: %v", err))
+		return
+	}
+	var stdoutBuf, stderrBuf bytes.Buffer
+	fields := log.Fields{
+		"image": image,
+	}
+	if v != nil {
+		fields["volume"] = v.Name
+	}
+	stdoutLog := newLineLogger(log.WithFields(fields), h.Config.ContainerLogLevel)
+	stderrLog := newLineLogger(log.WithFields(fields), h.Config.ContainerLogLevel)
+	logsDone := make(chan error, 1)
+	go func() {
+		defer body.Close()
+		stdoutW := io.MultiWriter(&stdoutBuf, stdoutLog)
+		stderrW := io.MultiWriter(&stderrBuf, stderrLog)
+		var err error
+		if tty {
+			_, err = io.Copy(stdoutW, body)
+		} else {
+			_, err = stdcopy.StdCopy(stdoutW, stderrW, body)
+		}
+		stdoutLog.Flush()
+		stderrLog.Flush()
+		logsDone <- err
+	}()
+
+	state, err = waitContainer(ctx, h, container.ID, interval)
+	if err != nil {
+		err = interrupted(container.ID, err)
+		return
+	}
+
+	// The log stream ends once the container exited
+	err = <-logsDone
+	if err != nil {
+		err = fmt.Errorf("failed to read logs from response: %v", err)
+		return
+	}
+
+	stdout = stdoutBuf.String()
+	stderr = stderrBuf.String()
+
+	return
+}
+
+// containerInspector inspects containers
+type containerInspector interface {
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+}
+
+// waitContainer inspects the container every interval until it exited
+// or ctx is done, and returns its exit code
+func waitContainer(ctx context.Context, cli containerInspector, id string, interval time.Duration) (state int, err error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var cont types.ContainerJSON
+		cont, err = cli.ContainerInspect(ctx, id)
+		if err != nil {
+			err = fmt.Errorf("failed to inspect container: %v", err)
+			return
+		}
+		if cont.State.Status == "exited" {
+			state = cont.State.ExitCode
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// secretEnvRx matches the names of environment variables holding secrets
+var secretEnvRx = regexp.MustCompile(`(?i)password|passphrase|secret|key|token`)
+
+// redactEnv returns a copy of env with the values of secrets masked.
+// It is meant for logging, containers must get the real environment.
+func redactEnv(env []string) (redacted []string) {
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 && secretEnvRx.MatchString(kv[0]) {
+			e = kv[0] + "=***"
+		}
+		redacted = append(redacted, e)
+	}
+	return
+}
+
+// containerLogFields returns the log fields describing a container,
+// without the secrets of its environment
+func containerLogFields(image string, cmd, binds, env []string) log.Fields {
+	return log.Fields{
+		"image":       image,
+		"command":     strings.Join(cmd, " "),
+		"environment": strings.Join(redactEnv(env), ", "),
+		"binds":       strings.Join(binds, ", "),
+	}
+}
+
+// hostConfig returns the host configuration of backup containers.
+// Containers run with the minimal set of capabilities needed
+// to read and restore volume data, and cannot gain new privileges.
+// Their network and the limits of their memory and CPU are set when configured.
+func hostConfig(h *handler.Conplicity, binds []string) *container.HostConfig {
+	r := h.Config.Resources
+	var memory int64
+	if r.Memory != "" {
+		// The memory limit is checked when validating the config
+		memory, _ = units.RAMInBytes(r.Memory)
+	}
+
+	return &container.HostConfig{
+		Binds:       binds,
+		CapDrop:     []string{"ALL"},
+		CapAdd:      h.Config.Docker.Capabilities,
+		SecurityOpt: []string{"no-new-privileges"},
+		NetworkMode: container.NetworkMode(h.Config.Docker.Network),
+		Resources: container.Resources{
+			Memory:    memory,
+			CPUShares: r.CPUShares,
+			NanoCPUs:  int64(r.CPUs * 1e9),
+		},
+	}
+}
+
+// stopTimeout is the time given to containers to stop when interrupted,
+// before they are killed
+var stopTimeout = 10 * time.Second
+
+// containerStopper stops containers
+type containerStopper interface {
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
+}
+
+// stopContainer stops a container which was interrupted or timed out.
+// It is removed by the caller's deferred cleanup.
+func stopContainer(cli containerStopper, id string) error {
+	// The run context is canceled or expired already
+	return cli.ContainerStop(context.Background(), id, &stopTimeout)
+}
+
+// timedOut records a backup timeout for the volume and returns the matching error.
+// The container itself is stopped and removed by the caller.
+func timedOut(v *volume.Volume, timeout time.Duration) error {
+	v.Log().WithFields(log.Fields{
+		"timeout": timeout,
+	}).Error("Backup container timed out, stopping it")
+
+	metric := v.MetricsHandler.NewMetric("conplicity_backupTimedOut", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: "1",
+		},
+	)
+	return fmt.Errorf("container timed out after %v", timeout)
+}
+
+// timeBackup runs backup and records its duration in seconds.
+// The image is pulled first, so that pulling it is not measured,
+// and its digest is recorded so that backups can be audited.
+func timeBackup(h *handler.Conplicity, v *volume.Volume, image string, backup func() error) error {
+	if !h.Config.DryRun {
+		digest, err := h.PullImage(image)
+		if err != nil {
+			return fmt.Errorf("failed to pull image: %v", err)
+		}
+		setImageDigest(v, image, digest)
+	}
+
+	start := time.Now()
+	err := backup()
+	duration := time.Since(start)
+
+	metric := v.MetricsHandler.NewMetric("conplicity_backupDuration", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.FormatFloat(duration.Seconds(), 'f', 2, 64),
+		},
+	)
+	return err
+}
+
+// setImageDigest logs the digest of the image backing up the volume
+// and records it in the conplicity_imageDigest info metric
+func setImageDigest(v *volume.Volume, image, digest string) {
+	v.Log().WithFields(log.Fields{
+		"image":  image,
+		"digest": digest,
+	}).Info("Using image")
+
+	metric := v.MetricsHandler.NewMetric("conplicity_imageDigest", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+				"image":  image,
+				"digest": digest,
+			},
+			Value: "1",
+		},
+	)
+}
+
+// lineLogger logs the lines written to it as soon as they are complete
+type lineLogger struct {
+	log func(args ...interface{})
+	buf bytes.Buffer
+}
+
+// newLineLogger returns a lineLogger logging to entry at the container log
+// level: info, or debug to only show the output when debugging
+func newLineLogger(entry *log.Entry, level string) *lineLogger {
+	l := &lineLogger{
+		log: entry.Info,
+	}
+	if level == "debug" {
+		l.log = entry.Debug
+	}
+	return l
+}
+
+// Write logs the complete lines of p, keeping the last partial line
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf.Write(p)
+	for {
+		line, err := l.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line, wait for the rest
+			l.buf.WriteString(line)
+			break
+		}
+		l.log(strings.TrimRight(line, "\r\n"))
+	}
+	return len(p), nil
+}
+
+// Flush logs the remaining partial line, if any
+func (l *lineLogger) Flush() {
+	if l.buf.Len() > 0 {
+		l.log(l.buf.String())
+		l.buf.Reset()
+	}
+}
+
+// Paths of the SSH private key and known_hosts file in containers
+const (
+	sshKeyPath        = "/run/conplicity/ssh/id"
+	sshKnownHostsPath = "/run/conplicity/ssh/known_hosts"
+)
+
+// sshOptions returns the ssh options and binds giving containers
+// the private key and known_hosts file of SFTP and SSH targets
+func sshOptions(c *config.Config) (opts, binds []string) {
+	if f := c.SSH.PrivateKeyPath; f != "" {
+		opts = append(opts, "-oIdentityFile="+sshKeyPath)
+		binds = append(binds, f+":"+sshKeyPath+":ro")
+	}
+	if f := c.SSH.KnownHostsPath; f != "" {
+		opts = append(opts, "-oUserKnownHostsFile="+sshKnownHostsPath)
+		binds = append(binds, f+":"+sshKnownHostsPath+":ro")
+	}
+	return
+}
+
+// sftpCommand returns the ssh command restic runs to reach an sftp: target,
+// either sftp:user@host:path or sftp://user@host:port//path
+func sftpCommand(target string, opts []string) (cmd string, err error) {
+	var host, port string
+	if strings.HasPrefix(target, "sftp://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse target %s: %v", target, err)
+		}
+		host = u.Hostname()
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		port = u.Port()
+	} else {
+		rest := strings.TrimPrefix(target, "sftp:")
+		i := strings.Index(rest, ":")
+		if i < 0 || rest == target {
+			return "", fmt.Errorf("invalid sftp target %s", target)
+		}
+		host = rest[:i]
+	}
+	if host == "" {
+		return "", fmt.Errorf("no host in sftp target %s", target)
+	}
+
+	args := []string{"ssh"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, opts...)
+	args = append(args, host, "-s", "sftp")
+	return strings.Join(args, " "), nil
+}
+
+// swiftEnv returns the OS_* environment authenticating restic and rclone
+// to Swift, with the Keystone v2 or v3 variables of the configured version.
+// Application credentials are used instead of the user name and password when set.
+func swiftEnv(c *config.Config) []string {
+	s := c.Swift
+	env := []string{
+		"OS_AUTH_URL=" + s.AuthURL,
+		"OS_REGION_NAME=" + s.RegionName,
+	}
+	if s.AuthVersion != 3 {
+		return append(env,
+			"OS_USERNAME="+s.Username,
+			"OS_PASSWORD="+s.Password,
+			"OS_TENANT_NAME="+s.TenantName,
+		)
+	}
+
+	if s.ApplicationCredentialID != "" {
+		return append(env,
+			"OS_APPLICATION_CREDENTIAL_ID="+s.ApplicationCredentialID,
+			"OS_APPLICATION_CREDENTIAL_SECRET="+s.ApplicationCredentialSecret,
+		)
+	}
+	env = append(env,
+		"OS_USERNAME="+s.Username,
+		"OS_PASSWORD="+s.Password,
+		"OS_USER_DOMAIN_NAME="+s.UserDomainName,
+		"OS_PROJECT_DOMAIN_NAME="+s.ProjectDomainName,
+	)
+	if s.ProjectID != "" {
+		return append(env, "OS_PROJECT_ID="+s.ProjectID)
+	}
+	return append(env, "OS_PROJECT_NAME="+s.ProjectName)
+}
@@ -0,0 +1,420 @@
+package engines
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/volume"
+)
+
+func TestHostConfig(t *testing.T) {
+	h := &handler.Conplicity{
+		Config: &config.Config{},
+	}
+	h.Config.Docker.Capabilities = []string{"DAC_READ_SEARCH"}
+
+	hc := hostConfig(h, []string{"foo:/backup:ro"})
+
+	if got := strings.Join(hc.Binds, ","); got != "foo:/backup:ro" {
+		t.Fatalf("Expected binds foo:/backup:ro, got %s", got)
+	}
+	if got := strings.Join(hc.CapDrop, ","); got != "ALL" {
+		t.Fatalf("Expected all capabilities to be dropped, got %s", got)
+	}
+	if got := strings.Join(hc.CapAdd, ","); got != "DAC_READ_SEARCH" {
+		t.Fatalf("Expected DAC_READ_SEARCH capability, got %s", got)
+	}
+	if got := strings.Join(hc.SecurityOpt, ","); got != "no-new-privileges" {
+		t.Fatalf("Expected no-new-privileges security option, got %s", got)
+	}
+	if hc.NetworkMode != "" {
+		t.Fatalf("Expected Docker's default network, got %s", hc.NetworkMode)
+	}
+	if r := hc.Resources; r.Memory != 0 || r.CPUShares != 0 || r.NanoCPUs != 0 {
+		t.Fatalf("Expected no resource limits, got %+v", r)
+	}
+
+	h.Config.Docker.Network = "none"
+	h.Config.Resources.Memory = "512m"
+	h.Config.Resources.CPUShares = 512
+	h.Config.Resources.CPUs = 1.5
+	hc = hostConfig(h, nil)
+	if !hc.NetworkMode.IsNone() {
+		t.Fatalf("Expected no network, got %s", hc.NetworkMode)
+	}
+	if got := hc.Memory; got != 512*1024*1024 {
+		t.Fatalf("Expected a 512 MiB memory limit, got %d", got)
+	}
+	if got := hc.CPUShares; got != 512 {
+		t.Fatalf("Expected 512 CPU shares, got %d", got)
+	}
+	if got := hc.NanoCPUs; got != 1500000000 {
+		t.Fatalf("Expected 1.5 CPUs, got %d nano CPUs", got)
+	}
+}
+
+func TestSSHOptions(t *testing.T) {
+	c := &config.Config{}
+	if opts, binds := sshOptions(c); len(opts) != 0 || len(binds) != 0 {
+		t.Fatalf("Expected no SSH options, got %v and binds %v", opts, binds)
+	}
+
+	c.SSH.PrivateKeyPath = "/etc/conplicity/id_ed25519"
+	c.SSH.KnownHostsPath = "/etc/conplicity/known_hosts"
+	opts, binds := sshOptions(c)
+	if got, expected := strings.Join(opts, " "), "-oIdentityFile="+sshKeyPath+" -oUserKnownHostsFile="+sshKnownHostsPath; got != expected {
+		t.Fatalf("Expected options '%s', got '%s'", expected, got)
+	}
+	if got, expected := strings.Join(binds, ","), "/etc/conplicity/id_ed25519:"+sshKeyPath+":ro,/etc/conplicity/known_hosts:"+sshKnownHostsPath+":ro"; got != expected {
+		t.Fatalf("Expected binds '%s', got '%s'", expected, got)
+	}
+}
+
+func TestSftpCommand(t *testing.T) {
+	opts := []string{"-oIdentityFile=/id"}
+	for target, expected := range map[string]string{
+		"sftp:backup@example.com:/srv/restic":        "ssh -oIdentityFile=/id backup@example.com -s sftp",
+		"sftp:example.com:restic":                    "ssh -oIdentityFile=/id example.com -s sftp",
+		"sftp://backup@example.com:2222//srv/restic": "ssh -p 2222 -oIdentityFile=/id backup@example.com -s sftp",
+	} {
+		cmd, err := sftpCommand(target, opts)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", target, err)
+		}
+		if cmd != expected {
+			t.Fatalf("Expected '%s' for %s, got '%s'", expected, target, cmd)
+		}
+	}
+
+	for _, target := range []string{"sftp:example.com", "sftp:///srv/restic"} {
+		if _, err := sftpCommand(target, opts); err == nil {
+			t.Fatalf("Expected an error for %s", target)
+		}
+	}
+}
+
+func TestLaunchContainerDryRun(t *testing.T) {
+	// No Docker client is needed, as no container is launched
+	h := &handler.Conplicity{
+		Config: &config.Config{},
+	}
+	h.Config.DryRun = true
+
+	state, stdout, stderr, err := LaunchContainer(h, nil, "restic/restic:latest", []string{"snapshots"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if state != 0 || stdout != "" || stderr != "" {
+		t.Fatalf("Expected a synthetic success, got state %d, stdout %q, stderr %q", state, stdout, stderr)
+	}
+}
+
+func TestTimeBackup(t *testing.T) {
+	h := &handler.Conplicity{
+		Config: &config.Config{},
+	}
+	h.Config.DryRun = true
+	v := &volume.Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	expected := errors.New("failed to backup volume")
+	err := timeBackup(h, v, "restic/restic:latest", func() error {
+		time.Sleep(10 * time.Millisecond)
+		return expected
+	})
+	if err != expected {
+		t.Fatalf("Expected the backup error, got %v", err)
+	}
+
+	events := v.MetricsHandler.Metrics["conplicity_backupDuration"].Events
+	if len(events) != 1 {
+		t.Fatalf("Expected a duration event, got %v", events)
+	}
+	if d, err := strconv.ParseFloat(events[0].Value, 64); err != nil || d < 0.01 {
+		t.Fatalf("Expected a duration of at least 0.01s, got %s", events[0].Value)
+	}
+}
+
+func TestSetImageDigest(t *testing.T) {
+	v := &volume.Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	setImageDigest(v, "restic/restic:0.16.0", "sha256:abc")
+
+	events := v.MetricsHandler.Metrics["conplicity_imageDigest"].Events
+	if len(events) != 1 {
+		t.Fatalf("Expected an image digest event, got %v", events)
+	}
+	if l := events[0].Labels; l["image"] != "restic/restic:0.16.0" || l["digest"] != "sha256:abc" || events[0].Value != "1" {
+		t.Fatalf("Expected the image and digest labels, got %v = %s", l, events[0].Value)
+	}
+}
+
+func TestLineLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Level = log.InfoLevel
+	logger.Formatter = &log.TextFormatter{DisableTimestamp: true}
+
+	l := newLineLogger(log.NewEntry(logger), "info")
+	l.Write([]byte("scanned 12 files\nuploaded "))
+	if got := strings.Count(out.String(), "\n"); got != 1 {
+		t.Fatalf("Expected 1 line logged, got %d: %s", got, out.String())
+	}
+	if !strings.Contains(out.String(), "level=info") || !strings.Contains(out.String(), "scanned 12 files") {
+		t.Fatalf("Expected complete line to be logged at info level, got %s", out.String())
+	}
+
+	l.Write([]byte("3 MiB\n"))
+	if !strings.Contains(out.String(), "uploaded 3 MiB") {
+		t.Fatalf("Expected partial lines to be joined, got %s", out.String())
+	}
+
+	l.Write([]byte("done"))
+	l.Flush()
+	if got := strings.Count(out.String(), "\n"); got != 3 {
+		t.Fatalf("Expected 3 lines logged after flush, got %d: %s", got, out.String())
+	}
+
+	// The output is hidden unless debugging at the debug level
+	out.Reset()
+	l = newLineLogger(log.NewEntry(logger), "debug")
+	l.Write([]byte("scanned 12 files\n"))
+	if out.Len() != 0 {
+		t.Fatalf("Expected no line logged at info level, got %s", out.String())
+	}
+}
+
+// fakeInspector reports a running container, then an exited one
+type fakeInspector struct {
+	running  int
+	inspects int
+}
+
+func (f *fakeInspector) ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	f.inspects++
+	status, exitCode := "running", 0
+	if f.inspects > f.running {
+		status, exitCode = "exited", 3
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			State: &types.ContainerState{
+				Status:   status,
+				ExitCode: exitCode,
+			},
+		},
+	}, nil
+}
+
+func TestWaitContainer(t *testing.T) {
+	f := &fakeInspector{running: 2}
+	start := time.Now()
+	state, err := waitContainer(context.Background(), f, "foo", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if state != 3 {
+		t.Fatalf("Expected exit code 3, got %d", state)
+	}
+	if f.inspects != 3 {
+		t.Fatalf("Expected 3 inspects, got %d", f.inspects)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("Expected to wait between inspects, returned after %v", elapsed)
+	}
+}
+
+func TestWaitContainerTimeout(t *testing.T) {
+	f := &fakeInspector{running: 1000}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := waitContainer(ctx, f, "foo", 10*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if f.inspects > 10 {
+		t.Fatalf("Expected a few inspects, got %d", f.inspects)
+	}
+}
+
+type fakeStopper struct {
+	stopped []string
+	err     error
+}
+
+func (f *fakeStopper) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	f.stopped = append(f.stopped, containerID)
+	return f.err
+}
+
+func TestStopContainer(t *testing.T) {
+	f := &fakeStopper{}
+	if err := stopContainer(f, "foo"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(f.stopped) != 1 || f.stopped[0] != "foo" {
+		t.Fatalf("Expected container foo to be stopped, got %v", f.stopped)
+	}
+}
+
+// fakeDockerAPI serves the Docker API calls of LaunchContainer for a
+// container which never exits, recording the calls. Starting the
+// container fails when failStart is set.
+func fakeDockerAPI(failStart bool) (ts *httptest.Server, calls func() []string) {
+	var mutex sync.Mutex
+	var recorded []string
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		recorded = append(recorded, r.Method+" "+r.URL.Path)
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/containers/create":
+			w.Write([]byte(`{"Id": "abc"}`))
+		case strings.HasSuffix(r.URL.Path, "/json"):
+			w.Write([]byte(`{"Id": "abc", "State": {"Status": "running"}}`))
+		case strings.HasSuffix(r.URL.Path, "/start") && failStart:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message": "failed to mount volume"}`))
+		case strings.HasSuffix(r.URL.Path, "/logs"):
+			// Empty log stream
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	calls = func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), recorded...)
+	}
+	return
+}
+
+// fakeHandler returns a handler using the Docker API served by ts
+func fakeHandler(t *testing.T, ts *httptest.Server) *handler.Conplicity {
+	cli, err := docker.NewClient("tcp://"+strings.TrimPrefix(ts.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create Docker client: %v", err)
+	}
+	h := &handler.Conplicity{
+		Client: cli,
+		Config: &config.Config{},
+	}
+	h.Config.Docker.NoTTY = true
+	h.Config.Docker.PollInterval = "10ms"
+	return h
+}
+
+func TestLaunchContainerStartFailure(t *testing.T) {
+	ts, calls := fakeDockerAPI(true)
+	defer ts.Close()
+
+	_, _, _, err := LaunchContainer(fakeHandler(t, ts), nil, "restic/restic:latest", []string{"backup"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to start container") {
+		t.Fatalf("Expected a start error, got %v", err)
+	}
+
+	got := calls()
+	if len(got) == 0 || got[len(got)-1] != "DELETE /containers/abc" {
+		t.Fatalf("Expected the container to be removed, got calls %v", got)
+	}
+}
+
+func TestLaunchContainerTimeout(t *testing.T) {
+	ts, calls := fakeDockerAPI(false)
+	defer ts.Close()
+
+	h := fakeHandler(t, ts)
+	v := &volume.Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		Config: &volume.Config{
+			Timeout: "100ms",
+		},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	_, _, _, err := LaunchContainer(h, v, "restic/restic:latest", []string{"backup"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+
+	var stopped, removed bool
+	for _, c := range calls() {
+		switch c {
+		case "POST /containers/abc/stop":
+			stopped = true
+		case "DELETE /containers/abc":
+			removed = stopped
+		}
+	}
+	if !stopped || !removed {
+		t.Fatalf("Expected the container to be stopped then removed, got calls %v", calls())
+	}
+	if _, ok := v.MetricsHandler.Metrics["conplicity_backupTimedOut"]; !ok {
+		t.Fatal("Expected the timeout to be recorded")
+	}
+}
+
+func TestContainerLogFields(t *testing.T) {
+	env := []string{
+		"AWS_SECRET_ACCESS_KEY=s3cr3t-aws",
+		"OS_PASSWORD=s3cr3t-swift",
+		"RESTIC_PASSWORD=s3cr3t-restic",
+		"VAULT_TOKEN=s3cr3t-token",
+		"AZURE_ACCOUNT_KEY=s3cr3t-azure",
+		"PASSPHRASE=s3cr3t-gpg",
+		"BORG_PASSPHRASE=s3cr3t-borg",
+		"OS_USERNAME=admin",
+		"EMPTY",
+	}
+	original := strings.Join(env, ",")
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Level = log.DebugLevel
+	logger.WithFields(containerLogFields("restic/restic", []string{"backup"}, nil, env)).Debug("Creating container")
+
+	if strings.Contains(out.String(), "s3cr3t") {
+		t.Fatalf("Expected secrets to be redacted, got %s", out.String())
+	}
+	if !strings.Contains(out.String(), "OS_USERNAME=admin") || !strings.Contains(out.String(), "RESTIC_PASSWORD=***") {
+		t.Fatalf("Expected non-secret values and redacted keys to be logged, got %s", out.String())
+	}
+	if strings.Join(env, ",") != original {
+		t.Fatalf("Expected environment to be unchanged, got %v", env)
+	}
+}
@@ -2,22 +2,17 @@ package engines
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net/url"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/conplicity/config"
 	"github.com/camptocamp/conplicity/handler"
 	"github.com/camptocamp/conplicity/metrics"
 	"github.com/camptocamp/conplicity/util"
 	"github.com/camptocamp/conplicity/volume"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"golang.org/x/net/context"
 )
 
 // DuplicityEngine implements a backup engine with Duplicity
@@ -33,6 +28,13 @@ const timeFormat = "Mon Jan 2 15:04:05 2006"
 var fullBackupRx = regexp.MustCompile("Last full backup date: (.+)")
 var chainEndTimeRx = regexp.MustCompile("Chain end time: (.+)")
 
+// backupSetsRx matches the number of backup sets of a chain in collection-status
+var backupSetsRx = regexp.MustCompile(`Number of contained backup sets: (\d+)`)
+
+// noBackupChainRx matches the collection-status output of targets without backups
+var noBackupChainRx = regexp.MustCompile("No backup chains with active signatures found")
+var gpgErrorRx = regexp.MustCompile("GPGError|gpg: decryption failed|no valid OpenPGP data found")
+
 // GetName returns the engine name
 func (*DuplicityEngine) GetName() string {
 	return "Duplicity"
@@ -41,24 +43,23 @@ func (*DuplicityEngine) GetName() string {
 // Backup performs the backup of the passed volume
 func (d *DuplicityEngine) Backup() (err error) {
 	vol := d.Volume
-	log.WithFields(log.Fields{
-		"volume":     vol.Name,
+	vol.Log().WithFields(log.Fields{
 		"driver":     vol.Driver,
 		"mountpoint": vol.Mountpoint,
 	}).Info("Creating duplicity container")
 
-	targetURL, err := url.Parse(vol.Config.TargetURL)
+	err = d.setupTarget()
 	if err != nil {
-		err = fmt.Errorf("failed to parse target URL: %v", err)
 		return
 	}
 
 	backupDir := vol.BackupDir
-	vol.Target = targetURL.String() + "/" + d.Handler.Hostname + "/" + vol.Name
-	vol.BackupDir = vol.Mountpoint + "/" + backupDir
-	vol.Mount = vol.Name + ":" + vol.Mountpoint + ":ro"
+	vol.BackupDir = vol.ContainerPath() + "/" + backupDir
+	vol.Mount = vol.MountSource() + ":" + vol.ContainerPath() + ":ro"
 
-	err = util.Retry(3, d.duplicityBackup)
+	err = timeBackup(d.Handler, vol, d.Handler.Config.Duplicity.Image, func() error {
+		return util.Retry(3, d.duplicityBackup)
+	})
 	if err != nil {
 		err = fmt.Errorf("failed to backup volume with duplicity: %v", err)
 		return
@@ -76,14 +77,21 @@ func (d *DuplicityEngine) Backup() (err error) {
 		return
 	}
 
-	if _, err := d.Handler.IsCheckScheduled(vol); err == nil {
-		err = util.Retry(3, d.verify)
+	scheduled, err := d.Handler.IsCheckScheduled(vol)
+	if err != nil {
+		return
+	}
+	if scheduled {
+		err = util.Retry(3, d.check)
 		if err != nil {
 			err = fmt.Errorf("failed to verify backup: %v", err)
-			return err
+			return
 		}
-	} else {
-		return err
+	}
+
+	if d.Handler.Config.DryRun {
+		// No collection status to parse
+		return
 	}
 
 	err = util.Retry(3, d.status)
@@ -95,19 +103,100 @@ func (d *DuplicityEngine) Backup() (err error) {
 	return
 }
 
-// removeOld cleans up old backup data
-func (d *DuplicityEngine) removeOld() (err error) {
+// setupTarget sets the volume target from the target URL
+func (d *DuplicityEngine) setupTarget() (err error) {
 	v := d.Volume
-	_, _, err = d.launchDuplicity(
+	targetURL, err := v.TargetURL()
+	if err != nil {
+		return
+	}
+	v.Target = targetURL.String() + "/" + d.Handler.Hostname + "/" + v.Name
+	return
+}
+
+// Restore restores the volume from its backup at opts.Time,
+// or from the latest backup if it is empty.
+// Restored files overwrite the ones in the volume.
+func (d *DuplicityEngine) Restore(opts RestoreOptions) (err error) {
+	v := d.Volume
+	restoreTime := opts.Time
+
+	err = d.setupTarget()
+	if err != nil {
+		return
+	}
+
+	state, _, err := d.launchDuplicity(
+		d.restoreCommand(restoreTime),
+		[]string{
+			v.MountSource() + ":" + v.ContainerPath(),
+			cacheMount,
+		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch duplicity to restore the volume: %v", err)
+		return
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_restoreExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+
+	if state != 0 {
+		err = fmt.Errorf("Duplicity exited with state %v while restoring the volume", state)
+	}
+	return
+}
+
+// duplicityBackupSetRx matches the backup sets listed by duplicity
+var duplicityBackupSetRx = regexp.MustCompile(`^\s*(Full|Incremental)\s+(.+?)\s+\d+\s*$`)
+
+// Init checks that the volume's target is reachable, without backing up.
+// Duplicity creates its backup chains on the first backup, so there is
+// no repository to create.
+func (d *DuplicityEngine) Init() (err error) {
+	err = d.setupTarget()
+	if err != nil {
+		return
+	}
+
+	state, _, err := d.launchDuplicity(
+		d.statusCommand(),
 		[]string{
-			"remove-older-than", v.Config.Duplicity.RemoveOlderThan,
-			"--s3-use-new-style",
-			"--ssh-options", "-oStrictHostKeyChecking=no",
-			"--no-encryption",
-			"--force",
-			"--name", v.Name,
-			v.Target,
+			cacheMount,
 		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Duplicity: %v", err)
+		return
+	}
+	if state != 0 {
+		err = fmt.Errorf("Duplicity exited with state %v while checking the target", state)
+	}
+	return
+}
+
+// PreviewRetention returns the backup sets remove-older-than would remove
+func (d *DuplicityEngine) PreviewRetention() (sets []string, err error) {
+	if d.Volume.Config.Duplicity.RemoveOlderThan == "" {
+		err = ErrNoRetentionPolicy
+		return
+	}
+
+	err = d.setupTarget()
+	if err != nil {
+		return
+	}
+
+	// Without --force, duplicity only lists the backup sets to remove
+	_, stdout, err := d.launchDuplicity(
+		d.removeOldCommand(false),
 		[]string{
 			cacheMount,
 		},
@@ -116,23 +205,39 @@ func (d *DuplicityEngine) removeOld() (err error) {
 		err = fmt.Errorf("failed to launch Duplicity: %v", err)
 		return
 	}
+	sets = parseBackupSets(stdout)
 	return
 }
 
-// cleanup removes old index data from duplicity
-func (d *DuplicityEngine) cleanup() (err error) {
-	v := d.Volume
+// parseBackupSets returns the backup sets listed in duplicity's output
+func parseBackupSets(stdout string) (sets []string) {
+	for _, line := range strings.Split(stdout, "\n") {
+		if m := duplicityBackupSetRx.FindStringSubmatch(line); m != nil {
+			sets = append(sets, m[1]+" "+m[2])
+		}
+	}
+	return
+}
+
+// removeOld cleans up old backup data
+func (d *DuplicityEngine) removeOld() (err error) {
 	_, _, err = d.launchDuplicity(
+		d.removeOldCommand(true),
 		[]string{
-			"cleanup",
-			"--s3-use-new-style",
-			"--ssh-options", "-oStrictHostKeyChecking=no",
-			"--no-encryption",
-			"--force",
-			"--extra-clean",
-			"--name", v.Name,
-			v.Target,
+			cacheMount,
 		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Duplicity: %v", err)
+		return
+	}
+	return
+}
+
+// cleanup removes old index data from duplicity
+func (d *DuplicityEngine) cleanup() (err error) {
+	_, _, err = d.launchDuplicity(
+		d.cleanupCommand(),
 		[]string{
 			cacheMount,
 		},
@@ -143,20 +248,27 @@ func (d *DuplicityEngine) cleanup() (err error) {
 	return
 }
 
-// verify checks that the backup is usable
-func (d *DuplicityEngine) verify() (err error) {
+// Verify checks the volume's backup without backing it up
+func (d *DuplicityEngine) Verify() (err error) {
+	v := d.Volume
+	if v.Target == "" {
+		err = d.setupTarget()
+		if err != nil {
+			return
+		}
+	}
+	if v.Mount == "" {
+		v.BackupDir = v.ContainerPath() + "/" + v.BackupDir
+		v.Mount = v.MountSource() + ":" + v.ContainerPath() + ":ro"
+	}
+	return util.Retry(3, d.check)
+}
+
+// check checks that the backup is usable
+func (d *DuplicityEngine) check() (err error) {
 	v := d.Volume
 	state, _, err := d.launchDuplicity(
-		[]string{
-			"verify",
-			"--s3-use-new-style",
-			"--ssh-options", "-oStrictHostKeyChecking=no",
-			"--no-encryption",
-			"--allow-source-mismatch",
-			"--name", v.Name,
-			v.Target,
-			v.BackupDir,
-		},
+		d.verifyCommand(),
 		[]string{
 			v.Mount,
 			cacheMount,
@@ -168,14 +280,13 @@ func (d *DuplicityEngine) verify() (err error) {
 	}
 
 	if state == 0 {
-		now := time.Now().Local()
-		os.Chtimes(v.Mountpoint+"/.conplicity_last_check", now, now)
+		d.Handler.SetLastCheck(v)
 	} else {
 		err = fmt.Errorf("Duplicity exited with state %v while checking the backup", state)
 	}
 
 	metric := d.Volume.MetricsHandler.NewMetric("conplicity_verifyExitCode", "gauge")
-	err = metric.UpdateEvent(
+	metric.UpdateEvent(
 		&metrics.Event{
 			Labels: map[string]string{
 				"volume": v.Name,
@@ -194,14 +305,7 @@ func (d *DuplicityEngine) status() (err error) {
 	v := d.Volume
 	for i := 0; i < attempts; i++ {
 		_, stdout, err = d.launchDuplicity(
-			[]string{
-				"collection-status",
-				"--s3-use-new-style",
-				"--ssh-options", "-oStrictHostKeyChecking=no",
-				"--no-encryption",
-				"--name", v.Name,
-				v.Target,
-			},
+			d.statusCommand(),
 			[]string{
 				v.Mount,
 				cacheMount,
@@ -224,36 +328,9 @@ func (d *DuplicityEngine) status() (err error) {
 		return
 	}
 
-	fullBackup := fullBackupRx.FindStringSubmatch(stdout)
-	var fullBackupDate time.Time
-	var chainEndTimeDate time.Time
-
-	if len(fullBackup) > 0 {
-		chainEndTime := chainEndTimeRx.FindAllStringSubmatch(stdout, -1)
-		if strings.TrimSpace(fullBackup[1]) == "none" {
-			fullBackupDate = time.Unix(0, 0)
-			chainEndTimeDate = time.Unix(0, 0)
-		} else {
-			fullBackupDate, err = time.Parse(timeFormat, strings.TrimSpace(fullBackup[1]))
-			if err != nil {
-				err = fmt.Errorf("failed to parse full backup data: %v", err)
-				return
-			}
-
-			if len(chainEndTime) > 0 {
-				chainEndTimeDate, err = time.Parse(timeFormat, strings.TrimSpace(chainEndTime[len(chainEndTime)-1][1]))
-				if err != nil {
-					err = fmt.Errorf("failed to parse chain end time date: %v", err)
-					return
-				}
-			} else {
-				err = fmt.Errorf("failed to parse Duplicity output for chain end time of %v", v.Name)
-				return
-			}
-
-		}
-	} else {
-		err = fmt.Errorf("failed to parse Duplicity output for last full backup date of %v", v.Name)
+	fullBackupDate, chainEndTimeDate, err := parseCollectionStatus(stdout)
+	if err != nil {
+		err = fmt.Errorf("failed to parse Duplicity output for %v: %v", v.Name, err)
 		return
 	}
 
@@ -273,109 +350,223 @@ func (d *DuplicityEngine) status() (err error) {
 		},
 	)
 
+	if length, ok := parseChainLength(stdout); ok {
+		chainLengthMetric := d.Volume.MetricsHandler.NewMetric("conplicity_chainLength", "gauge")
+		chainLengthMetric.UpdateEvent(
+			&metrics.Event{
+				Labels: map[string]string{},
+				Value:  strconv.Itoa(length),
+			},
+		)
+	} else {
+		v.Log().Debug("No backup sets count found in collection-status output")
+	}
+
 	return
 }
 
-// launchDuplicity starts a duplicity container with given command and binds
-func (d *DuplicityEngine) launchDuplicity(cmd []string, binds []string) (state int, stdout string, err error) {
-	err = util.PullImage(d.Handler.Client, d.Handler.Config.Duplicity.Image)
-	if err != nil {
-		err = fmt.Errorf("failed to pull image: %v", err)
+// parseChainLength returns the number of backup sets in the last backup
+// chain from collection-status' output, which is the primary chain
+func parseChainLength(stdout string) (length int, ok bool) {
+	if noBackupChainRx.MatchString(stdout) {
+		return 0, true
+	}
+	sets := backupSetsRx.FindAllStringSubmatch(stdout, -1)
+	if len(sets) == 0 {
 		return
 	}
+	length, err := strconv.Atoi(sets[len(sets)-1][1])
+	return length, err == nil
+}
 
-	env := []string{
-		"AWS_ACCESS_KEY_ID=" + d.Handler.Config.AWS.AccessKeyID,
-		"AWS_SECRET_ACCESS_KEY=" + d.Handler.Config.AWS.SecretAccessKey,
-		"SWIFT_USERNAME=" + d.Handler.Config.Swift.Username,
-		"SWIFT_PASSWORD=" + d.Handler.Config.Swift.Password,
-		"SWIFT_AUTHURL=" + d.Handler.Config.Swift.AuthURL,
-		"SWIFT_TENANTNAME=" + d.Handler.Config.Swift.TenantName,
-		"SWIFT_REGIONNAME=" + d.Handler.Config.Swift.RegionName,
-		"SWIFT_AUTHVERSION=2",
-	}
-
-	log.WithFields(log.Fields{
-		"image":       d.Handler.Config.Duplicity.Image,
-		"command":     strings.Join(cmd, " "),
-		"environment": strings.Join(env, ", "),
-		"binds":       strings.Join(binds, ", "),
-	}).Debug("Creating container")
-
-	container, err := d.Handler.ContainerCreate(
-		context.Background(),
-		&container.Config{
-			Cmd:          cmd,
-			Env:          env,
-			Image:        d.Handler.Config.Duplicity.Image,
-			OpenStdin:    true,
-			StdinOnce:    true,
-			AttachStdin:  true,
-			AttachStdout: true,
-			AttachStderr: true,
-			Tty:          true,
-		},
-		&container.HostConfig{
-			Binds: binds,
-		}, nil, "",
-	)
+// parseCollectionStatus returns the dates of the last full backup
+// and of the end of the last backup chain from collection-status' output.
+// Both dates are the epoch when no backup was made yet.
+func parseCollectionStatus(stdout string) (fullBackupDate, chainEndTimeDate time.Time, err error) {
+	fullBackup := fullBackupRx.FindStringSubmatch(stdout)
+	if len(fullBackup) == 0 {
+		if noBackupChainRx.MatchString(stdout) {
+			return time.Unix(0, 0), time.Unix(0, 0), nil
+		}
+		err = fmt.Errorf("no last full backup date found")
+		return
+	}
+
+	if strings.TrimSpace(fullBackup[1]) == "none" {
+		return time.Unix(0, 0), time.Unix(0, 0), nil
+	}
+
+	fullBackupDate, err = time.Parse(timeFormat, strings.TrimSpace(fullBackup[1]))
 	if err != nil {
-		err = fmt.Errorf("failed to create container: %v", err)
+		err = fmt.Errorf("failed to parse full backup data: %v", err)
 		return
 	}
-	defer util.RemoveContainer(d.Handler.Client, container.ID)
 
-	log.Debugf("Launching 'duplicity %v'...", strings.Join(cmd, " "))
-	err = d.Handler.ContainerStart(context.Background(), container.ID, types.ContainerStartOptions{})
+	chainEndTime := chainEndTimeRx.FindAllStringSubmatch(stdout, -1)
+	if len(chainEndTime) == 0 {
+		err = fmt.Errorf("no chain end time found")
+		return
+	}
+	chainEndTimeDate, err = time.Parse(timeFormat, strings.TrimSpace(chainEndTime[len(chainEndTime)-1][1]))
 	if err != nil {
-		err = fmt.Errorf("failed to start container: %v", err)
+		err = fmt.Errorf("failed to parse chain end time date: %v", err)
 	}
+	return
+}
 
-	var exited bool
+// command assembles a duplicity command: the operation and its options,
+// the options shared by all commands, the volume's extra arguments, then
+// the positional arguments, so that duplicity parses the extra arguments
+// as options
+func (d *DuplicityEngine) command(operation []string, positionals ...string) (cmd []string) {
+	cmd = append(cmd, operation...)
+	cmd = append(cmd, d.commonArgs()...)
+	cmd = append(cmd, d.Volume.Config.Duplicity.ExtraArgs...)
+	return append(cmd, positionals...)
+}
 
-	for !exited {
-		var cont types.ContainerJSON
-		cont, err = d.Handler.ContainerInspect(context.Background(), container.ID)
-		if err != nil {
-			err = fmt.Errorf("failed to inspect container: %v", err)
-			return
-		}
+// commonArgs returns the options shared by all duplicity commands
+func (d *DuplicityEngine) commonArgs() (args []string) {
+	args = []string{"--s3-use-new-style"}
+	encryption, _ := encryptionArgs(d.Volume.Config)
+	args = append(args, encryption...)
+	opts, _ := sshOptions(d.Handler.Config)
+	if !d.Handler.Config.SSH.StrictHostKeyChecking {
+		// Host keys were never checked before the setting existed
+		opts = append([]string{"-oStrictHostKeyChecking=no"}, opts...)
+	}
+	if len(opts) > 0 {
+		args = append(args, "--ssh-options", strings.Join(opts, " "))
+	}
+	return append(args, "--name", d.Volume.Name)
+}
 
-		if cont.State.Status == "exited" {
-			exited = true
-			state = cont.State.ExitCode
-		}
+// backupCommand returns the command backing up the volume
+func (d *DuplicityEngine) backupCommand() []string {
+	v := d.Volume
+	return d.command([]string{
+		"--full-if-older-than", v.Config.Duplicity.FullIfOlderThan,
+		"--allow-source-mismatch",
+	}, v.BackupDir, v.Target)
+}
+
+// restoreCommand returns the command restoring the volume
+// from its backup at restoreTime, or from the latest one
+func (d *DuplicityEngine) restoreCommand(restoreTime string) []string {
+	v := d.Volume
+	operation := []string{"restore", "--force"}
+	if restoreTime != "" {
+		operation = append(operation, "--time", restoreTime)
 	}
+	return d.command(operation, v.Target, v.ContainerPath()+"/"+v.BackupDir)
+}
 
-	body, err := d.Handler.ContainerLogs(context.Background(), container.ID, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Details:    true,
-		Follow:     true,
-	})
-	if err != nil {
-		err = fmt.Errorf("failed to retrieve logs: %v", err)
-		return
+// removeOldCommand returns the command removing the backups older than
+// the retention period, which only lists them without force
+func (d *DuplicityEngine) removeOldCommand(force bool) []string {
+	v := d.Volume
+	operation := []string{"remove-older-than", v.Config.Duplicity.RemoveOlderThan}
+	if force {
+		operation = append(operation, "--force")
 	}
+	return d.command(operation, v.Target)
+}
+
+// cleanupCommand returns the command removing the leftovers of failed backups
+func (d *DuplicityEngine) cleanupCommand() []string {
+	return d.command([]string{"cleanup", "--force", "--extra-clean"}, d.Volume.Target)
+}
+
+// verifyCommand returns the command comparing the backup with the volume
+func (d *DuplicityEngine) verifyCommand() []string {
+	v := d.Volume
+	return d.command([]string{"verify", "--allow-source-mismatch"}, v.Target, v.BackupDir)
+}
+
+// statusCommand returns the command listing the backup chains of the volume
+func (d *DuplicityEngine) statusCommand() []string {
+	return d.command([]string{"collection-status"}, d.Volume.Target)
+}
 
-	defer body.Close()
-	content, err := ioutil.ReadAll(body)
+// duplicityEnv returns the environment of duplicity containers
+// with the credentials of the storage backends
+func duplicityEnv(c *config.Config) []string {
+	env := []string{
+		"AWS_ACCESS_KEY_ID=" + c.AWS.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + c.AWS.SecretAccessKey,
+		"SWIFT_USERNAME=" + c.Swift.Username,
+		"SWIFT_PASSWORD=" + c.Swift.Password,
+		"SWIFT_AUTHURL=" + c.Swift.AuthURL,
+		"SWIFT_TENANTNAME=" + c.Swift.TenantName,
+		"SWIFT_REGIONNAME=" + c.Swift.RegionName,
+		"SWIFT_AUTHVERSION=" + strconv.Itoa(c.Swift.AuthVersion),
+		"AZURE_ACCOUNT_NAME=" + c.Azure.AccountName,
+		"AZURE_ACCOUNT_KEY=" + c.Azure.AccountKey,
+		// The output of collection-status is parsed
+		"LANG=C",
+		"LC_ALL=C",
+	}
+	if c.Swift.AuthVersion == 3 {
+		env = append(env,
+			"SWIFT_USER_DOMAIN_NAME="+c.Swift.UserDomainName,
+			"SWIFT_PROJECT_DOMAIN_NAME="+c.Swift.ProjectDomainName,
+			"SWIFT_PROJECT_NAME="+c.Swift.ProjectName,
+			"SWIFT_PROJECT_ID="+c.Swift.ProjectID,
+		)
+	}
+	return env
+}
+
+// launchDuplicity starts a duplicity container with given command and binds
+func (d *DuplicityEngine) launchDuplicity(cmd []string, binds []string) (state int, stdout string, err error) {
+	env := duplicityEnv(d.Handler.Config)
+
+	_, sshBinds := sshOptions(d.Handler.Config)
+	binds = append(binds, sshBinds...)
+
+	_, encryptionEnv := encryptionArgs(d.Volume.Config)
+	env = append(env, encryptionEnv...)
+
+	state, stdout, stderr, err := LaunchContainer(d.Handler, d.Volume, d.Handler.Config.Duplicity.Image, cmd, binds, env)
 	if err != nil {
-		err = fmt.Errorf("failed to read logs from response: %v", err)
 		return
 	}
+	stdout += stderr
+	err = checkEncryption(d.Volume.Target, stdout, d.Volume.Config.GPGPassphrase != "")
+	return
+}
 
-	stdout = string(content)
-	log.Debug(stdout)
-
+// encryptionArgs returns the duplicity arguments and environment
+// encrypting the backups of a volume. Backups are encrypted
+// only when a GPG passphrase is set, asymmetrically if a key is set.
+func encryptionArgs(c *volume.Config) (args, env []string) {
+	if c.GPGPassphrase == "" {
+		return []string{"--no-encryption"}, nil
+	}
+	if c.EncryptKey != "" {
+		args = []string{"--encrypt-key", c.EncryptKey}
+	}
+	env = []string{"PASSPHRASE=" + c.GPGPassphrase}
 	return
 }
 
+// checkEncryption reports backup chains that cannot be decrypted,
+// either because duplicity is run with --no-encryption
+// or because the passphrase is wrong
+func checkEncryption(target, stdout string, encrypted bool) error {
+	if !gpgErrorRx.MatchString(stdout) {
+		return nil
+	}
+	if encrypted {
+		return fmt.Errorf("failed to decrypt backup chain at %s, check the GPG passphrase and key", target)
+	}
+	return fmt.Errorf("backup chain at %s is GPG-encrypted but duplicity is run with --no-encryption", target)
+}
+
 // duplicityBackup performs the backup of a volume with duplicity
 func (d *DuplicityEngine) duplicityBackup() (err error) {
 	v := d.Volume
-	log.WithFields(log.Fields{
-		"name":               v.Name,
+	v.Log().WithFields(log.Fields{
 		"backup_dir":         v.BackupDir,
 		"full_if_older_than": v.Config.Duplicity.FullIfOlderThan,
 		"target":             v.Target,
@@ -386,16 +577,7 @@ func (d *DuplicityEngine) duplicityBackup() (err error) {
 	// Init engine
 
 	state, _, err := d.launchDuplicity(
-		[]string{
-			"--full-if-older-than", v.Config.Duplicity.FullIfOlderThan,
-			"--s3-use-new-style",
-			"--ssh-options", "-oStrictHostKeyChecking=no",
-			"--no-encryption",
-			"--allow-source-mismatch",
-			"--name", v.Name,
-			v.BackupDir,
-			v.Target,
-		},
+		d.backupCommand(),
 		[]string{
 			v.Mount,
 			cacheMount,
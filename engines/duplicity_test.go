@@ -1,5 +1,361 @@
 package engines
 
+import (
+	"strings"
+	"testing"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/volume"
+	"github.com/docker/docker/api/types"
+)
+
+func TestCheckEncryption(t *testing.T) {
+	err := checkEncryption("s3://foo/bar", "Last full backup date: none\n", false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	gpgError := "GPGError: GPG Failed, see log below:\ngpg: decryption failed: No secret key\n"
+	err = checkEncryption("s3://foo/bar", gpgError, false)
+	if err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+
+	expected := "backup chain at s3://foo/bar is GPG-encrypted but duplicity is run with --no-encryption"
+	if got := err.Error(); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+
+	err = checkEncryption("s3://foo/bar", gpgError, true)
+	expected = "failed to decrypt backup chain at s3://foo/bar, check the GPG passphrase and key"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected %s, got %v", expected, err)
+	}
+}
+
+func TestEncryptionArgs(t *testing.T) {
+	c := &volume.Config{}
+	args, env := encryptionArgs(c)
+	if strings.Join(args, " ") != "--no-encryption" || len(env) != 0 {
+		t.Fatalf("Expected --no-encryption without environment, got %v, %v", args, env)
+	}
+
+	c.GPGPassphrase = "secret"
+	args, env = encryptionArgs(c)
+	if len(args) != 0 || strings.Join(env, " ") != "PASSPHRASE=secret" {
+		t.Fatalf("Expected symmetric encryption, got %v, %v", args, env)
+	}
+
+	c.EncryptKey = "DEADBEEF"
+	args, env = encryptionArgs(c)
+	if strings.Join(args, " ") != "--encrypt-key DEADBEEF" || strings.Join(env, " ") != "PASSPHRASE=secret" {
+		t.Fatalf("Expected asymmetric encryption, got %v, %v", args, env)
+	}
+}
+
+// fakeDuplicityEngine returns a duplicity engine for volume foo
+// backed up to s3://bucket/foo
+func fakeDuplicityEngine() *DuplicityEngine {
+	d := &DuplicityEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{},
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name:       "foo",
+				Mountpoint: "/var/lib/docker/volumes/foo/_data",
+			},
+			Target:    "s3://bucket/foo",
+			BackupDir: "data",
+			Config:    &volume.Config{},
+		},
+	}
+	d.Handler.Config.SSH.StrictHostKeyChecking = true
+	d.Volume.Config.Duplicity.FullIfOlderThan = "15D"
+	d.Volume.Config.Duplicity.RemoveOlderThan = "30D"
+	return d
+}
+
+func TestDuplicityCommands(t *testing.T) {
+	d := fakeDuplicityEngine()
+	common := "--s3-use-new-style --no-encryption --name foo"
+
+	for _, c := range []struct {
+		cmd      []string
+		expected string
+	}{
+		{d.backupCommand(), "--full-if-older-than 15D --allow-source-mismatch " + common + " data s3://bucket/foo"},
+		{d.restoreCommand(""), "restore --force " + common + " s3://bucket/foo /var/lib/docker/volumes/foo/_data/data"},
+		{d.restoreCommand("3D"), "restore --force --time 3D " + common + " s3://bucket/foo /var/lib/docker/volumes/foo/_data/data"},
+		{d.removeOldCommand(false), "remove-older-than 30D " + common + " s3://bucket/foo"},
+		{d.removeOldCommand(true), "remove-older-than 30D --force " + common + " s3://bucket/foo"},
+		{d.cleanupCommand(), "cleanup --force --extra-clean " + common + " s3://bucket/foo"},
+		{d.verifyCommand(), "verify --allow-source-mismatch " + common + " s3://bucket/foo data"},
+		{d.statusCommand(), "collection-status " + common + " s3://bucket/foo"},
+	} {
+		if got := strings.Join(c.cmd, " "); got != c.expected {
+			t.Fatalf("Expected '%s', got '%s'", c.expected, got)
+		}
+	}
+}
+
+func TestDuplicityCommand(t *testing.T) {
+	d := fakeDuplicityEngine()
+	d.Volume.Config.GPGPassphrase = "secret"
+	d.Volume.Config.EncryptKey = "ABCD1234"
+	d.Volume.Config.Duplicity.ExtraArgs = []string{"--volsize", "100"}
+
+	cmd := strings.Join(d.command([]string{"verify"}, "s3://bucket/foo", "/data"), " ")
+	if expected := "verify --s3-use-new-style --encrypt-key ABCD1234 --name foo --volsize 100 s3://bucket/foo /data"; cmd != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, cmd)
+	}
+}
+
+func TestDuplicityStrictHostKeyChecking(t *testing.T) {
+	d := fakeDuplicityEngine()
+	d.Handler.Config.SSH.StrictHostKeyChecking = false
+
+	cmd := strings.Join(d.statusCommand(), " ")
+	if !strings.Contains(cmd, "--ssh-options -oStrictHostKeyChecking=no") {
+		t.Fatalf("Expected host key checking to be disabled, got '%s'", cmd)
+	}
+
+	d.Handler.Config.SSH.StrictHostKeyChecking = true
+	cmd = strings.Join(d.statusCommand(), " ")
+	if strings.Contains(cmd, "--ssh-options") {
+		t.Fatalf("Expected no ssh options, got '%s'", cmd)
+	}
+
+	d.Handler.Config.SSH.KnownHostsPath = "/etc/conplicity/known_hosts"
+	cmd = strings.Join(d.statusCommand(), " ")
+	if expected := "--ssh-options -oUserKnownHostsFile=" + sshKnownHostsPath; !strings.Contains(cmd, expected) {
+		t.Fatalf("Expected '%s' in '%s'", expected, cmd)
+	}
+}
+
+func TestDuplicitySSHOptions(t *testing.T) {
+	d := fakeDuplicityEngine()
+	d.Handler.Config.SSH.StrictHostKeyChecking = false
+	d.Handler.Config.SSH.PrivateKeyPath = "/etc/conplicity/id_ed25519"
+	expected := "--ssh-options -oStrictHostKeyChecking=no -oIdentityFile=" + sshKeyPath + " --name foo"
+
+	for _, cmd := range [][]string{
+		d.backupCommand(),
+		d.restoreCommand(""),
+		d.removeOldCommand(false),
+		d.cleanupCommand(),
+		d.verifyCommand(),
+		d.statusCommand(),
+	} {
+		if got := strings.Join(cmd, " "); !strings.Contains(got, expected) {
+			t.Fatalf("Expected '%s' in '%s'", expected, got)
+		}
+	}
+}
+
+func TestDuplicityInitDryRun(t *testing.T) {
+	d := &DuplicityEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{
+				DryRun: true,
+			},
+			Hostname: "host",
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name: "foo",
+			},
+			Config: &volume.Config{
+				TargetURL: "s3://s3.amazonaws.com/backups",
+			},
+		},
+	}
+
+	if err := d.Init(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if d.Volume.Target != "s3://s3.amazonaws.com/backups/host/foo" {
+		t.Fatalf("Expected the target to be set up, got %s", d.Volume.Target)
+	}
+}
+
+func TestDuplicityVerifyDryRun(t *testing.T) {
+	d := &DuplicityEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{
+				DryRun:     true,
+				CheckEvery: "24h",
+			},
+			Hostname: "host",
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name:       "foo",
+				Mountpoint: "/var/lib/docker/volumes/foo/_data",
+			},
+			BackupDir: "data",
+			Config: &volume.Config{
+				TargetURL: "s3://s3.amazonaws.com/backups",
+			},
+			MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+		},
+	}
+
+	if err := d.Verify(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got, expected := d.Volume.BackupDir, "/var/lib/docker/volumes/foo/_data/data"; got != expected {
+		t.Fatalf("Expected backup dir %s, got %s", expected, got)
+	}
+	if event := d.Volume.MetricsHandler.Metrics["conplicity_verifyExitCode"].Events[0]; event.Value != "0" {
+		t.Fatalf("Expected a successful check, got %+v", event)
+	}
+}
+
+func TestParseCollectionStatus(t *testing.T) {
+	// Output of an encrypted backup chain
+	stdout := `Local and Remote metadata are synchronized, no sync needed.
+Last full backup date: Wed Mar  1 02:00:12 2017
+Collection Status
+-----------------
+Connecting with backend: BackendWrapper
+Archive dir: /root/.cache/duplicity/foo
+
+Found 0 secondary backup chains.
+
+Found primary backup chain with matching signature chain:
+-------------------------
+Chain start time: Wed Mar  1 02:00:12 2017
+Chain end time: Thu Mar  2 02:00:08 2017
+Number of contained backup sets: 2
+Total number of contained volumes: 2
+ Type of backup set:                            Time:      Num volumes:
+                Full         Wed Mar  1 02:00:12 2017                 1
+         Incremental         Thu Mar  2 02:00:08 2017                 1
+-------------------------
+No orphaned or incomplete backup sets found.
+gpg: AES256 encrypted data
+gpg: encrypted with 1 passphrase
+`
+	full, end, err := parseCollectionStatus(stdout)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if full.Unix() != 1488333612 {
+		t.Fatalf("Expected full backup date 1488333612, got %v", full.Unix())
+	}
+	if end.Unix() != 1488420008 {
+		t.Fatalf("Expected chain end time 1488420008, got %v", end.Unix())
+	}
+
+	full, end, err = parseCollectionStatus("Last full backup date: none\nNo orphaned or incomplete backup sets found.\n")
+	if err != nil || full.Unix() != 0 || end.Unix() != 0 {
+		t.Fatalf("Expected epoch dates, got %v, %v, %v", full, end, err)
+	}
+
+	// Output of a target without backups
+	stdout = `Local and Remote metadata are synchronized, no sync needed.
+Last full backup date: none
+Collection Status
+-----------------
+Connecting with backend: BackendWrapper
+Archive dir: /root/.cache/duplicity/foo
+
+Found 0 secondary backup chains.
+No backup chains with active signatures found
+No orphaned or incomplete backup sets found.
+`
+	full, end, err = parseCollectionStatus(stdout)
+	if err != nil || full.Unix() != 0 || end.Unix() != 0 {
+		t.Fatalf("Expected epoch dates for an empty target, got %v, %v, %v", full, end, err)
+	}
+
+	// Output of a new target, without the last full backup date
+	stdout = `Collection Status
+-----------------
+Connecting with backend: BackendWrapper
+Archive dir: /root/.cache/duplicity/foo
+
+Found 0 secondary backup chains.
+No backup chains with active signatures found
+No orphaned or incomplete backup sets found.
+`
+	full, end, err = parseCollectionStatus(stdout)
+	if err != nil || full.Unix() != 0 || end.Unix() != 0 {
+		t.Fatalf("Expected epoch dates for a new target, got %v, %v, %v", full, end, err)
+	}
+
+	if _, _, err = parseCollectionStatus("Wrong stdout"); err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+}
+
+func TestParseChainLength(t *testing.T) {
+	stdout := `Found 1 secondary backup chains.
+Secondary chain 1 of 1:
+-------------------------
+Chain start time: Sat Jan 28 02:00:11 2017
+Chain end time: Tue Feb 28 02:00:09 2017
+Number of contained backup sets: 32
+Total number of contained volumes: 32
+-------------------------
+
+Found primary backup chain with matching signature chain:
+-------------------------
+Chain start time: Wed Mar  1 02:00:12 2017
+Chain end time: Thu Mar  2 02:00:08 2017
+Number of contained backup sets: 2
+Total number of contained volumes: 2
+-------------------------
+No orphaned or incomplete backup sets found.
+`
+	if length, ok := parseChainLength(stdout); !ok || length != 2 {
+		t.Fatalf("Expected a primary chain of 2 backup sets, got %d, %v", length, ok)
+	}
+
+	if length, ok := parseChainLength("No backup chains with active signatures found\n"); !ok || length != 0 {
+		t.Fatalf("Expected no backup set, got %d, %v", length, ok)
+	}
+
+	if _, ok := parseChainLength("Wrong stdout"); ok {
+		t.Fatal("Expected no chain length")
+	}
+}
+
+func TestParseBackupSets(t *testing.T) {
+	stdout := `Found old backup chains at the following times, which would be deleted (use --force):
+-------------------------
+Chain start time: Wed Mar  1 02:00:12 2017
+Chain end time: Thu Mar  2 02:00:08 2017
+Number of contained backup sets: 2
+Total number of contained volumes: 2
+ Type of backup set:                            Time:      Num volumes:
+                Full         Wed Mar  1 02:00:12 2017                 1
+         Incremental         Thu Mar  2 02:00:08 2017                 1
+-------------------------
+Run duplicity again with the --force option to actually delete.
+`
+	sets := parseBackupSets(stdout)
+	expected := []string{
+		"Full Wed Mar  1 02:00:12 2017",
+		"Incremental Thu Mar  2 02:00:08 2017",
+	}
+	if len(sets) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, sets)
+	}
+	for i := range expected {
+		if sets[i] != expected[i] {
+			t.Fatalf("Expected %s, got %s", expected[i], sets[i])
+		}
+	}
+
+	if sets := parseBackupSets("No old backup sets found, nothing deleted.\n"); len(sets) != 0 {
+		t.Fatalf("Expected no backup set, got %v", sets)
+	}
+}
+
 // TODO: fix these tests
 /*
 
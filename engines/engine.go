@@ -1,6 +1,8 @@
 package engines
 
 import (
+	"errors"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/camptocamp/conplicity/handler"
 	"github.com/camptocamp/conplicity/volume"
@@ -8,11 +10,47 @@ import (
 
 // Engine implements a backup engine interface
 type Engine interface {
+	// Backup backs up the volume
 	Backup() error
+	// Verify checks the volume's backup, outside of a backup
+	Verify() error
+	// Restore restores the volume from its backup
+	Restore(opts RestoreOptions) error
 	GetName() string
 }
 
-// GetEngine returns the engine for passed volume
+// RestoreOptions tells what to restore. Engines ignore the options
+// which do not apply to them.
+type RestoreOptions struct {
+	// Snapshot is the restic snapshot, borg or tar archive to restore,
+	// the latest one when empty
+	Snapshot string
+	// Target is the path restic restores to, where the volume is mounted
+	Target string
+	// Include restricts the restic or borg restore to these absolute paths
+	Include []string
+	// Time is the time of the duplicity backup to restore, the latest when empty
+	Time string
+}
+
+// RetentionPreviewer is implemented by engines able to list the backups
+// their retention policy would remove, without removing them
+type RetentionPreviewer interface {
+	PreviewRetention() ([]string, error)
+}
+
+// ErrNoRetentionPolicy is returned by PreviewRetention when the volume has
+// no retention policy, so that its backups are kept forever
+var ErrNoRetentionPolicy = errors.New("no retention policy configured")
+
+// Initializer is implemented by engines able to prepare the target
+// of a volume without backing it up
+type Initializer interface {
+	Init() error
+}
+
+// GetEngine returns the engine for passed volume,
+// or nil if the volume's engine is unknown
 func GetEngine(c *handler.Conplicity, v *volume.Volume) Engine {
 	engine := v.Config.Engine
 	log.Debugf("engine=%s", engine)
@@ -33,8 +71,17 @@ func GetEngine(c *handler.Conplicity, v *volume.Volume) Engine {
 			Handler: c,
 			Volume:  v,
 		}
+	case "borg":
+		return &BorgEngine{
+			Handler: c,
+			Volume:  v,
+		}
+	case "tar":
+		return &TarEngine{
+			Handler: c,
+			Volume:  v,
+		}
 	}
 
-	log.Fatalf("Unknown engine %s", engine)
 	return nil
 }
@@ -0,0 +1,122 @@
+package engines
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/volume"
+)
+
+func TestGetEngine(t *testing.T) {
+	vol := &volume.Volume{
+		Config: &volume.Config{},
+	}
+
+	for engine, name := range map[string]string{
+		"duplicity": "Duplicity",
+		"rclone":    "RClone",
+		"restic":    "Restic",
+		"borg":      "Borg",
+		"tar":       "Tar",
+	} {
+		vol.Config.Engine = engine
+		e := GetEngine(&handler.Conplicity{}, vol)
+		if e == nil {
+			t.Fatalf("Expected engine %s, got nil", name)
+		}
+		if e.GetName() != name {
+			t.Fatalf("Expected engine %s, got %s", name, e.GetName())
+		}
+	}
+
+	vol.Config.Engine = "foo"
+	if e := GetEngine(&handler.Conplicity{}, vol); e != nil {
+		t.Fatalf("Expected no engine, got %s", e.GetName())
+	}
+}
+
+func TestBackendEnv(t *testing.T) {
+	c := &config.Config{}
+	c.AWS.AccessKeyID = "aws-id"
+	c.AWS.SecretAccessKey = "aws-secret"
+	c.Swift.Username = "swift-user"
+	c.Swift.Password = "swift-password"
+	c.B2.AccountID = "b2-id"
+	c.B2.AccountKey = "b2-key"
+	c.Azure.AccountName = "azure-name"
+	c.Azure.AccountKey = "azure-key"
+	c.Restic.Compression = "max"
+
+	for _, tc := range []struct {
+		engine   string
+		env      []string
+		expected []string
+	}{
+		{"duplicity", duplicityEnv(c), []string{
+			"AWS_ACCESS_KEY_ID=aws-id",
+			"AWS_SECRET_ACCESS_KEY=aws-secret",
+			"SWIFT_USERNAME=swift-user",
+			"SWIFT_PASSWORD=swift-password",
+			"AZURE_ACCOUNT_NAME=azure-name",
+			"AZURE_ACCOUNT_KEY=azure-key",
+		}},
+		{"restic", resticEnv(c), []string{
+			"AWS_ACCESS_KEY_ID=aws-id",
+			"AWS_SECRET_ACCESS_KEY=aws-secret",
+			"OS_USERNAME=swift-user",
+			"OS_PASSWORD=swift-password",
+			"B2_ACCOUNT_ID=b2-id",
+			"B2_ACCOUNT_KEY=b2-key",
+			"AZURE_ACCOUNT_NAME=azure-name",
+			"AZURE_ACCOUNT_KEY=azure-key",
+			"RESTIC_COMPRESSION=max",
+		}},
+	} {
+		env := strings.Join(tc.env, "\n") + "\n"
+		for _, e := range tc.expected {
+			if !strings.Contains(env, e+"\n") {
+				t.Fatalf("Expected %s in the %s environment, got %v", e, tc.engine, tc.env)
+			}
+		}
+	}
+}
+
+func TestSwiftEnv(t *testing.T) {
+	c := &config.Config{}
+	c.Swift.Username = "swift-user"
+	c.Swift.Password = "swift-password"
+	c.Swift.TenantName = "tenant"
+	c.Swift.ProjectName = "project"
+	c.Swift.UserDomainName = "Default"
+	c.Swift.ProjectDomainName = "Default"
+
+	for _, tc := range []struct {
+		version  int
+		appCreds bool
+		expected string
+	}{
+		{2, false, "OS_USERNAME=swift-user,OS_PASSWORD=swift-password,OS_TENANT_NAME=tenant"},
+		{3, false, "OS_USERNAME=swift-user,OS_PASSWORD=swift-password,OS_USER_DOMAIN_NAME=Default,OS_PROJECT_DOMAIN_NAME=Default,OS_PROJECT_NAME=project"},
+		{3, true, "OS_APPLICATION_CREDENTIAL_ID=id,OS_APPLICATION_CREDENTIAL_SECRET=secret"},
+	} {
+		c.Swift.AuthVersion = tc.version
+		if tc.appCreds {
+			c.Swift.ApplicationCredentialID = "id"
+			c.Swift.ApplicationCredentialSecret = "secret"
+		}
+		// The auth URL and region come first
+		if got := strings.Join(swiftEnv(c)[2:], ","); got != tc.expected {
+			t.Fatalf("Expected Keystone v%d environment %s, got %s", tc.version, tc.expected, got)
+		}
+	}
+
+	c.Swift.AuthVersion = 3
+	env := strings.Join(duplicityEnv(c), ",")
+	for _, e := range []string{"SWIFT_AUTHVERSION=3", "SWIFT_USER_DOMAIN_NAME=Default", "SWIFT_PROJECT_NAME=project"} {
+		if !strings.Contains(env, e) {
+			t.Fatalf("Expected %s in the duplicity environment, got %s", e, env)
+		}
+	}
+}
@@ -2,18 +2,11 @@ package engines
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/url"
 	"strings"
 
-	"golang.org/x/net/context"
-
-	log "github.com/Sirupsen/logrus"
 	"github.com/camptocamp/conplicity/handler"
-	"github.com/camptocamp/conplicity/util"
 	"github.com/camptocamp/conplicity/volume"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
 )
 
 // RCloneEngine implements a backup engine with RClone
@@ -31,17 +24,12 @@ func (*RCloneEngine) GetName() string {
 func (r *RCloneEngine) Backup() (err error) {
 	v := r.Volume
 
-	targetURL, err := url.Parse(v.Config.TargetURL)
+	target, extraEnv, err := r.target()
 	if err != nil {
-		err = fmt.Errorf("failed to parse target URL: %v", err)
 		return
 	}
 
-	// Format targetURL for RClone
-	extraEnv := formatURL(targetURL)
-
-	target := targetURL.String() + "/" + r.Handler.Hostname + "/" + v.Name
-	backupDir := v.Mountpoint + "/" + v.BackupDir
+	backupDir := v.ContainerPath() + "/" + v.BackupDir
 
 	state, _, err := r.launchRClone(
 		[]string{
@@ -50,7 +38,7 @@ func (r *RCloneEngine) Backup() (err error) {
 			target,
 		},
 		[]string{
-			v.Name + ":" + v.Mountpoint + ":ro",
+			v.MountSource() + ":" + v.ContainerPath() + ":ro",
 		},
 		extraEnv,
 	)
@@ -63,114 +51,110 @@ func (r *RCloneEngine) Backup() (err error) {
 	return
 }
 
-func formatURL(u *url.URL) (env []string) {
-	// We have no way but to assume fqdns contain "."
-	// which is arguable very ugly
-	if strings.Contains(u.Host, ".") && strings.HasPrefix(u.Scheme, "s3") {
-		u.Opaque = strings.TrimPrefix(u.Path, "/")
-		env = append(env, "AWS_ENDPOINT="+u.Host)
-	} else {
-		u.Opaque = strings.TrimPrefix(u.Host+u.Path, "/")
+// Verify checks that the files of the volume match the ones of its backup
+func (r *RCloneEngine) Verify() (err error) {
+	v := r.Volume
+
+	target, extraEnv, err := r.target()
+	if err != nil {
+		return
 	}
 
-	plusIndex := strings.Index(u.Scheme, "+")
-	if plusIndex >= 0 {
-		u.Scheme = u.Scheme[0:plusIndex]
+	state, _, err := r.launchRClone(
+		[]string{
+			"check",
+			v.ContainerPath() + "/" + v.BackupDir,
+			target,
+		},
+		[]string{
+			v.MountSource() + ":" + v.ContainerPath() + ":ro",
+		},
+		extraEnv,
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch RClone: %v", err)
+		return
+	}
+	if state != 0 {
+		err = fmt.Errorf("RClone exited with state %v while checking the backup", state)
 	}
 	return
 }
 
-// launchRClone starts an rclone container with a given command and binds
-func (r *RCloneEngine) launchRClone(cmd, binds, extraEnv []string) (state int, stdout string, err error) {
-	err = util.PullImage(r.Handler.Client, r.Handler.Config.RClone.Image)
-	if err != nil {
-		err = fmt.Errorf("failed to pull image: %v", err)
-		return
+// Restore copies the files of the backup back to the volume. RClone keeps
+// no history, so only the latest state can be restored, and files which
+// are not in the backup are kept.
+func (r *RCloneEngine) Restore(opts RestoreOptions) (err error) {
+	v := r.Volume
+	if opts.Time != "" || (opts.Snapshot != "" && opts.Snapshot != "latest") {
+		return fmt.Errorf("RClone only restores the latest backup")
 	}
 
-	env := []string{
-		"AWS_ACCESS_KEY_ID=" + r.Handler.Config.AWS.AccessKeyID,
-		"AWS_SECRET_ACCESS_KEY=" + r.Handler.Config.AWS.SecretAccessKey,
-		"OS_USERNAME=" + r.Handler.Config.Swift.Username,
-		"OS_PASSWORD=" + r.Handler.Config.Swift.Password,
-		"OS_AUTH_URL=" + r.Handler.Config.Swift.AuthURL,
-		"OS_TENANT_NAME=" + r.Handler.Config.Swift.TenantName,
-		"OS_REGION_NAME=" + r.Handler.Config.Swift.RegionName,
+	target, extraEnv, err := r.target()
+	if err != nil {
+		return
 	}
-	env = append(env, extraEnv...)
 
-	log.WithFields(log.Fields{
-		"image":       r.Handler.Config.RClone.Image,
-		"command":     strings.Join(cmd, " "),
-		"environment": strings.Join(env, ", "),
-		"binds":       strings.Join(binds, ", "),
-	}).Debug("Creating container")
-
-	container, err := r.Handler.ContainerCreate(
-		context.Background(),
-		&container.Config{
-			Cmd:          cmd,
-			Env:          env,
-			Image:        r.Handler.Config.RClone.Image,
-			OpenStdin:    true,
-			StdinOnce:    true,
-			AttachStdin:  true,
-			AttachStdout: true,
-			AttachStderr: true,
-			Tty:          true,
+	state, _, err := r.launchRClone(
+		[]string{
+			"copy",
+			target,
+			v.ContainerPath() + "/" + v.BackupDir,
 		},
-		&container.HostConfig{
-			Binds: binds,
-		}, nil, "",
+		[]string{
+			v.MountSource() + ":" + v.ContainerPath(),
+		},
+		extraEnv,
 	)
 	if err != nil {
-		err = fmt.Errorf("failed to create container: %v", err)
+		err = fmt.Errorf("failed to launch RClone: %v", err)
 		return
 	}
-	defer util.RemoveContainer(r.Handler.Client, container.ID)
+	if state != 0 {
+		err = fmt.Errorf("RClone exited with state %v while restoring the volume", state)
+	}
+	return
+}
 
-	log.Debugf("Launching 'rclone %v'...", strings.Join(cmd, " "))
-	err = r.Handler.ContainerStart(context.Background(), container.ID, types.ContainerStartOptions{})
+// target returns the rclone path of the volume's backup
+// and the environment needed to reach it
+func (r *RCloneEngine) target() (target string, env []string, err error) {
+	targetURL, err := r.Volume.TargetURL()
 	if err != nil {
-		err = fmt.Errorf("failed to start container: %v", err)
 		return
 	}
+	env = formatURL(targetURL)
+	target = targetURL.String() + "/" + r.Handler.Hostname + "/" + r.Volume.Name
+	return
+}
 
-	var exited bool
-
-	for !exited {
-		var cont types.ContainerJSON
-		cont, err = r.Handler.ContainerInspect(context.Background(), container.ID)
-		if err != nil {
-			err = fmt.Errorf("failed to inspect container: %v", err)
-			return
-		}
-		if cont.State.Status == "exited" {
-			exited = true
-			state = cont.State.ExitCode
-		}
+func formatURL(u *url.URL) (env []string) {
+	// We have no way but to assume fqdns contain "."
+	// which is arguable very ugly
+	if strings.Contains(u.Host, ".") && strings.HasPrefix(u.Scheme, "s3") {
+		u.Opaque = strings.TrimPrefix(u.Path, "/")
+		env = append(env, "AWS_ENDPOINT="+u.Host)
+	} else {
+		u.Opaque = strings.TrimPrefix(u.Host+u.Path, "/")
 	}
 
-	body, err := r.Handler.ContainerLogs(context.Background(), container.ID, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Details:    true,
-		Follow:     true,
-	})
-	if err != nil {
-		err = fmt.Errorf("failed to retrieve logs: %v", err)
-		return
+	plusIndex := strings.Index(u.Scheme, "+")
+	if plusIndex >= 0 {
+		u.Scheme = u.Scheme[0:plusIndex]
 	}
+	return
+}
 
-	defer body.Close()
-	content, err := ioutil.ReadAll(body)
-	if err != nil {
-		err = fmt.Errorf("failed to read logs from response: %v", err)
-		return
+// launchRClone starts an rclone container with a given command and binds
+func (r *RCloneEngine) launchRClone(cmd, binds, extraEnv []string) (state int, stdout string, err error) {
+	env := []string{
+		"AWS_ACCESS_KEY_ID=" + r.Handler.Config.AWS.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + r.Handler.Config.AWS.SecretAccessKey,
 	}
+	env = append(env, swiftEnv(r.Handler.Config)...)
+	env = append(env, extraEnv...)
 
-	stdout = string(content)
-	log.Debug(stdout)
-
+	state, stdout, stderr, err := LaunchContainer(r.Handler, r.Volume, r.Handler.Config.RClone.Image, cmd, binds, env)
+	stdout += stderr
 	return
 }
@@ -3,6 +3,11 @@ package engines
 import (
 	"net/url"
 	"testing"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/volume"
+	"github.com/docker/docker/api/types"
 )
 
 func TestFormatURL(t *testing.T) {
@@ -42,3 +47,38 @@ func checkURL(t *testing.T, uri, expected string, expectedEnv []string) {
 	}
 	return
 }
+
+func TestRCloneRestoreLatestOnly(t *testing.T) {
+	r := &RCloneEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{
+				DryRun: true,
+			},
+			Hostname: "host",
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name:       "foo",
+				Mountpoint: "/var/lib/docker/volumes/foo/_data",
+			},
+			Config: &volume.Config{
+				TargetURL: "s3://s3.amazonaws.com/backups",
+			},
+		},
+	}
+
+	for _, opts := range []RestoreOptions{
+		{Time: "3D"},
+		{Snapshot: "4bba301e"},
+	} {
+		if err := r.Restore(opts); err == nil {
+			t.Fatalf("Expected an error restoring %+v, got no error", opts)
+		}
+	}
+	if err := r.Restore(RestoreOptions{Snapshot: "latest"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := r.Verify(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
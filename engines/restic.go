@@ -1,31 +1,99 @@
 package engines
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/net/context"
-
 	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/conplicity/config"
 	"github.com/camptocamp/conplicity/handler"
 	"github.com/camptocamp/conplicity/metrics"
 	"github.com/camptocamp/conplicity/util"
 	"github.com/camptocamp/conplicity/volume"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
 )
 
+// Snapshot is a snapshot of a restic repository
+type Snapshot struct {
+	ID       string    `json:"id"`
+	ShortID  string    `json:"short_id"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Paths    []string  `json:"paths"`
+	Tags     []string  `json:"tags"`
+}
+
+// commentTagPrefix prefixes the tag storing a snapshot's comment.
+// Restic has no snapshot comments, so they are stored base64-encoded in a tag.
+const commentTagPrefix = "comment="
+
+// Comment returns the snapshot's comment, if any
+func (s Snapshot) Comment() string {
+	for _, t := range s.Tags {
+		if !strings.HasPrefix(t, commentTagPrefix) {
+			continue
+		}
+		comment, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(t, commentTagPrefix))
+		if err == nil {
+			return string(comment)
+		}
+	}
+	return ""
+}
+
+// commentArgs returns the restic backup arguments storing the comment
+func commentArgs(comment string) []string {
+	if comment == "" {
+		return nil
+	}
+	return []string{"--tag", commentTagPrefix + base64.RawURLEncoding.EncodeToString([]byte(comment))}
+}
+
 // ResticEngine implements a backup engine with Restic
 type ResticEngine struct {
 	Handler *handler.Conplicity
 	Volume  *volume.Volume
+
+	interruptions int
+	// paths are backed up together in a single snapshot
+	paths []string
+	// checkLevel is the level of the check run by verify
+	checkLevel string
 }
 
+// repositoryFilePath is where the repository file is mounted in restic containers
+const repositoryFilePath = "/run/conplicity/repository"
+
+// repositoryFileTarget identifies the repository read from the repository
+// file, without disclosing it
+const repositoryFileTarget = "restic-repository-file"
+
+// Levels of restic checks: a structural check reads the repository
+// metadata, a read-data check also reads and verifies all the data
+const (
+	checkStructure = "structure"
+	checkReadData  = "read-data"
+)
+
+// lastDeepCheckFile records the date of the last read-data check in the volume
+const lastDeepCheckFile = ".conplicity_last_deep_check"
+
+// lastNoCacheCheckFile records the date of the last check without cache in the volume
+const lastNoCacheCheckFile = ".conplicity_last_no_cache_check"
+
+// resticNetworkErrorRx matches restic failures caused by network interruptions.
+// Restic deduplicates data already uploaded, so retrying resumes the backup.
+var resticNetworkErrorRx = regexp.MustCompile("connection reset by peer|connection refused|i/o timeout|TLS handshake timeout|no such host|network is unreachable|unexpected EOF|broken pipe|Client.Timeout exceeded")
+
+// resticLockedRx matches restic failures caused by a lock on the repository
+var resticLockedRx = regexp.MustCompile(`repository is already locked`)
+
 // GetName returns the engine name
 func (*ResticEngine) GetName() string {
 	return "Restic"
@@ -36,30 +104,51 @@ func (r *ResticEngine) Backup() (err error) {
 
 	v := r.Volume
 
-	targetURL, err := url.Parse(v.Config.TargetURL)
+	err = r.setupTarget()
 	if err != nil {
-		err = fmt.Errorf("failed to parse target URL: %v", err)
 		return
 	}
 
-	v.Target = targetURL.String()
-	v.BackupDir = v.Mountpoint + "/" + v.BackupDir
-	v.Mount = v.Name + ":" + v.Mountpoint + ":ro"
+	r.paths, err = v.BackupPaths()
+	if err != nil {
+		return
+	}
 
-	err = util.Retry(3, r.init)
+	v.BackupDir = v.ContainerPath() + "/" + v.BackupDir
+	v.Mount = v.MountSource() + ":" + v.ContainerPath() + ":ro"
+
+	err = r.retry(r.init)
 	if err != nil {
 		err = fmt.Errorf("failed to create a secure bucket: %v", err)
 		return
 	}
 
-	err = util.Retry(3, r.resticBackup)
+	err = timeBackup(r.Handler, v, r.Handler.Config.Restic.Image, func() error {
+		return r.retry(r.resticBackup)
+	})
 	if err != nil {
 		err = fmt.Errorf("failed to backup the volume: %v", err)
 		return
 	}
 
-	if _, err := r.Handler.IsCheckScheduled(v); err == nil {
-		err = util.Retry(3, r.verify)
+	err = r.retention()
+	if err != nil {
+		err = fmt.Errorf("failed to remove old snapshots: %v", err)
+		return
+	}
+
+	if r.Handler.Config.DryRun {
+		v.Log().Debug("Dry run, not counting snapshots")
+	} else if _, err := r.Snapshots(); err != nil {
+		v.Log().Errorf("Failed to count snapshots: %v", err)
+	}
+
+	r.checkLevel, err = r.scheduledCheckLevel()
+	if err != nil {
+		return
+	}
+	if r.checkLevel != "" {
+		err = r.Verify()
 		if err != nil {
 			err = fmt.Errorf("failed to verify backup: %v", err)
 			return err
@@ -68,181 +157,1064 @@ func (r *ResticEngine) Backup() (err error) {
 	return
 }
 
-// init initialize a secure bucket
-func (r *ResticEngine) init() (err error) {
+// Restore restores a snapshot of the volume, the latest one by default,
+// to the target path in the restic container, where the volume is mounted
+// read-write. When includes are passed, only these paths are restored.
+func (r *ResticEngine) Restore(opts RestoreOptions) (err error) {
 	v := r.Volume
-	state, stdout, err := r.launchRestic(
+	snapshotID, target, includes := opts.Snapshot, opts.Target, opts.Include
+
+	if snapshotID == "" {
+		snapshotID = "latest"
+	}
+
+	err = r.setupTarget()
+	if err != nil {
+		return
+	}
+
+	includeArgs, err := restoreIncludeArgs(v.ContainerPath(), includes)
+	if err != nil {
+		return
+	}
+
+	cmd := []string{
+		"restore",
+		snapshotID,
+		"--target",
+		target,
+	}
+	cmd = append(cmd, includeArgs...)
+
+	state, _, _, err := r.launchRestic(
+		cmd,
 		[]string{
-			"-r",
-			v.Target,
-			"init",
+			v.MountSource() + ":" + v.ContainerPath(),
+		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Restic to restore the volume: %v", err)
+		return
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_restoreExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
 		},
+	)
+
+	if state != 0 {
+		err = fmt.Errorf("Restic exited with state %v while restoring the volume", state)
+	}
+	return
+}
+
+// retention removes the snapshots outside of the volume's retention policy
+// and prunes their data. It does nothing when no policy is set.
+func (r *ResticEngine) retention() (err error) {
+	v := r.Volume
+
+	cmd, err := r.forgetArgs("--prune")
+	if err != nil || len(cmd) == 0 {
+		return
+	}
+
+	state, _, _, err := r.launchRestic(
+		cmd,
 		[]string{
 			v.Mount,
 		},
 	)
-	if strings.Contains(stdout, "already initialized") {
-		err = nil
+	if err != nil {
+		err = fmt.Errorf("failed to launch Restic to forget snapshots: %v", err)
 		return
 	}
+
+	metric := r.Volume.MetricsHandler.NewMetric("conplicity_forgetExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+
+	if state != 0 {
+		err = fmt.Errorf("Restic exited with state %v while forgetting snapshots", state)
+	}
+	return
+}
+
+// PreviewRetention returns the snapshots forget would remove
+func (r *ResticEngine) PreviewRetention() (snapshots []string, err error) {
+	err = r.setupTarget()
 	if err != nil {
-		err = fmt.Errorf("failed to launch Restic to initialize the repository: %v", err)
+		return
+	}
+
+	// The same command as retention, so the preview matches it
+	cmd, err := r.forgetArgs("--dry-run", "--json")
+	if err != nil {
+		return
+	}
+	if len(cmd) == 0 {
+		err = ErrNoRetentionPolicy
+		return
+	}
+
+	state, stdout, stderr, err := r.launchRestic(cmd, []string{})
+	if err != nil {
+		err = fmt.Errorf("failed to launch Restic to preview forget: %v", err)
 		return
 	}
 	if state != 0 {
-		err = fmt.Errorf("Restic existed with state %v while initializing repository", state)
+		err = fmt.Errorf("Restic exited with state %v while previewing forget: %s", state, stderr)
 		return
 	}
+	snapshots, err = parseForgetRemovals(stdout)
 	return
 }
 
-// resticBackup performs the backup of a volume with Restic
-func (r *ResticEngine) resticBackup() (err error) {
+// parseForgetRemovals returns the snapshots to remove listed in the output of restic forget --json
+func parseForgetRemovals(stdout string) (snapshots []string, err error) {
+	var groups []struct {
+		Remove []Snapshot `json:"remove"`
+	}
+	i := strings.Index(stdout, "[")
+	if i < 0 {
+		err = fmt.Errorf("failed to find snapshot groups in restic output")
+		return
+	}
+	err = json.NewDecoder(strings.NewReader(stdout[i:])).Decode(&groups)
+	if err != nil {
+		err = fmt.Errorf("failed to decode snapshot groups: %v", err)
+		return
+	}
+	for _, g := range groups {
+		for _, s := range g.Remove {
+			snapshot := fmt.Sprintf("%s %s %s", s.ShortID, s.Time.Format(time.RFC3339), strings.Join(s.Paths, ","))
+			if c := s.Comment(); c != "" {
+				snapshot += fmt.Sprintf(" (%s)", c)
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return
+}
+
+// forgetArgs returns the restic forget command applying the volume's
+// retention policy, with the extra options. Only the snapshots of the
+// volume, and of this host, are considered, as volumes may share their
+// repository. No command is returned when no policy is set.
+func (r *ResticEngine) forgetArgs(extra ...string) (cmd []string, err error) {
+	v := r.Volume
+	keepArgs, err := forgetKeepArgs(v.Config)
+	if err != nil || len(keepArgs) == 0 {
+		return
+	}
+
+	cmd = append([]string{"forget"}, extra...)
+	cmd = append(cmd, "--tag", "volume:"+v.Name)
+	cmd = append(cmd, hostArgs(r.Handler.Hostname)...)
+	cmd = append(cmd, keepArgs...)
+	return
+}
+
+// hostArgs returns the restic option setting or filtering the snapshot
+// host. Restic would otherwise use the hostname of its container.
+func hostArgs(hostname string) []string {
+	if hostname == "" {
+		return nil
+	}
+	return []string{"--host", hostname}
+}
+
+// resticDurationRx matches restic durations, e.g. 1y6m15d12h
+var resticDurationRx = regexp.MustCompile(`^([0-9]+[ymdh])+$`)
+
+// forgetKeepArgs returns the restic forget arguments of the volume's
+// retention policy. No arguments are returned when no policy is set.
+func forgetKeepArgs(c *volume.Config) (args []string, err error) {
+	keeps := []struct {
+		flag  string
+		value string
+	}{
+		{"--keep-last", c.Restic.KeepLast},
+		{"--keep-daily", c.Restic.KeepDaily},
+		{"--keep-weekly", c.Restic.KeepWeekly},
+		{"--keep-monthly", c.Restic.KeepMonthly},
+	}
+	for _, k := range keeps {
+		if k.value == "" || k.value == "0" {
+			continue
+		}
+		if n, e := strconv.Atoi(k.value); e != nil || n < 0 {
+			err = fmt.Errorf("invalid %s value %s, expected a number of snapshots", k.flag, k.value)
+			return
+		}
+		args = append(args, k.flag, k.value)
+	}
+
+	if c.Restic.KeepWithin != "" {
+		if !resticDurationRx.MatchString(c.Restic.KeepWithin) {
+			err = fmt.Errorf("invalid keep-within duration %s, expected e.g. '30d' or '1y6m'", c.Restic.KeepWithin)
+			return
+		}
+		args = append(args, "--keep-within", c.Restic.KeepWithin)
+	}
+	return
+}
+
+// ForgetSnapshot removes a snapshot from the volume's repository
+// and prunes the data only it referenced
+func (r *ResticEngine) ForgetSnapshot(snapshotID string) (err error) {
+	v := r.Volume
+
+	err = r.setupTarget()
+	if err != nil {
+		return
+	}
+
+	v.Log().WithFields(log.Fields{
+		"snapshot": snapshotID,
+	}).Info("Forgetting snapshot")
+
+	state, _, _, err := r.launchRestic(
+		[]string{
+			"forget",
+			snapshotID,
+			"--prune",
+		},
+		[]string{},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch Restic to forget the snapshot: %v", err)
+		return
+	}
+	if state != 0 {
+		err = fmt.Errorf("Restic exited with state %v while forgetting the snapshot", state)
+	}
+	return
+}
+
+// restoreIncludeArgs returns the --include arguments for a partial restore,
+// making sure all paths are absolute paths within the volume
+func restoreIncludeArgs(root string, includes []string) (args []string, err error) {
+	for _, i := range includes {
+		p := path.Clean(i)
+		if !path.IsAbs(p) {
+			err = fmt.Errorf("restore path %s is not absolute", i)
+			return
+		}
+		if p != root && !strings.HasPrefix(p, root+"/") {
+			err = fmt.Errorf("restore path %s is not within the volume path %s", i, root)
+			return
+		}
+		args = append(args, "--include", p)
+	}
+	return
+}
+
+// setupTarget sets the volume target from the target URL
+func (r *ResticEngine) setupTarget() (err error) {
+	v := r.Volume
+	if r.Handler.Config.Restic.RepositoryFile != "" {
+		v.Target = repositoryFileTarget
+		return
+	}
+	targetURL, err := v.TargetURL()
+	if err != nil {
+		return
+	}
+	v.Target = targetURL.String()
+	return
+}
+
+// retry calls the restic operation op with the configured retries and backoff
+func (r *ResticEngine) retry(op func() error) error {
+	var delay time.Duration
+	if d := r.Handler.Config.Restic.RetryDelay; d != "" {
+		var err error
+		delay, err = time.ParseDuration(d)
+		if err != nil {
+			return fmt.Errorf("failed to parse the parameter 'restic-retry-delay': %v", err)
+		}
+	}
+	return util.RetryWithBackoff(r.Handler.Config.Restic.Retries, delay, op)
+}
+
+// init initialize a secure bucket
+func (r *ResticEngine) init() (err error) {
 	v := r.Volume
-	state, _, err := r.launchRestic(
+	if r.Handler.Config.Restic.Password == "" && r.Handler.Config.Restic.PasswordFile == "" {
+		// restic would wait for the password on its standard input
+		return &util.PermanentError{Err: fmt.Errorf("no restic password set, use RESTIC_PASSWORD or RESTIC_PASSWORD_FILE")}
+	}
+
+	state, stdout, stderr, err := r.launchRestic(
 		[]string{
-			"-r",
-			v.Target,
-			"backup",
-			v.BackupDir,
+			"init",
+			"--json",
 		},
 		[]string{
 			v.Mount,
 		},
 	)
+	if repositoryExists(stdout + stderr) {
+		err = r.logRepositoryID()
+		return
+	}
 	if err != nil {
-		err = fmt.Errorf("failed to launch Restic to backup the volume: %v", err)
+		err = fmt.Errorf("failed to launch Restic to initialize the repository: %v", err)
+		return
 	}
 	if state != 0 {
-		err = fmt.Errorf("Restic exited with state %v while backuping the volume", state)
+		err = fmt.Errorf("Restic exited with state %v while initializing repository%s", state, resticErrorSuffix(stdout+stderr))
+		return
+	}
+	err = r.logRepositoryID()
+	return
+}
+
+// logRepositoryID adds an info metric with the ID of the volume's repository,
+// so volumes can be grouped by physical repository. The ID is read once per
+// run and per target.
+func (r *ResticEngine) logRepositoryID() (err error) {
+	v := r.Volume
+	if r.Handler.Config.DryRun {
+		// No repository config to read
+		return
+	}
+
+	id, ok := r.Handler.RepositoryID(v.Target)
+	if !ok {
+		id, err = r.readRepositoryID()
+		if err != nil {
+			return
+		}
+		r.Handler.SetRepositoryID(v.Target, id)
 	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_repository", "gauge")
+	err = metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume":  v.Name,
+				"repo_id": id,
+			},
+			Value: "1",
+		},
+	)
 	return
 }
 
-// verify checks that the backup is usable
-func (r *ResticEngine) verify() (err error) {
+// readRepositoryID reads the repository ID from its config,
+// making sure it can be decrypted with the configured password
+func (r *ResticEngine) readRepositoryID() (id string, err error) {
 	v := r.Volume
-	state, _, err := r.launchRestic(
+	state, stdout, stderr, err := r.launchRestic(
 		[]string{
-			"-r",
-			v.Target,
-			"check",
+			"--no-lock",
+			"cat",
+			"config",
 		},
 		[]string{
 			v.Mount,
 		},
 	)
 	if err != nil {
-		err = fmt.Errorf("failed to launch Restic to check the backup: %v", err)
+		err = fmt.Errorf("failed to launch Restic to read the repository config: %v", err)
+		return
+	}
+	if strings.Contains(stdout+stderr, "wrong password or no key found") {
+		err = fmt.Errorf("repository %s is encrypted with a key that does not match the configured restic password", v.Target)
 		return
 	}
-	if state == 0 {
-		now := time.Now().Local()
-		os.Chtimes(v.Mountpoint+"/.conplicity_last_check", now, now)
-	} else {
-		err = fmt.Errorf("Restic exited with state %v while checking the backup", state)
+	if state != 0 {
+		err = fmt.Errorf("Restic exited with state %v while reading the repository config", state)
+		return
 	}
+	id, err = parseRepositoryID(stdout)
+	return
+}
 
-	metric := r.Volume.MetricsHandler.NewMetric("conplicity_verifyExitCode", "gauge")
+// Snapshots returns the snapshots of the volume in its repository.
+// It does not lock the repository, so it works on read-only repositories.
+func (r *ResticEngine) Snapshots() (snapshots []Snapshot, err error) {
+	err = r.setupTarget()
+	if err != nil {
+		return
+	}
+
+	state, stdout, stderr, err := r.launchRestic(snapshotsArgs(r.Volume), []string{})
+	if err != nil {
+		err = fmt.Errorf("failed to launch Restic to list snapshots: %v", err)
+		return
+	}
+	if state != 0 {
+		err = fmt.Errorf("Restic exited with state %v while listing snapshots: %s", state, stderr)
+		return
+	}
+	snapshots, err = parseSnapshots(stdout)
+	if err != nil {
+		return
+	}
+
+	metric := r.Volume.MetricsHandler.NewMetric("conplicity_snapshotsCount", "gauge")
 	err = metric.UpdateEvent(
 		&metrics.Event{
 			Labels: map[string]string{
-				"volume": v.Name,
+				"volume": r.Volume.Name,
 			},
-			Value: strconv.Itoa(state),
+			Value: strconv.Itoa(len(snapshots)),
 		},
 	)
 	return
 }
 
-// launchRestic starts a restic container with the given command and binds
-func (r *ResticEngine) launchRestic(cmd, binds []string) (state int, stdout string, err error) {
-	err = util.PullImage(r.Handler.Client, r.Handler.Config.Restic.Image)
+// snapshotsArgs returns the command listing the snapshots of the volume,
+// among the ones of all the volumes sharing the repository
+func snapshotsArgs(v *volume.Volume) []string {
+	return []string{
+		"--no-lock",
+		"snapshots",
+		"--json",
+		"--tag", "volume:" + v.Name,
+	}
+}
+
+// parseSnapshots decodes the output of restic snapshots --json
+func parseSnapshots(stdout string) (snapshots []Snapshot, err error) {
+	// Some restic versions output null for repositories without snapshots
+	if strings.TrimSpace(stdout) == "null" {
+		return
+	}
+	i := strings.Index(stdout, "[")
+	if i < 0 {
+		err = fmt.Errorf("failed to find snapshots in restic output")
+		return
+	}
+	err = json.NewDecoder(strings.NewReader(stdout[i:])).Decode(&snapshots)
+	if err != nil {
+		err = fmt.Errorf("failed to decode snapshots: %v", err)
+	}
+	return
+}
+
+// parseRepositoryID extracts the repository ID from the output of restic cat config
+func parseRepositoryID(stdout string) (id string, err error) {
+	var config struct {
+		ID string `json:"id"`
+	}
+	i := strings.Index(stdout, "{")
+	if i < 0 {
+		err = fmt.Errorf("failed to find repository config in restic output")
+		return
+	}
+	err = json.NewDecoder(strings.NewReader(stdout[i:])).Decode(&config)
 	if err != nil {
-		err = fmt.Errorf("failed to pull image: %v", err)
+		err = fmt.Errorf("failed to decode repository config: %v", err)
+		return
+	}
+	if config.ID == "" {
+		err = fmt.Errorf("failed to find ID in repository config")
 		return
 	}
+	id = config.ID
+	return
+}
 
-	env := []string{
-		"AWS_ACCESS_KEY_ID=" + r.Handler.Config.AWS.AccessKeyID,
-		"AWS_SECRET_ACCESS_KEY=" + r.Handler.Config.AWS.SecretAccessKey,
-		"OS_USERNAME=" + r.Handler.Config.Swift.Username,
-		"OS_PASSWORD=" + r.Handler.Config.Swift.Password,
-		"OS_AUTH_URL=" + r.Handler.Config.Swift.AuthURL,
-		"OS_TENANT_NAME=" + r.Handler.Config.Swift.TenantName,
-		"OS_REGION_NAME=" + r.Handler.Config.Swift.RegionName,
-		"RESTIC_PASSWORD=" + r.Handler.Config.Restic.Password,
-	}
-
-	log.WithFields(log.Fields{
-		"image":       r.Handler.Config.Restic.Image,
-		"command":     strings.Join(cmd, " "),
-		"environment": strings.Join(env, ", "),
-		"binds":       strings.Join(binds, ", "),
-	}).Debug("Creating container")
-
-	container, err := r.Handler.ContainerCreate(
-		context.Background(),
-		&container.Config{
-			Cmd:          cmd,
-			Env:          env,
-			Image:        r.Handler.Config.Restic.Image,
-			OpenStdin:    true,
-			StdinOnce:    true,
-			AttachStdin:  true,
-			AttachStdout: true,
-			AttachStderr: true,
-			Tty:          true,
+// resticBackup performs the backup of a volume with Restic
+func (r *ResticEngine) resticBackup() (err error) {
+	v := r.Volume
+	state, stdout, stderr, err := r.launchRestic(
+		r.backupArgs(),
+		[]string{
+			v.Mount,
 		},
-		&container.HostConfig{
-			Binds: binds,
-		}, nil, "",
 	)
 	if err != nil {
-		err = fmt.Errorf("failed to create container: %v", err)
+		err = fmt.Errorf("failed to launch Restic to backup the volume: %v", err)
+		return
+	}
+	for _, m := range parseResticMessages(stdout) {
+		if m.MessageType == "error" {
+			v.Log().WithFields(log.Fields{
+				"item": m.Item,
+			}).Warningf("Failed to back up file: %s", m.Error.Message)
+		}
+	}
+	if state != 0 {
+		err = fmt.Errorf("Restic exited with state %v while backuping the volume%s", state, resticErrorSuffix(stdout+stderr))
+		if hint := unsupportedOptionHint(stdout + stderr); hint != "" {
+			err = &util.PermanentError{Err: fmt.Errorf("%v (%s)", err, hint)}
+			return
+		}
+		if !resticNetworkErrorRx.MatchString(stdout + stderr) {
+			err = &util.PermanentError{Err: err}
+			return
+		}
+
+		r.interruptions++
+		v.Log().WithFields(log.Fields{
+			"interruptions": r.interruptions,
+		}).Warning("Backup interrupted by a network error")
+
+		metric := v.MetricsHandler.NewMetric("conplicity_backupInterruptions", "gauge")
+		metric.UpdateEvent(
+			&metrics.Event{
+				Labels: map[string]string{
+					"volume": v.Name,
+				},
+				Value: strconv.Itoa(r.interruptions),
+			},
+		)
+		return
+	}
+	if r.Handler.Config.DryRun {
+		return
+	}
+
+	added, processed, err := parseBackupSummary(stdout)
+	if err != nil {
+		// The backup itself succeeded
+		v.Log().Warnf("Failed to read backup sizes: %v", err)
+		return nil
+	}
+	for name, value := range map[string]uint64{
+		"conplicity_bytesAdded":     added,
+		"conplicity_bytesProcessed": processed,
+	} {
+		metric := v.MetricsHandler.NewMetric(name, "gauge")
+		metric.UpdateEvent(
+			&metrics.Event{
+				Labels: map[string]string{
+					"volume": v.Name,
+				},
+				Value: strconv.FormatUint(value, 10),
+			},
+		)
+	}
+	return
+}
+
+// backupAddedRx matches the size of the data added by a restic backup
+var backupAddedRx = regexp.MustCompile(`Added to the repo(?:sitory)?: ([\d.]+ [KMGT]?i?B)`)
+
+// backupProcessedRx matches the size of the data processed by a restic backup
+var backupProcessedRx = regexp.MustCompile(`processed \d+ files, ([\d.]+ [KMGT]?i?B) in`)
+
+// parseBackupSummary returns the sizes of the data added to the repository
+// and of the data processed by restic backup. It reads the JSON summary,
+// or the human-readable one of restic versions without JSON backup output.
+func parseBackupSummary(stdout string) (added, processed uint64, err error) {
+	for _, m := range parseResticMessages(stdout) {
+		if m.MessageType == "summary" {
+			return m.DataAdded, m.TotalBytesProcessed, nil
+		}
+	}
+
+	a := backupAddedRx.FindStringSubmatch(stdout)
+	p := backupProcessedRx.FindStringSubmatch(stdout)
+	if a == nil || p == nil {
+		err = fmt.Errorf("failed to find backup summary in restic output")
+		return
+	}
+	added, err = parseSize(a[1])
+	if err != nil {
+		return
+	}
+	processed, err = parseSize(p[1])
+	return
+}
+
+// resticMessage is a message printed by restic with --json.
+// Only the fields used by conplicity are decoded.
+type resticMessage struct {
+	MessageType string `json:"message_type"`
+
+	// exit_error messages
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+
+	// error messages of restic backup
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+	Item string `json:"item"`
+
+	// summary messages of restic backup
+	DataAdded           uint64 `json:"data_added"`
+	TotalBytesProcessed uint64 `json:"total_bytes_processed"`
+}
+
+// parseResticMessages decodes the JSON messages in the output of restic,
+// one per line, ignoring the lines which are not JSON messages
+func parseResticMessages(output string) (messages []resticMessage) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var m resticMessage
+		if json.Unmarshal([]byte(line), &m) == nil && m.MessageType != "" {
+			messages = append(messages, m)
+		}
+	}
+	return
+}
+
+// resticError returns the error reported by restic in its output: the
+// message of its exit_error JSON message, or its last line starting with
+// Fatal: for restic versions without JSON errors
+func resticError(output string) string {
+	for _, m := range parseResticMessages(output) {
+		if m.MessageType == "exit_error" {
+			return m.Message
+		}
+	}
+	lines := strings.Split(output, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); strings.HasPrefix(line, "Fatal: ") {
+			return strings.TrimPrefix(line, "Fatal: ")
+		}
+	}
+	return ""
+}
+
+// resticErrorSuffix formats the error reported by restic to end an error message
+func resticErrorSuffix(output string) string {
+	if e := resticError(output); e != "" {
+		return ": " + e
+	}
+	return ""
+}
+
+// repositoryExistsRx matches the errors of restic init on an existing
+// repository, depending on the restic version
+var repositoryExistsRx = regexp.MustCompile(`already initialized|config file already exists`)
+
+// repositoryExists tells whether restic init failed because the repository
+// already exists
+func repositoryExists(output string) bool {
+	if e := resticError(output); e != "" {
+		return repositoryExistsRx.MatchString(e)
+	}
+	return repositoryExistsRx.MatchString(output)
+}
+
+// sizeUnits are the multipliers of the size units used by restic
+var sizeUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// parseSize converts a size formatted by restic, e.g. 1.234 MiB, to bytes
+func parseSize(s string) (size uint64, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+	unit, ok := sizeUnits[fields[1]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in size %s", s)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s: %v", s, err)
+	}
+	return uint64(value * unit), nil
+}
+
+// backupArgs returns the restic backup command
+func (r *ResticEngine) backupArgs() (args []string) {
+	v := r.Volume
+
+	// --json outputs a summary with the backup sizes
+	args = []string{"backup", "--json"}
+	args = append(args, hostArgs(r.Handler.Hostname)...)
+	args = append(args, packSizeArgs(r.Handler.Config.Restic.PackSize)...)
+	for _, t := range backupTags(v) {
+		args = append(args, "--tag", t)
+	}
+	args = append(args, commentArgs(v.Config.Comment)...)
+
+	// Excludes are passed as arguments, as files written by conplicity
+	// are not on the host the Docker daemon mounts binds from
+	for _, e := range backupExcludes(v) {
+		args = append(args, "--exclude", e)
+	}
+
+	args = append(args, r.paths...)
+	return
+}
+
+// backupExcludes returns the volume's exclude patterns, one per line in its config
+func backupExcludes(v *volume.Volume) (excludes []string) {
+	for _, e := range strings.Split(v.Config.Excludes, "\n") {
+		if e = strings.TrimSpace(e); e != "" {
+			excludes = append(excludes, e)
+		}
+	}
+	return
+}
+
+// backupTags returns the tags of the volume's snapshots: the conplicity
+// and volume:<name> tags, followed by the volume's tags
+func backupTags(v *volume.Volume) []string {
+	tags := []string{"conplicity", "volume:" + v.Name}
+	for _, t := range strings.Split(v.Config.Tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// Verify checks that the volume's backups are usable. It runs after
+// scheduled backups, and can also be run on demand, without a backup,
+// in which case it checks the repository structure.
+// The check state file is only updated on success.
+func (r *ResticEngine) Verify() (err error) {
+	err = r.setupStandalone()
+	if err != nil {
+		return
+	}
+	if r.checkLevel == "" {
+		r.checkLevel = checkStructure
+	}
+	return r.retry(r.check)
+}
+
+// Init initializes the volume's repository without backing it up.
+// Repositories which already exist are left untouched.
+func (r *ResticEngine) Init() (err error) {
+	err = r.setupStandalone()
+	if err != nil {
+		return
+	}
+	return r.retry(r.init)
+}
+
+// setupStandalone sets up the volume's target and mount for operations
+// run outside of a backup, unless a backup already did
+func (r *ResticEngine) setupStandalone() (err error) {
+	v := r.Volume
+	if v.Target == "" {
+		err = r.setupTarget()
+		if err != nil {
+			return
+		}
+	}
+	if v.Mount == "" {
+		v.Mount = v.MountSource() + ":" + v.ContainerPath() + ":ro"
+	}
+	return
+}
+
+// check runs restic check on the volume's repository
+func (r *ResticEngine) check() (err error) {
+	v := r.Volume
+	cmd := append([]string{"check", "--json"}, checkDataArgs(r.checkLevel, r.Handler.Config.Restic.CheckReadDataPercent)...)
+
+	noCache, err := r.isNoCacheCheckScheduled()
+	if err != nil {
 		return
 	}
-	defer util.RemoveContainer(r.Handler.Client, container.ID)
+	if noCache {
+		// A cached check can pass while the backend is corrupted
+		v.Log().Info("Checking backup without cache")
+		cmd = append(cmd, "--no-cache")
+	}
 
-	log.Debugf("Launching 'restic %v'...", strings.Join(cmd, " "))
-	err = r.Handler.ContainerStart(context.Background(), container.ID, types.ContainerStartOptions{})
+	state, stdout, stderr, err := r.launchRestic(
+		cmd,
+		[]string{
+			v.Mount,
+		},
+	)
 	if err != nil {
-		err = fmt.Errorf("failed to start container: %v", err)
+		err = fmt.Errorf("failed to launch Restic to check the backup: %v", err)
 		return
 	}
-	var exited bool
+	metric := r.Volume.MetricsHandler.NewMetric("conplicity_verifyExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+				"level":  r.checkLevel,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
 
-	for !exited {
-		var cont types.ContainerJSON
-		cont, err = r.Handler.ContainerInspect(context.Background(), container.ID)
+	if state != 0 {
+		err = fmt.Errorf("Restic exited with state %v while checking the backup%s", state, resticErrorSuffix(stdout+stderr))
+		return
+	}
+
+	r.Handler.SetLastCheck(v)
+	if noCache {
+		r.Handler.TouchStateFile(v, lastNoCacheCheckFile)
+	}
+	if r.checkLevel == checkReadData {
+		r.Handler.TouchStateFile(v, lastDeepCheckFile)
+	}
+	return
+}
+
+// scheduledCheckLevel returns the deepest check due for the volume,
+// or an empty string if no check is due
+func (r *ResticEngine) scheduledCheckLevel() (level string, err error) {
+	v := r.Volume
+
+	if every := r.Handler.Config.Restic.DeepCheckEvery; every != "" && !v.Config.NoVerify {
+		var deep bool
+		deep, err = r.Handler.IsScheduled(v, lastDeepCheckFile, every)
 		if err != nil {
-			err = fmt.Errorf("failed to inspect container: %v", err)
+			err = fmt.Errorf("failed to parse the parameter 'restic-deep-check-every': %v", err)
 			return
 		}
-		if cont.State.Status == "exited" {
-			exited = true
-			state = cont.State.ExitCode
+		if deep {
+			return checkReadData, nil
 		}
 	}
 
-	body, err := r.Handler.ContainerLogs(context.Background(), container.ID, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Details:    true,
-		Follow:     true,
-	})
+	scheduled, err := r.Handler.IsCheckScheduled(v)
+	if err != nil || !scheduled {
+		return
+	}
+	return checkStructure, nil
+}
+
+// checkDataArgs returns the arguments of restic check reading the data
+// for the check level: all of it for read-data checks, otherwise the
+// given percentage of it, if any
+func checkDataArgs(level string, percent int) []string {
+	switch {
+	case level == checkReadData:
+		return []string{"--read-data"}
+	case percent > 0:
+		return []string{fmt.Sprintf("--read-data-subset=%d%%", percent)}
+	}
+	return nil
+}
+
+// isNoCacheCheckScheduled checks if the backup must be checked without cache
+func (r *ResticEngine) isNoCacheCheckScheduled() (bool, error) {
+	every := r.Handler.Config.Restic.CheckNoCacheEvery
+	if every == "" {
+		return false, nil
+	}
+	scheduled, err := r.Handler.IsScheduled(r.Volume, lastNoCacheCheckFile, every)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse the parameter 'restic-check-no-cache-every': %v", err)
+	}
+	return scheduled, nil
+}
+
+// launchRestic starts a restic container with the given command and binds,
+// on the volume's repository. When the repository is locked, stale locks
+// left by interrupted runs are removed and the command is run again once.
+func (r *ResticEngine) launchRestic(cmd, binds []string) (state int, stdout, stderr string, err error) {
+	state, stdout, stderr, err = r.runRestic(cmd, binds)
+	if err != nil || state == 0 || !resticLockedRx.MatchString(stdout+stderr) {
+		return
+	}
+
+	// restic unlock only removes stale locks, not the ones of running processes
+	r.Volume.Log().WithFields(log.Fields{
+		"command": cmd[0],
+	}).Warning("Repository is locked, removing stale locks left by interrupted runs")
+	unlockState, _, _, unlockErr := r.runRestic([]string{"unlock"}, nil)
+	if unlockErr != nil || unlockState != 0 {
+		r.Volume.Log().WithFields(log.Fields{
+			"state": unlockState,
+		}).Errorf("Failed to remove stale locks: %v", unlockErr)
+		return
+	}
+
+	state, stdout, stderr, err = r.runRestic(cmd, binds)
+	if err == nil && state != 0 && resticLockedRx.MatchString(stdout+stderr) {
+		r.Volume.Log().Error("Repository is still locked, another process is using it")
+	}
+	return
+}
+
+// resticEnv returns the environment of restic containers
+// with the credentials of the storage backends
+func resticEnv(c *config.Config) []string {
+	env := []string{
+		"AWS_ACCESS_KEY_ID=" + c.AWS.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + c.AWS.SecretAccessKey,
+		"B2_ACCOUNT_ID=" + c.B2.AccountID,
+		"B2_ACCOUNT_KEY=" + c.B2.AccountKey,
+		"AZURE_ACCOUNT_NAME=" + c.Azure.AccountName,
+		"AZURE_ACCOUNT_KEY=" + c.Azure.AccountKey,
+	}
+	env = append(env, swiftEnv(c)...)
+	// Older restic versions do not support compression
+	if c.Restic.Compression != "" {
+		env = append(env, "RESTIC_COMPRESSION="+c.Restic.Compression)
+	}
+	return env
+}
+
+// packSizeArgs returns the restic options setting the pack size in
+// MiB, if any, since older restic versions do not support --pack-size
+func packSizeArgs(size int) []string {
+	if size <= 0 {
+		return nil
+	}
+	return []string{"--pack-size", strconv.Itoa(size)}
+}
+
+// unsupportedOptionHint explains restic failures caused by the pack size or
+// compression options, which require recent restic versions and repositories
+func unsupportedOptionHint(output string) string {
+	switch {
+	case strings.Contains(output, "unknown flag: --pack-size"):
+		return "the restic image does not support RESTIC_PACK_SIZE, upgrade it or unset RESTIC_PACK_SIZE"
+	case strings.Contains(output, "compression requires at least repository format version 2"):
+		return "RESTIC_COMPRESSION requires a repository of format version 2, upgrade it with 'restic migrate upgrade_repo_v2' or unset RESTIC_COMPRESSION"
+	}
+	return ""
+}
+
+// runRestic starts a restic container with the given command and binds,
+// on the volume's repository
+func (r *ResticEngine) runRestic(cmd, binds []string) (state int, stdout, stderr string, err error) {
+	env := resticEnv(r.Handler.Config)
+
+	if cache := r.Handler.Config.Restic.CacheVolume; cache != "" {
+		// Docker creates the named volume if needed
+		binds = append(binds, cache+":"+resticCachePath)
+	}
+
+	passwordArgs, passwordBinds, passwordEnv := passwordArgs(r.Handler.Config)
+	env = append(env, passwordEnv...)
+	binds = append(binds, passwordBinds...)
+
+	gcsEnv, gcsBinds := gcsCredentials(r.Handler.Config)
+	env = append(env, gcsEnv...)
+	binds = append(binds, gcsBinds...)
+
+	rcloneEnv, rcloneBinds, err := rcloneConfig(r.Handler.Config, r.Volume.Target)
 	if err != nil {
-		err = fmt.Errorf("failed to retrieve logs: %v", err)
 		return
 	}
-	defer body.Close()
-	content, err := ioutil.ReadAll(body)
+	env = append(env, rcloneEnv...)
+	binds = append(binds, rcloneBinds...)
+
+	sftpArgs, sshBinds, err := sftpArgs(r.Handler.Config, r.Volume.Target)
 	if err != nil {
-		err = fmt.Errorf("failed to read logs from response: %v", err)
 		return
 	}
-	stdout = string(content)
-	log.Debug(stdout)
+	binds = append(binds, sshBinds...)
+
+	repo, repoBinds := r.repositoryArgs()
+	args := append(append(append(repo, passwordArgs...), sftpArgs...), cmd...)
+	return LaunchContainer(r.Handler, r.Volume, r.Handler.Config.Restic.Image, args, append(binds, repoBinds...), env)
+}
+
+// resticCachePath is the restic cache directory in restic containers
+const resticCachePath = "/root/.cache/restic"
+
+// passwordFilePath is where the repository password file is mounted in restic containers
+const passwordFilePath = "/run/conplicity/restic-password"
+
+// passwordArgs returns the restic arguments, binds and environment passing
+// the repository password. A password file is preferred, as environment
+// variables are visible when inspecting containers.
+func passwordArgs(c *config.Config) (args, binds, env []string) {
+	if f := c.Restic.PasswordFile; f != "" {
+		return []string{"--password-file", passwordFilePath}, []string{f + ":" + passwordFilePath + ":ro"}, nil
+	}
+	return nil, nil, []string{"RESTIC_PASSWORD=" + c.Restic.Password}
+}
+
+// gcsCredentialsPath is where the Google service account file is mounted in restic containers
+const gcsCredentialsPath = "/run/conplicity/gcs-credentials.json"
+
+// gcsCredentials returns the environment and binds giving restic access
+// to Google Cloud Storage. The service account file is mounted from the host.
+func gcsCredentials(c *config.Config) (env, binds []string) {
+	if c.GCS.ProjectID == "" && c.GCS.Credentials == "" {
+		return
+	}
 
+	env = []string{"GOOGLE_PROJECT_ID=" + c.GCS.ProjectID}
+	if f := c.GCS.Credentials; f != "" {
+		env = append(env, "GOOGLE_APPLICATION_CREDENTIALS="+gcsCredentialsPath)
+		binds = []string{f + ":" + gcsCredentialsPath + ":ro"}
+	}
 	return
 }
+
+// rcloneConfigPath is where the rclone config file is mounted in restic containers
+const rcloneConfigPath = "/run/conplicity/rclone.conf"
+
+// rcloneConfig returns the environment and binds giving restic access
+// to the rclone config file, for rclone: targets only
+func rcloneConfig(c *config.Config, target string) (env, binds []string, err error) {
+	if !strings.HasPrefix(target, "rclone:") {
+		return
+	}
+
+	f := c.RClone.ConfigPath
+	if f == "" {
+		err = fmt.Errorf("no rclone config file set for target %s, use RCLONE_CONFIG_PATH", target)
+		return
+	}
+	info, err := os.Stat(f)
+	if err != nil {
+		err = fmt.Errorf("failed to read rclone config file: %v", err)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		err = fmt.Errorf("rclone config file %s is not a regular file", f)
+		return
+	}
+
+	env = []string{"RCLONE_CONFIG=" + rcloneConfigPath}
+	binds = []string{f + ":" + rcloneConfigPath + ":ro"}
+	return
+}
+
+// sftpArgs returns the restic arguments and binds passing the SSH
+// options to the ssh command of sftp: targets
+func sftpArgs(c *config.Config, target string) (args, binds []string, err error) {
+	if !strings.HasPrefix(target, "sftp:") {
+		return
+	}
+	opts, binds := sshOptions(c)
+	if len(opts) == 0 {
+		return
+	}
+	cmd, err := sftpCommand(target, opts)
+	if err != nil {
+		return
+	}
+	args = []string{"-o", "sftp.command=" + cmd}
+	return
+}
+
+// repositoryArgs returns the restic arguments and binds selecting the volume's
+// repository. The repository file is a host path, it is only read from the
+// global configuration, never from volume labels.
+func (r *ResticEngine) repositoryArgs() (args, binds []string) {
+	f := r.Handler.Config.Restic.RepositoryFile
+	if f == "" {
+		return []string{"-r", r.Volume.Target}, nil
+	}
+	// Keep the repository out of the container's arguments
+	return []string{"--repository-file", repositoryFilePath}, []string{f + ":" + repositoryFilePath + ":ro"}
+}
@@ -0,0 +1,703 @@
+package engines
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/util"
+	"github.com/camptocamp/conplicity/volume"
+	"github.com/docker/docker/api/types"
+)
+
+func TestRestoreIncludeArgs(t *testing.T) {
+	root := "/var/lib/docker/volumes/foo/_data"
+
+	args, err := restoreIncludeArgs(root, []string{root + "/etc/", root + "/var/log/app.log"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := "--include " + root + "/etc --include " + root + "/var/log/app.log"
+	if got := strings.Join(args, " "); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+
+	if _, err := restoreIncludeArgs(root, []string{"etc"}); err == nil {
+		t.Fatal("Expected an error for a relative path, got no error")
+	}
+
+	if _, err := restoreIncludeArgs(root, []string{root + "/../bar"}); err == nil {
+		t.Fatal("Expected an error for a path outside the volume, got no error")
+	}
+
+	if _, err := restoreIncludeArgs(root, []string{root + "bar"}); err == nil {
+		t.Fatal("Expected an error for a sibling path, got no error")
+	}
+}
+
+func TestResticNetworkErrorRx(t *testing.T) {
+	interrupted := "Save(<data/1f2e3d>) returned error, retrying after 552ms: Put https://s3.amazonaws.com/foo: read tcp 10.0.0.2:44112->52.216.1.2:443: read: connection reset by peer"
+	if !resticNetworkErrorRx.MatchString(interrupted) {
+		t.Fatalf("Expected %s to be a network interruption", interrupted)
+	}
+
+	failed := "Fatal: unable to open config file: Stat: The specified key does not exist."
+	if resticNetworkErrorRx.MatchString(failed) {
+		t.Fatalf("Expected %s not to be a network interruption", failed)
+	}
+}
+
+func TestResticLockedRx(t *testing.T) {
+	locked := `unable to create lock in backend: repository is already locked by PID 42 on backup-host by root (UID 0, GID 0)
+lock was created at 2017-03-01 02:00:03 (26h3m12.5s ago)
+storage ID 8b5e0a2c
+the ` + "`unlock`" + ` command can be used to remove stale locks`
+	if !resticLockedRx.MatchString(locked) {
+		t.Fatalf("Expected %s to be a locked repository", locked)
+	}
+
+	failed := "Fatal: unable to open config file: Stat: The specified key does not exist."
+	if resticLockedRx.MatchString(failed) {
+		t.Fatalf("Expected %s not to be a locked repository", failed)
+	}
+}
+
+func TestParseRepositoryID(t *testing.T) {
+	stdout := `{
+  "version": 1,
+  "id": "a87ffd6e5c8b0b9b2a8e0c7d5d9fb3e58fd6dd97e6f1d63ae9ebc2a0d47e6a11",
+  "chunker_polynomial": "3dea92648f6e83"
+}
+`
+	id, err := parseRepositoryID(stdout)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := "a87ffd6e5c8b0b9b2a8e0c7d5d9fb3e58fd6dd97e6f1d63ae9ebc2a0d47e6a11"
+	if id != expected {
+		t.Fatalf("Expected %s, got %s", expected, id)
+	}
+
+	if _, err := parseRepositoryID("Fatal: unable to open config file"); err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+}
+
+func TestSnapshotsArgs(t *testing.T) {
+	v := &volume.Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+	}
+	if got, expected := strings.Join(snapshotsArgs(v), " "), "--no-lock snapshots --json --tag volume:foo"; got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestParseSnapshots(t *testing.T) {
+	stdout := `[{"time":"2017-03-20T14:05:12.128451736Z","tree":"b9a6b2c1","paths":["/data"],"hostname":"foo","username":"root","id":"40dc1520f8f2c5d36ad1d95ec8d6e2a3c5e4b7a1","short_id":"40dc1520"}]`
+
+	snapshots, err := parseSnapshots(stdout)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("Expected 1 snapshot, got %v", len(snapshots))
+	}
+	if snapshots[0].ShortID != "40dc1520" || snapshots[0].Paths[0] != "/data" {
+		t.Fatalf("Unexpected snapshot %+v", snapshots[0])
+	}
+
+	for _, empty := range []string{"[]\n", "null\n"} {
+		snapshots, err := parseSnapshots(empty)
+		if err != nil || len(snapshots) != 0 {
+			t.Fatalf("Expected no snapshot for %q, got %v, %v", empty, snapshots, err)
+		}
+	}
+
+	if _, err := parseSnapshots("Fatal: unable to open repository"); err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+}
+
+func TestForgetKeepArgs(t *testing.T) {
+	c := &volume.Config{}
+	args, err := forgetKeepArgs(c)
+	if err != nil || len(args) != 0 {
+		t.Fatalf("Expected no arguments and no error, got %v, %v", args, err)
+	}
+
+	c.Restic.KeepWithin = "1y6m15d"
+	args, err = forgetKeepArgs(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if strings.Join(args, " ") != "--keep-within 1y6m15d" {
+		t.Fatalf("Unexpected arguments %v", args)
+	}
+
+	c.Restic.KeepDaily = "7"
+	c.Restic.KeepMonthly = "12"
+	c.Restic.KeepWeekly = "0"
+	args, err = forgetKeepArgs(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if strings.Join(args, " ") != "--keep-daily 7 --keep-monthly 12 --keep-within 1y6m15d" {
+		t.Fatalf("Unexpected arguments %v", args)
+	}
+
+	for _, d := range []string{"30 days", "30", "d", "1w"} {
+		c := &volume.Config{}
+		c.Restic.KeepWithin = d
+		if _, err := forgetKeepArgs(c); err == nil {
+			t.Fatalf("Expected an error for keep-within %s, got no error", d)
+		}
+	}
+
+	for _, n := range []string{"-1", "seven"} {
+		c := &volume.Config{}
+		c.Restic.KeepLast = n
+		if _, err := forgetKeepArgs(c); err == nil {
+			t.Fatalf("Expected an error for keep-last %s, got no error", n)
+		}
+	}
+}
+
+func TestForgetArgs(t *testing.T) {
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config:   &config.Config{},
+			Hostname: "host",
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name: "foo",
+			},
+			Config: &volume.Config{},
+		},
+	}
+
+	cmd, err := r.forgetArgs("--prune")
+	if err != nil || len(cmd) != 0 {
+		t.Fatalf("Expected no command without policy, got %v, %v", cmd, err)
+	}
+
+	r.Volume.Config.Restic.KeepDaily = "7"
+	cmd, err = r.forgetArgs("--prune")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// Other volumes and hosts sharing the repository are left alone
+	expected := "forget --prune --tag volume:foo --host host --keep-daily 7"
+	if got := strings.Join(cmd, " "); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestRepositoryArgs(t *testing.T) {
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{},
+		},
+		Volume: &volume.Volume{
+			Target: "s3:s3.amazonaws.com/bucket/repo",
+			Config: &volume.Config{},
+		},
+	}
+
+	args, binds := r.repositoryArgs()
+	if len(args) != 2 || args[0] != "-r" || args[1] != "s3:s3.amazonaws.com/bucket/repo" || len(binds) != 0 {
+		t.Fatalf("Unexpected arguments %v and binds %v", args, binds)
+	}
+
+	r.Handler.Config.Restic.RepositoryFile = "/etc/conplicity/repo"
+	args, binds = r.repositoryArgs()
+	if len(args) != 2 || args[0] != "--repository-file" || args[1] != repositoryFilePath {
+		t.Fatalf("Unexpected arguments %v", args)
+	}
+	if len(binds) != 1 || binds[0] != "/etc/conplicity/repo:"+repositoryFilePath+":ro" {
+		t.Fatalf("Unexpected binds %v", binds)
+	}
+
+	// The volume is identified by a placeholder, not by the host path
+	r.Volume.Target = ""
+	if err := r.setupTarget(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if r.Volume.Target != repositoryFileTarget {
+		t.Fatalf("Expected target %s, got %s", repositoryFileTarget, r.Volume.Target)
+	}
+}
+
+func TestPreviewRetentionWithoutPolicy(t *testing.T) {
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{},
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name: "foo",
+			},
+			Config: &volume.Config{
+				TargetURL: "s3:s3.amazonaws.com/bucket/repo",
+			},
+		},
+	}
+
+	// Not a preview of zero removals, nothing is ever removed
+	snapshots, err := r.PreviewRetention()
+	if err != ErrNoRetentionPolicy || len(snapshots) != 0 {
+		t.Fatalf("Expected no retention policy, got %v and %v", snapshots, err)
+	}
+}
+
+func TestParseForgetRemovals(t *testing.T) {
+	stdout := `[{"tags":null,"host":"foo","paths":["/data"],"keep":[{"time":"2017-03-20T14:05:12Z","paths":["/data"],"id":"b2e1c7a0","short_id":"b2e1c7a0"}],"remove":[{"time":"2017-01-10T14:05:12Z","paths":["/data"],"id":"40dc1520","short_id":"40dc1520"}],"reasons":[]},{"host":"bar","paths":["/other"],"keep":[],"remove":null}]`
+
+	snapshots, err := parseForgetRemovals(stdout)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(snapshots) != 1 || snapshots[0] != "40dc1520 2017-01-10T14:05:12Z /data" {
+		t.Fatalf("Unexpected snapshots %v", snapshots)
+	}
+
+	if _, err := parseForgetRemovals("Fatal: unable to open repository"); err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+}
+
+func TestScheduledCheckLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		CheckEvery: "1h",
+	}
+	c.Restic.DeepCheckEvery = "720h"
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config: c,
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Mountpoint: dir,
+			},
+			Config: &volume.Config{},
+		},
+	}
+
+	// State files are created on first run, no check is due yet
+	if level, err := r.scheduledCheckLevel(); err != nil || level != "" {
+		t.Fatalf("Expected no check, got %s, %v", level, err)
+	}
+
+	h := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(dir+"/.conplicity_last_check", h, h)
+	if level, err := r.scheduledCheckLevel(); err != nil || level != checkStructure {
+		t.Fatalf("Expected %s check, got %s, %v", checkStructure, level, err)
+	}
+
+	h = time.Now().Add(-721 * time.Hour)
+	os.Chtimes(dir+"/"+lastDeepCheckFile, h, h)
+	if level, err := r.scheduledCheckLevel(); err != nil || level != checkReadData {
+		t.Fatalf("Expected %s check, got %s, %v", checkReadData, level, err)
+	}
+
+	r.Volume.Config.NoVerify = true
+	if level, err := r.scheduledCheckLevel(); err != nil || level != "" {
+		t.Fatalf("Expected no check with no_verify, got %s, %v", level, err)
+	}
+}
+
+func TestInitDryRun(t *testing.T) {
+	c := &config.Config{
+		DryRun: true,
+	}
+	c.Restic.Retries = 3
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config: c,
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name:       "foo",
+				Mountpoint: "/var/lib/docker/volumes/foo/_data",
+			},
+			Config: &volume.Config{
+				TargetURL: "s3:s3.amazonaws.com/backups",
+			},
+			MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+		},
+	}
+
+	if err := r.Init(); err == nil || !strings.Contains(err.Error(), "no restic password set") {
+		t.Fatalf("Expected a missing password error, got %v", err)
+	}
+
+	// A missing password is a permanent error, which is not retried
+	attempts := 0
+	err := r.retry(func() error {
+		attempts++
+		return r.init()
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("Expected a single failed attempt without password, got %d attempts, %v", attempts, err)
+	}
+
+	attempts = 0
+	err = r.retry(func() error {
+		attempts++
+		return fmt.Errorf("connection refused")
+	})
+	if err == nil || attempts != 3 {
+		t.Fatalf("Expected 3 failed attempts, got %d attempts, %v", attempts, err)
+	}
+
+	c.Restic.Password = "secret"
+	if err := r.Init(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if r.Volume.Target != "s3:s3.amazonaws.com/backups" {
+		t.Fatalf("Expected the target to be set up, got %s", r.Volume.Target)
+	}
+	if r.Volume.Mount == "" {
+		t.Fatal("Expected the volume mount to be set up")
+	}
+}
+
+func TestVerifyDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		DryRun: true,
+	}
+	c.Restic.Password = "secret"
+	c.Restic.Retries = 1
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config: c,
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name:       "foo",
+				Mountpoint: dir,
+			},
+			Config: &volume.Config{
+				TargetURL: "s3:s3.amazonaws.com/backups",
+			},
+			MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+		},
+	}
+
+	// No backup nor schedule is needed
+	if err := r.Verify(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if r.Volume.Target != "s3:s3.amazonaws.com/backups" {
+		t.Fatalf("Expected the target to be set up, got %s", r.Volume.Target)
+	}
+	event := r.Volume.MetricsHandler.Metrics["conplicity_verifyExitCode"].Events[0]
+	if event.Value != "0" || event.Labels["level"] != checkStructure {
+		t.Fatalf("Expected a successful structure check, got %+v", event)
+	}
+}
+
+func TestCheckDataArgs(t *testing.T) {
+	for _, tc := range []struct {
+		level    string
+		percent  int
+		expected string
+	}{
+		{checkStructure, 0, ""},
+		{checkStructure, 10, "--read-data-subset=10%"},
+		{checkReadData, 0, "--read-data"},
+		{checkReadData, 10, "--read-data"},
+	} {
+		if args := strings.Join(checkDataArgs(tc.level, tc.percent), " "); args != tc.expected {
+			t.Fatalf("Expected '%s' for a %s check of %d%%, got '%s'", tc.expected, tc.level, tc.percent, args)
+		}
+	}
+}
+
+func TestSnapshotComment(t *testing.T) {
+	args := commentArgs("before upgrade, v2")
+	if len(args) != 2 || args[0] != "--tag" || strings.Contains(args[1], ",") {
+		t.Fatalf("Unexpected arguments %v", args)
+	}
+
+	s := Snapshot{
+		Tags: []string{"foo", args[1]},
+	}
+	if c := s.Comment(); c != "before upgrade, v2" {
+		t.Fatalf("Expected 'before upgrade, v2', got '%s'", c)
+	}
+
+	if args := commentArgs(""); len(args) != 0 {
+		t.Fatalf("Expected no arguments, got %v", args)
+	}
+	if c := (Snapshot{Tags: []string{"foo"}}).Comment(); c != "" {
+		t.Fatalf("Expected no comment, got '%s'", c)
+	}
+}
+
+func TestGCSCredentials(t *testing.T) {
+	c := &config.Config{}
+	if env, binds := gcsCredentials(c); len(env) != 0 || len(binds) != 0 {
+		t.Fatalf("Expected nothing without GCS config, got %v, %v", env, binds)
+	}
+
+	c.GCS.ProjectID = "foo"
+	c.GCS.Credentials = "/etc/gcs.json"
+	env, binds := gcsCredentials(c)
+	if strings.Join(env, " ") != "GOOGLE_PROJECT_ID=foo GOOGLE_APPLICATION_CREDENTIALS="+gcsCredentialsPath {
+		t.Fatalf("Unexpected environment %v", env)
+	}
+	if len(binds) != 1 || binds[0] != "/etc/gcs.json:"+gcsCredentialsPath+":ro" {
+		t.Fatalf("Unexpected binds %v", binds)
+	}
+}
+
+func TestRCloneConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "conplicity-rclone")
+	if err != nil {
+		t.Fatalf("Failed to create rclone config file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	c := &config.Config{}
+	c.RClone.ConfigPath = f.Name()
+
+	env, binds, err := rcloneConfig(c, "rclone:onedrive:backups")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(env) != 1 || env[0] != "RCLONE_CONFIG="+rcloneConfigPath {
+		t.Fatalf("Expected RCLONE_CONFIG in the environment, got %v", env)
+	}
+	if len(binds) != 1 || binds[0] != f.Name()+":"+rcloneConfigPath+":ro" {
+		t.Fatalf("Expected a read-only bind of the config file, got %v", binds)
+	}
+
+	// Other targets do not need the config file
+	if env, binds, err := rcloneConfig(c, "s3:s3.amazonaws.com/backups"); err != nil || len(env) != 0 || len(binds) != 0 {
+		t.Fatalf("Expected nothing for S3 targets, got %v, %v, %v", env, binds, err)
+	}
+
+	for _, path := range []string{"", os.TempDir(), f.Name() + ".missing"} {
+		c.RClone.ConfigPath = path
+		if _, _, err := rcloneConfig(c, "rclone:onedrive:backups"); err == nil {
+			t.Fatalf("Expected an error for config file %q, got no error", path)
+		}
+	}
+}
+
+func TestSftpArgs(t *testing.T) {
+	c := &config.Config{}
+	if args, binds, err := sftpArgs(c, "sftp:backup@example.com:/srv/restic"); err != nil || len(args) != 0 || len(binds) != 0 {
+		t.Fatalf("Expected restic's own ssh command without SSH options, got %v, %v, %v", args, binds, err)
+	}
+
+	c.SSH.PrivateKeyPath = "/etc/conplicity/id_ed25519"
+	args, binds, err := sftpArgs(c, "sftp:backup@example.com:/srv/restic")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got, expected := strings.Join(args, " "), "-o sftp.command=ssh -oIdentityFile="+sshKeyPath+" backup@example.com -s sftp"; got != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, got)
+	}
+	if len(binds) != 1 {
+		t.Fatalf("Expected a bind of the private key, got %v", binds)
+	}
+
+	// Other targets do not use ssh
+	if args, binds, err := sftpArgs(c, "s3:s3.amazonaws.com/backups"); err != nil || len(args) != 0 || len(binds) != 0 {
+		t.Fatalf("Expected nothing for S3 targets, got %v, %v, %v", args, binds, err)
+	}
+}
+
+func TestPasswordArgs(t *testing.T) {
+	c := &config.Config{}
+	c.Restic.Password = "foo"
+	args, binds, env := passwordArgs(c)
+	if len(args) != 0 || len(binds) != 0 || len(env) != 1 || env[0] != "RESTIC_PASSWORD=foo" {
+		t.Fatalf("Unexpected arguments %v, binds %v and environment %v", args, binds, env)
+	}
+
+	c.Restic.PasswordFile = "/etc/restic/password"
+	args, binds, env = passwordArgs(c)
+	if len(env) != 0 {
+		t.Fatalf("Expected no password in environment, got %v", env)
+	}
+	if strings.Join(args, " ") != "--password-file "+passwordFilePath {
+		t.Fatalf("Unexpected arguments %v", args)
+	}
+	if len(binds) != 1 || binds[0] != "/etc/restic/password:"+passwordFilePath+":ro" {
+		t.Fatalf("Unexpected binds %v", binds)
+	}
+}
+
+func TestInitWithoutPassword(t *testing.T) {
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{},
+		},
+		Volume: &volume.Volume{
+			Config: &volume.Config{},
+		},
+	}
+	err := r.init()
+	if _, ok := err.(*util.PermanentError); !ok {
+		t.Fatalf("Expected a permanent error, got %v", err)
+	}
+}
+
+func TestBackupArgs(t *testing.T) {
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{},
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name: "foo",
+			},
+			Config: &volume.Config{
+				Tags:     "db, prod,",
+				Excludes: "*.log\n\n cache/ \n",
+			},
+		},
+		paths: []string{"/var/lib/docker/volumes/foo/_data"},
+	}
+
+	args := r.backupArgs()
+	expected := "backup --json --tag conplicity --tag volume:foo --tag db --tag prod --exclude *.log --exclude cache/ /var/lib/docker/volumes/foo/_data"
+	if got := strings.Join(args, " "); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+
+	r.Handler.Config.Restic.PackSize = 64
+	r.Handler.Hostname = "host"
+	args = r.backupArgs()
+	if got := strings.Join(args[:6], " "); got != "backup --json --host host --pack-size 64" {
+		t.Fatalf("Expected the host and pack size options, got %v", args)
+	}
+}
+
+func TestUnsupportedOptionHint(t *testing.T) {
+	for output, expected := range map[string]string{
+		"unknown flag: --pack-size\n":                                                     "RESTIC_PACK_SIZE",
+		"Fatal: compression requires at least repository format version 2\n":              "RESTIC_COMPRESSION",
+		"Fatal: unable to open config file: Stat: connection refused\n":                   "",
+		`{"message_type":"exit_error","code":1,"message":"Fatal: wrong password"}` + "\n": "",
+	} {
+		if hint := unsupportedOptionHint(output); !strings.Contains(hint, expected) || (expected == "") != (hint == "") {
+			t.Fatalf("Expected a hint about %q for %q, got %q", expected, output, hint)
+		}
+	}
+}
+
+func TestBackupArgsManyExcludes(t *testing.T) {
+	var excludes []string
+	for i := 0; i < 50; i++ {
+		excludes = append(excludes, fmt.Sprintf("dir%d", i))
+	}
+	r := &ResticEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{},
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name: "foo",
+			},
+			Config: &volume.Config{
+				Excludes: strings.Join(excludes, "\n"),
+			},
+		},
+		paths: []string{"/data"},
+	}
+
+	args := r.backupArgs()
+	if got := strings.Join(args[len(args)-3:], " "); got != "--exclude dir49 /data" {
+		t.Fatalf("Expected excludes before the backup path, got %v", args)
+	}
+	if got := strings.Count(strings.Join(args, " "), "--exclude "); got != len(excludes) {
+		t.Fatalf("Expected %d excludes, got %d", len(excludes), got)
+	}
+}
+
+func TestResticError(t *testing.T) {
+	for _, tc := range []struct {
+		output, expected string
+		exists           bool
+	}{
+		// Captured from restic init --json with restic 0.17
+		{`{"message_type":"exit_error","code":1,"message":"Fatal: create repository at /srv/restic failed: config file already exists"}`, "Fatal: create repository at /srv/restic failed: config file already exists", true},
+		// Captured from restic init with older versions
+		{"Fatal: create key in backend at s3:s3.amazonaws.com/bucket failed: repository master key and config already initialized\n", "create key in backend at s3:s3.amazonaws.com/bucket failed: repository master key and config already initialized", true},
+		{`{"message_type":"initialized","id":"5c4fa2c0","repository":"/srv/restic"}`, "", false},
+		{`{"message_type":"exit_error","code":12,"message":"Fatal: wrong password or no key found"}`, "Fatal: wrong password or no key found", false},
+		{"Fatal: unable to open config file: Stat: connection refused\nIs there a repository at the following location?\n", "unable to open config file: Stat: connection refused", false},
+		{"", "", false},
+	} {
+		if e := resticError(tc.output); e != tc.expected {
+			t.Fatalf("Expected error '%s' in %q, got '%s'", tc.expected, tc.output, e)
+		}
+		if exists := repositoryExists(tc.output); exists != tc.exists {
+			t.Fatalf("Expected repository existence %v in %q, got %v", tc.exists, tc.output, exists)
+		}
+	}
+
+	if s := resticErrorSuffix("Fatal: no such file"); s != ": no such file" {
+		t.Fatalf("Expected ': no such file', got '%s'", s)
+	}
+}
+
+func TestParseBackupSummary(t *testing.T) {
+	// Captured from restic backup --json
+	stdout := `{"message_type":"status","percent_done":0.5,"total_files":5,"files_done":2,"total_bytes":1258291,"bytes_done":629145}
+{"message_type":"summary","files_new":5,"files_changed":0,"files_unmodified":0,"dirs_new":2,"dirs_changed":0,"dirs_unmodified":0,"data_blobs":5,"tree_blobs":3,"data_added":1293942,"total_files_processed":5,"total_bytes_processed":1258291,"total_duration":1.2,"snapshot_id":"40dc1520"}
+`
+	added, processed, err := parseBackupSummary(stdout)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if added != 1293942 || processed != 1258291 {
+		t.Fatalf("Expected 1293942 bytes added and 1258291 processed, got %d and %d", added, processed)
+	}
+
+	// Captured from a restic version without JSON backup output
+	stdout = `using parent snapshot 3d2f1c6e
+Files:           5 new,     0 changed,     0 unmodified
+Dirs:            2 new,     0 changed,     0 unmodified
+Added to the repo: 1.234 MiB
+
+processed 5 files, 1.200 MiB in 0:01
+snapshot 40dc1520 saved
+`
+	added, processed, err = parseBackupSummary(stdout)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if added != 1293942 || processed != 1258291 {
+		t.Fatalf("Expected 1293942 bytes added and 1258291 processed, got %d and %d", added, processed)
+	}
+
+	if _, _, err = parseBackupSummary("snapshot 40dc1520 saved\n"); err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+}
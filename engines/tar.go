@@ -0,0 +1,284 @@
+package engines
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/volume"
+)
+
+// TarEngine implements a backup engine writing gzipped tar archives
+// to a host directory, for simple setups without a backup tool
+type TarEngine struct {
+	Handler *handler.Conplicity
+	Volume  *volume.Volume
+}
+
+// tarTargetPath is where the target directory is mounted in tar containers
+const tarTargetPath = "/run/conplicity/target"
+
+// tarArchiveTimeFormat is the format of the timestamp of archive names.
+// Archive names sort by date.
+const tarArchiveTimeFormat = "20060102T150405Z"
+
+// GetName returns the engine name
+func (*TarEngine) GetName() string {
+	return "Tar"
+}
+
+// Backup archives the volume to a new archive in the target directory
+func (t *TarEngine) Backup() (err error) {
+	v := t.Volume
+
+	err = t.setupTarget()
+	if err != nil {
+		return
+	}
+
+	paths, err := v.BackupPaths()
+	if err != nil {
+		return
+	}
+	v.Mount = v.MountSource() + ":" + v.ContainerPath() + ":ro"
+
+	archive := t.archivePath(time.Now())
+	err = timeBackup(t.Handler, v, t.Handler.Config.Tar.Image, func() error {
+		return t.create(archive, paths)
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to backup the volume: %v", err)
+		return
+	}
+
+	scheduled, err := t.Handler.IsCheckScheduled(v)
+	if err != nil {
+		return
+	}
+	if scheduled {
+		err = t.check("", shellQuote(archive))
+		if err != nil {
+			err = fmt.Errorf("failed to verify backup: %v", err)
+		}
+	}
+	return
+}
+
+// Verify checks that the latest archive of the volume can be read
+func (t *TarEngine) Verify() (err error) {
+	err = t.setupTarget()
+	if err != nil {
+		return
+	}
+	return t.check(t.latestArchive())
+}
+
+// Restore extracts an archive of the volume, the latest one by default,
+// to the volume. Files which are not in the archive are kept.
+func (t *TarEngine) Restore(opts RestoreOptions) (err error) {
+	v := t.Volume
+
+	err = t.setupTarget()
+	if err != nil {
+		return
+	}
+
+	setup, archive := t.latestArchive()
+	if s := opts.Snapshot; s != "" && s != "latest" {
+		if strings.Contains(s, "/") {
+			return fmt.Errorf("invalid archive %s, expected an archive name", s)
+		}
+		setup, archive = "", shellQuote(t.archiveDir()+"/"+s)
+	}
+
+	script := setup + fmt.Sprintf("tar xzf %s -C %s", archive, shellQuote(v.ContainerPath()))
+	state, _, stderr, err := t.launchTar(
+		script,
+		[]string{
+			v.MountSource() + ":" + v.ContainerPath(),
+		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch tar to restore the volume: %v", err)
+		return
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_restoreExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+
+	if state != 0 {
+		err = fmt.Errorf("tar exited with state %v while restoring the volume: %s", state, strings.TrimSpace(stderr))
+	}
+	return
+}
+
+// setupTarget sets the volume target to the host directory of the target URL
+func (t *TarEngine) setupTarget() (err error) {
+	v := t.Volume
+	targetURL, err := v.TargetURL()
+	if err != nil {
+		return
+	}
+	if targetURL.Scheme != "file" || targetURL.Path == "" {
+		return fmt.Errorf("invalid tar target %s, expected file:///path", v.Config.TargetURL)
+	}
+	v.Target = targetURL.Path
+	return
+}
+
+// archiveDir returns the directory of the volume's archives in tar containers
+func (t *TarEngine) archiveDir() string {
+	return tarTargetPath + "/" + t.Handler.Hostname + "/" + t.Volume.Name
+}
+
+// archivePath returns the path of a new archive of the volume in tar containers
+func (t *TarEngine) archivePath(now time.Time) string {
+	return t.archiveDir() + "/" + t.Volume.Name + "-" + now.UTC().Format(tarArchiveTimeFormat) + ".tar.gz"
+}
+
+// latestArchive returns a shell script setting $archive to the path of the
+// latest archive, which fails when there is none, and the expression of the path
+func (t *TarEngine) latestArchive() (setup, archive string) {
+	dir := shellQuote(t.archiveDir())
+	setup = fmt.Sprintf(`archive="$(ls -1 %[1]s/*.tar.gz 2>/dev/null | tail -n 1)"; if [ -z "$archive" ]; then echo no archive found in %[1]s >&2; exit 1; fi; `, dir)
+	return setup, `"$archive"`
+}
+
+// create writes the archive of the paths of the volume and records its size.
+// The archive is written under a temporary name, so that incomplete
+// archives are never taken for the latest one.
+func (t *TarEngine) create(archive string, paths []string) (err error) {
+	v := t.Volume
+	v.Log().WithFields(log.Fields{
+		"target":  v.Target,
+		"archive": path.Base(archive),
+	}).Info("Starting volume backup")
+
+	var members []string
+	for _, p := range paths {
+		m := strings.Trim(strings.TrimPrefix(p, v.ContainerPath()), "/")
+		if m == "" {
+			m = "."
+		}
+		members = append(members, shellQuote(m))
+	}
+
+	script := fmt.Sprintf(
+		"mkdir -p %[1]s && tar czf %[2]s.part -C %[3]s %[4]s && mv %[2]s.part %[2]s && stat -c %%s %[2]s",
+		shellQuote(path.Dir(archive)),
+		shellQuote(archive),
+		shellQuote(v.ContainerPath()),
+		strings.Join(members, " "),
+	)
+	state, stdout, stderr, err := t.launchTar(
+		script,
+		[]string{
+			v.Mount,
+		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch tar to backup the volume: %v", err)
+		return
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_backupExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+
+	if state != 0 {
+		err = fmt.Errorf("tar exited with state %v while backuping the volume: %s", state, strings.TrimSpace(stderr))
+		return
+	}
+	if t.Handler.Config.DryRun {
+		return
+	}
+
+	size, err := parseArchiveSize(stdout)
+	if err != nil {
+		// The backup itself succeeded
+		v.Log().Warnf("Failed to read archive size: %v", err)
+		return nil
+	}
+	metric = v.MetricsHandler.NewMetric("conplicity_bytesAdded", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.FormatUint(size, 10),
+		},
+	)
+	return
+}
+
+// check lists the content of the archive, the shell expression of its path
+// run after the setup script, to make sure it can be read
+func (t *TarEngine) check(setup, archive string) (err error) {
+	v := t.Volume
+	state, _, stderr, err := t.launchTar(
+		setup+fmt.Sprintf("tar tzf %s > /dev/null", archive),
+		[]string{},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to launch tar to check the archive: %v", err)
+		return
+	}
+
+	if state == 0 {
+		t.Handler.SetLastCheck(v)
+	} else {
+		err = fmt.Errorf("tar exited with state %v while checking the archive: %s", state, strings.TrimSpace(stderr))
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_verifyExitCode", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: strconv.Itoa(state),
+		},
+	)
+	return
+}
+
+// parseArchiveSize reads the archive size printed last by the backup script
+func parseArchiveSize(stdout string) (size uint64, err error) {
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	size, err = strconv.ParseUint(last, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("failed to find the archive size in %q", last)
+	}
+	return
+}
+
+// shellQuote quotes s for sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// launchTar runs a shell script in a tar container with the target
+// directory mounted, and the given binds
+func (t *TarEngine) launchTar(script string, binds []string) (state int, stdout, stderr string, err error) {
+	binds = append(binds, t.Volume.Target+":"+tarTargetPath)
+	return LaunchContainer(t.Handler, t.Volume, t.Handler.Config.Tar.Image, []string{"sh", "-c", script}, binds, nil)
+}
@@ -0,0 +1,101 @@
+package engines
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/handler"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/volume"
+	"github.com/docker/docker/api/types"
+)
+
+// fakeTarEngine returns a tar engine running in dry run
+func fakeTarEngine(target string) *TarEngine {
+	return &TarEngine{
+		Handler: &handler.Conplicity{
+			Config: &config.Config{
+				DryRun: true,
+			},
+			Hostname: "host",
+		},
+		Volume: &volume.Volume{
+			Volume: &types.Volume{
+				Name:       "foo",
+				Mountpoint: "/var/lib/docker/volumes/foo/_data",
+			},
+			Config: &volume.Config{
+				TargetURL: target,
+				NoVerify:  true,
+			},
+			MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+		},
+	}
+}
+
+func TestTarBackupDryRun(t *testing.T) {
+	e := fakeTarEngine("file:///srv/backups")
+	if err := e.Backup(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if e.Volume.Target != "/srv/backups" {
+		t.Fatalf("Expected target /srv/backups, got %s", e.Volume.Target)
+	}
+	for _, name := range []string{"conplicity_backupExitCode", "conplicity_backupDuration"} {
+		if _, ok := e.Volume.MetricsHandler.Metrics[name]; !ok {
+			t.Fatalf("Expected metric %s", name)
+		}
+	}
+	if err := e.Verify(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := e.Restore(RestoreOptions{Snapshot: "../bar.tar.gz"}); err == nil {
+		t.Fatal("Expected an error restoring an archive outside of the volume's directory, got no error")
+	}
+
+	e = fakeTarEngine("s3://s3.amazonaws.com/backups")
+	if err := e.Backup(); err == nil {
+		t.Fatal("Expected an error backing up to S3, got no error")
+	}
+}
+
+func TestTarArchivePath(t *testing.T) {
+	e := fakeTarEngine("file:///srv/backups")
+	d := time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)
+	if got, expected := e.archivePath(d), tarTargetPath+"/host/foo/foo-20170301T020000Z.tar.gz"; got != expected {
+		t.Fatalf("Expected archive %s, got %s", expected, got)
+	}
+}
+
+func TestParseArchiveSize(t *testing.T) {
+	size, err := parseArchiveSize("tar: removing leading '/'\r\n1048576\r\n")
+	if err != nil || size != 1048576 {
+		t.Fatalf("Expected size 1048576, got %v, %v", size, err)
+	}
+	if _, err := parseArchiveSize(""); err == nil {
+		t.Fatal("Expected an error without size, got no error")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, expected := shellQuote("it's"), `'it'\''s'`; got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestTarLatestArchive(t *testing.T) {
+	e := fakeTarEngine("file:///srv/backups")
+	setup, archive := e.latestArchive()
+	if archive != `"$archive"` {
+		t.Fatalf("Expected the archive variable, got %s", archive)
+	}
+
+	// The target directory is not mounted in tests, so it has no archive
+	out, err := exec.Command("sh", "-c", setup+"echo "+archive).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "no archive found in") {
+		t.Fatalf("Expected a missing archive error, got %v: %s", err, out)
+	}
+}
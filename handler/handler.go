@@ -1,12 +1,22 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode/utf8"
 
@@ -14,18 +24,41 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/metrics"
 	"github.com/camptocamp/conplicity/util"
 	"github.com/camptocamp/conplicity/volume"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
+	volumetypes "github.com/docker/docker/api/types/volume"
 	docker "github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
 )
 
+// lastCheckFile records the date of the last successful verification in the
+// volume, or of its repository in the state directory, suffixed with the hash
+// of the repository's target
+const lastCheckFile = ".conplicity_last_check"
+
 // Conplicity is the main handler struct
 type Conplicity struct {
 	*docker.Client
 	Config   *config.Config
 	Hostname string
+
+	checkedTargets map[string]bool
+	checkedMutex   sync.Mutex
+
+	stateDir     string
+	stateDirOnce sync.Once
+
+	pulledImages map[string]*imagePull
+	pulledMutex  sync.Mutex
+
+	repositoryIDs map[string]string
+	repositoryMu  sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewConplicity returns a new Conplicity handler
@@ -42,6 +75,18 @@ func (c *Conplicity) Setup(version string) (err error) {
 	err = c.setupLoglevel()
 	util.CheckErr(err, "Failed to setup log level: %v", "fatal")
 
+	err = c.Config.LoadSecrets()
+	util.CheckErr(err, "Failed to load secrets: %v", "fatal")
+
+	err = c.Config.Validate()
+	util.CheckErr(err, "%v", "fatal")
+
+	for _, image := range c.Config.UnpinnedImages() {
+		log.WithFields(log.Fields{
+			"image": image,
+		}).Warning("Image is not pinned to a tag or digest, backups are not reproducible")
+	}
+
 	err = c.GetHostname()
 	util.CheckErr(err, "Failed to get hostname: %v", "fatal")
 
@@ -51,6 +96,122 @@ func (c *Conplicity) Setup(version string) (err error) {
 	return
 }
 
+// ResetRun forgets the state of the previous backup run, so that shared
+// targets are checked again, images are pulled again and repository IDs
+// are read again
+func (c *Conplicity) ResetRun() {
+	c.checkedMutex.Lock()
+	defer c.checkedMutex.Unlock()
+	c.checkedTargets = nil
+
+	c.pulledMutex.Lock()
+	defer c.pulledMutex.Unlock()
+	c.pulledImages = nil
+
+	c.repositoryMu.Lock()
+	defer c.repositoryMu.Unlock()
+	c.repositoryIDs = nil
+}
+
+// RepositoryID returns the ID of the repository at target read during this
+// run, if any
+func (c *Conplicity) RepositoryID(target string) (id string, ok bool) {
+	c.repositoryMu.Lock()
+	defer c.repositoryMu.Unlock()
+	id, ok = c.repositoryIDs[target]
+	return
+}
+
+// SetRepositoryID records the ID of the repository at target for this run
+func (c *Conplicity) SetRepositoryID(target, id string) {
+	c.repositoryMu.Lock()
+	defer c.repositoryMu.Unlock()
+	if c.repositoryIDs == nil {
+		c.repositoryIDs = make(map[string]string)
+	}
+	c.repositoryIDs[target] = id
+}
+
+// imagePull is the pull of an image, shared by the containers of a run
+type imagePull struct {
+	once   sync.Once
+	digest string
+	err    error
+}
+
+// pullImage pulls an image, it is replaced in tests
+var pullImage = util.PullImage
+
+// PullImage pulls an image and returns its digest. Each image is pulled
+// at most once per run, even by concurrent backups; failed pulls are
+// attempted again by the next container.
+func (c *Conplicity) PullImage(image string) (digest string, err error) {
+	c.pulledMutex.Lock()
+	if c.pulledImages == nil {
+		c.pulledImages = make(map[string]*imagePull)
+	}
+	p, ok := c.pulledImages[image]
+	if !ok {
+		p = &imagePull{}
+		c.pulledImages[image] = p
+	}
+	c.pulledMutex.Unlock()
+
+	p.once.Do(func() {
+		r := c.Config.Registry
+		auth, err := util.RegistryAuth(r.Username, r.Password, r.Host, r.ConfigPath, image)
+		if err != nil {
+			p.err = err
+			return
+		}
+		p.digest, p.err = pullImage(c.Context(), c.Client, image, c.Config.Docker.ForcePull, auth)
+	})
+
+	if p.err != nil {
+		c.pulledMutex.Lock()
+		if c.pulledImages[image] == p {
+			delete(c.pulledImages, image)
+		}
+		c.pulledMutex.Unlock()
+	}
+	return p.digest, p.err
+}
+
+// Context returns the context of the run, canceled when conplicity
+// is asked to stop
+func (c *Conplicity) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// HandleSignals cancels the context of the run on SIGINT or SIGTERM,
+// so that running containers are stopped and removed before exiting.
+// A second signal exits immediately.
+func (c *Conplicity) HandleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	c.handleSignals(sigs, os.Exit)
+}
+
+func (c *Conplicity) handleSignals(sigs <-chan os.Signal, exit func(int)) {
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go func() {
+		sig := <-sigs
+		log.WithFields(log.Fields{
+			"signal": sig,
+		}).Warning("Stopping backups, send the signal again to exit immediately")
+		c.cancel()
+
+		sig = <-sigs
+		log.WithFields(log.Fields{
+			"signal": sig,
+		}).Error("Exiting immediately")
+		exit(1)
+	}()
+}
+
 // GetHostname gets the host name
 func (c *Conplicity) GetHostname() (err error) {
 	if c.Config.HostnameFromRancher {
@@ -72,18 +233,63 @@ func (c *Conplicity) GetHostname() (err error) {
 
 // SetupDocker for the  client
 func (c *Conplicity) SetupDocker() (err error) {
-	c.Client, err = docker.NewClient(c.Config.Docker.Endpoint, "", nil, nil)
+	c.Client, err = c.NewDockerClient()
 	util.CheckErr(err, "Failed to create Docker client: %v", "fatal")
 	return
 }
 
-// GetVolumes returns the Docker volumes, inspected and filtered
+// NewDockerClient returns a client of the Docker daemon at DOCKER_HOST,
+// or at the Docker endpoint if it is not set. TLS is used when
+// DOCKER_TLS_VERIFY or DOCKER_CERT_PATH is set, like the Docker CLI does.
+func (c *Conplicity) NewDockerClient() (*docker.Client, error) {
+	d := c.Config.Docker
+	host := d.Endpoint
+	if d.Host != "" {
+		host = d.Host
+	}
+
+	var client *http.Client
+	if d.TLSVerify != "" || d.CertPath != "" {
+		tlsc, err := tlsConfig(d.CertPath, d.TLSVerify != "")
+		if err != nil {
+			return nil, err
+		}
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsc,
+			},
+		}
+	}
+	return docker.NewClient(host, "", client, nil)
+}
+
+// tlsConfig loads the TLS configuration of the Docker client
+// from the certificates in certPath
+func tlsConfig(certPath string, verify bool) (*tls.Config, error) {
+	if certPath == "" {
+		certPath = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	tlsc, err := tlsconfig.Client(tlsconfig.Options{
+		CAFile:             filepath.Join(certPath, "ca.pem"),
+		CertFile:           filepath.Join(certPath, "cert.pem"),
+		KeyFile:            filepath.Join(certPath, "key.pem"),
+		InsecureSkipVerify: !verify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificates from %s: %v", certPath, err)
+	}
+	return tlsc, nil
+}
+
+// GetVolumes returns the Docker volumes and the extra paths, inspected and filtered
 func (c *Conplicity) GetVolumes() (volumes []*volume.Volume, err error) {
 	vols, err := c.VolumeList(context.Background(), filters.NewArgs())
 	if err != nil {
 		err = fmt.Errorf("Failed to list Docker volumes: %v", err)
 		return
 	}
+	var candidates []*volume.Volume
+	names := make(map[string]bool)
 	for _, vol := range vols.Volumes {
 		var voll types.Volume
 		voll, err = c.VolumeInspect(context.Background(), vol.Name)
@@ -91,67 +297,434 @@ func (c *Conplicity) GetVolumes() (volumes []*volume.Volume, err error) {
 			err = fmt.Errorf("Failed to inspect volume %s: %v", vol.Name, err)
 			return
 		}
-		v := volume.NewVolume(&voll, c.Config, c.Hostname)
+		candidates = append(candidates, volume.NewVolume(&voll, c.Config, c.Hostname))
+		names[vol.Name] = true
+	}
+
+	extra, err := c.extraPathVolumes()
+	if err != nil {
+		return
+	}
+	for _, v := range extra {
+		// Backups are named after volumes, they must not be shared
+		if names[v.Name] {
+			v.Log().WithFields(log.Fields{
+				"path": v.Mountpoint,
+			}).Warning("Ignoring extra path named like a Docker volume")
+			continue
+		}
+		candidates = append(candidates, v)
+	}
+
+	for _, v := range candidates {
 		if b, r, s := c.blacklistedVolume(v); b {
-			log.WithFields(log.Fields{
-				"volume": vol.Name,
+			v.Log().WithFields(log.Fields{
 				"reason": r,
 				"source": s,
 			}).Info("Ignoring volume")
 			continue
 		}
+		util.CheckErr(v.LogBackedUp(), "Failed to check whether volume was backed up: %v", "error")
 		volumes = append(volumes, v)
 	}
 	return
 }
 
+// extraPathVolumes returns the volumes backing up the configured extra paths
+func (c *Conplicity) extraPathVolumes() (volumes []*volume.Volume, err error) {
+	for _, s := range c.Config.ExtraPaths {
+		var p config.ExtraPath
+		p, err = config.ParseExtraPath(s)
+		if err != nil {
+			return
+		}
+		volumes = append(volumes, volume.NewHostPathVolume(p.Name, p.Path, c.Config, c.Hostname))
+	}
+	return
+}
+
+// GetVolume returns the Docker volume with the passed name, inspected,
+// or the extra path with this name if there is no such volume
+func (c *Conplicity) GetVolume(name string) (v *volume.Volume, err error) {
+	vol, err := c.VolumeInspect(context.Background(), name)
+	if docker.IsErrVolumeNotFound(err) {
+		for _, s := range c.Config.ExtraPaths {
+			if p, perr := config.ParseExtraPath(s); perr == nil && p.Name == name {
+				return volume.NewHostPathVolume(p.Name, p.Path, c.Config, c.Hostname), nil
+			}
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("Failed to inspect volume %s: %v", name, err)
+		return
+	}
+	v = volume.NewVolume(&vol, c.Config, c.Hostname)
+	return
+}
+
+// GetSelfVolume returns the volume storing conplicity's own state,
+// creating it if needed
+func (c *Conplicity) GetSelfVolume() (v *volume.Volume, err error) {
+	vol, err := c.VolumeCreate(context.Background(), volumetypes.VolumesCreateBody{
+		Name: c.Config.SelfVolume,
+	})
+	if err != nil {
+		err = fmt.Errorf("Failed to create volume %s: %v", c.Config.SelfVolume, err)
+		return
+	}
+	v = volume.NewVolume(&vol, c.Config, c.Hostname)
+	return
+}
+
+// PauseProject pauses the running containers of a Docker Compose project
+// and returns their IDs
+func (c *Conplicity) PauseProject(project string) (paused []string, err error) {
+	f := filters.NewArgs()
+	f.Add("label", "com.docker.compose.project="+project)
+	containers, err := c.ContainerList(c.Context(), types.ContainerListOptions{
+		Filters: f,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to list containers: %v", err)
+		return
+	}
+
+	// Conplicity's own container may be part of the project, it must keep running
+	self, _ := os.Hostname()
+	for _, container := range containers {
+		if container.State == "paused" || (self != "" && strings.HasPrefix(container.ID, self)) {
+			continue
+		}
+		if c.Config.DryRun {
+			log.WithFields(log.Fields{
+				"container": container.ID,
+				"project":   project,
+			}).Info("Dry run, not pausing container")
+			continue
+		}
+		err = c.ContainerPause(c.Context(), container.ID)
+		if err != nil {
+			err = fmt.Errorf("failed to pause container %s: %v", container.ID, err)
+			util.CheckErr(c.UnpauseContainers(paused), "Failed to unpause containers: %v", "error")
+			return nil, err
+		}
+		paused = append(paused, container.ID)
+	}
+	return
+}
+
+// UnpauseContainers unpauses the passed containers
+func (c *Conplicity) UnpauseContainers(ids []string) (err error) {
+	for _, id := range ids {
+		if e := c.ContainerUnpause(context.Background(), id); e != nil {
+			err = fmt.Errorf("failed to unpause container %s: %v", id, e)
+		}
+	}
+	return
+}
+
+// QuiesceContainers pauses the running containers using the volume, or
+// stops them if the volume's quiesce mode is 'stop', and returns their IDs.
+// Containers already quiesced are resumed if one of them fails.
+func (c *Conplicity) QuiesceContainers(vol *volume.Volume) (ids []string, err error) {
+	if !config.IsQuiesceMode(vol.Config.QuiesceMode) {
+		err = fmt.Errorf("invalid quiesce mode %s, expected pause or stop", vol.Config.QuiesceMode)
+		return
+	}
+
+	containers, err := c.ContainerList(c.Context(), types.ContainerListOptions{})
+	if err != nil {
+		err = fmt.Errorf("failed to list containers: %v", err)
+		return
+	}
+
+	// Conplicity's own container may use host paths, it must keep running
+	self, _ := os.Hostname()
+	stop := vol.Config.QuiesceMode == "stop"
+	for _, container := range containers {
+		if container.State != "running" || (self != "" && strings.HasPrefix(container.ID, self)) || !usesVolume(container, vol) {
+			continue
+		}
+
+		vol.Log().WithFields(log.Fields{
+			"container": container.ID,
+			"mode":      vol.Config.QuiesceMode,
+		}).Info("Quiescing container using volume")
+		if c.Config.DryRun {
+			continue
+		}
+
+		if stop {
+			err = c.ContainerStop(c.Context(), container.ID, nil)
+		} else {
+			err = c.ContainerPause(c.Context(), container.ID)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to quiesce container %s: %v", container.ID, err)
+			c.ResumeContainers(vol, ids)
+			return nil, err
+		}
+		ids = append(ids, container.ID)
+	}
+	return
+}
+
+// ResumeContainers unpauses or restarts the containers quiesced for the
+// backup of the volume. Failures are logged, and all containers are resumed.
+func (c *Conplicity) ResumeContainers(vol *volume.Volume, ids []string) (failed int) {
+	for _, id := range ids {
+		var err error
+		// The run context may be canceled, containers must be resumed anyway
+		if vol.Config.QuiesceMode == "stop" {
+			err = c.ContainerStart(context.Background(), id, types.ContainerStartOptions{})
+		} else {
+			err = c.ContainerUnpause(context.Background(), id)
+		}
+		if err != nil {
+			failed++
+			vol.Log().WithFields(log.Fields{
+				"container": id,
+			}).Errorf("FAILED TO RESUME CONTAINER, it must be restarted manually: %v", err)
+		}
+	}
+	return
+}
+
+// usesVolume tells whether the container mounts the volume
+func usesVolume(container types.Container, vol *volume.Volume) bool {
+	for _, m := range container.Mounts {
+		if vol.IsMountedBy(m) {
+			return true
+		}
+	}
+	return false
+}
+
 // IsCheckScheduled checks if the backup must be verified
 func (c *Conplicity) IsCheckScheduled(vol *volume.Volume) (bool, error) {
-	logCheckPath := vol.Mountpoint + "/.conplicity_last_check"
-
 	if vol.Config.NoVerify {
-		log.WithFields(log.Fields{
-			"volume": vol.Name,
-		}).Info("Skipping verification")
+		vol.Log().Info("Skipping verification")
 
 		return false, nil
 	}
 
-	if _, err := os.Stat(logCheckPath); os.IsNotExist(err) {
-		os.OpenFile(logCheckPath, os.O_RDONLY|os.O_CREATE, 0644)
+	// Volumes sharing a repository (e.g. restic) only need it checked once
+	if c.isTargetChecked(vol.Target) {
+		vol.Log().WithFields(log.Fields{
+			"target": vol.Target,
+		}).Info("Repository already verified during this run, skipping verification")
+		return false, nil
 	}
 
-	info, err := os.Stat(logCheckPath)
+	// A failed check leaves the state file untouched, so its age tells
+	// how overdue the verification is. It is read before isPathScheduled
+	// creates a missing file, as the repository was then never checked.
+	path := c.lastCheckPath(vol)
+	c.seedLastCheck(vol, path)
+	info, statErr := os.Stat(path)
+
+	option, every := "check-every", c.Config.CheckEvery
+	if vol.Config.Engine == "restic" {
+		option, every = "restic-check-every", c.Config.Restic.CheckEvery
+	}
+	scheduled, err := c.isPathScheduled(vol, path, every)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"volume": vol.Name,
-		}).Warning("Cannot retrieve the last check date, skipping verification")
+		err = fmt.Errorf("failed to parse the parameter '%s': %v", option, err)
+		return false, err
+	}
+
+	if statErr == nil {
+		c.setLastCheckAge(vol, time.Since(info.ModTime()))
+	}
+
+	if !scheduled {
 		return false, nil
 	}
 
-	checkEvery, err := time.ParseDuration(c.Config.CheckEvery)
+	vol.Log().Info("Verifying backup")
+
+	return true, nil
+}
+
+// IsScheduled checks if an operation must be performed on the volume,
+// i.e. if more than every elapsed since its state file was last touched
+func (c *Conplicity) IsScheduled(vol *volume.Volume, stateFile, every string) (bool, error) {
+	return c.isPathScheduled(vol, vol.Mountpoint+"/"+stateFile, every)
+}
+
+// isPathScheduled checks if an operation must be performed on the volume,
+// i.e. if more than every elapsed since the state file at path was last touched
+func (c *Conplicity) isPathScheduled(vol *volume.Volume, path, every string) (bool, error) {
+	duration, err := time.ParseDuration(every)
 	if err != nil {
-		err = fmt.Errorf("failed to parse the parameter 'check-every': %v", err)
 		return false, err
 	}
 
-	checkExpiration := info.ModTime().Add(checkEvery)
-	if time.Now().Before(checkExpiration) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if c.Config.DryRun {
+			// Dry runs do not write state files
+			return true, nil
+		}
+		os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		vol.Log().WithFields(log.Fields{
+			"file": filepath.Base(path),
+		}).Warning("Cannot retrieve the last operation date, skipping operation")
 		return false, nil
 	}
 
-	log.WithFields(log.Fields{
-		"volume": vol.Name,
-	}).Info("Verifying backup")
+	expiration := info.ModTime().Add(duration)
+	return !time.Now().Before(expiration), nil
+}
+
+// TouchStateFile records that the operation tracked by the state file
+// was just performed on the volume, unless in dry run mode
+func (c *Conplicity) TouchStateFile(vol *volume.Volume, stateFile string) {
+	c.touchPath(vol.Mountpoint + "/" + stateFile)
+}
 
-	return true, nil
+// touchPath sets the modification time of the state file at path to now,
+// unless in dry run mode
+func (c *Conplicity) touchPath(path string) {
+	if c.Config.DryRun {
+		return
+	}
+	now := time.Now().Local()
+	os.Chtimes(path, now, now)
+}
+
+// SetLastCheck records a successful verification of the volume's repository
+func (c *Conplicity) SetLastCheck(vol *volume.Volume) {
+	c.touchPath(c.lastCheckPath(vol))
+	if !c.Config.DryRun {
+		c.setLastCheckAge(vol, 0)
+	}
+
+	c.checkedMutex.Lock()
+	defer c.checkedMutex.Unlock()
+	if c.checkedTargets == nil {
+		c.checkedTargets = make(map[string]bool)
+	}
+	c.checkedTargets[vol.Target] = true
+}
+
+// setLastCheckAge reports the time elapsed since the last successful
+// verification of the volume
+func (c *Conplicity) setLastCheckAge(vol *volume.Volume, age time.Duration) {
+	if vol.MetricsHandler == nil {
+		return
+	}
+	metric := vol.MetricsHandler.NewMetric("conplicity_lastCheckAge", "gauge")
+	metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": vol.Name,
+			},
+			Value: strconv.FormatInt(int64(age.Seconds()), 10),
+		},
+	)
+}
+
+// lastCheckPath returns the path of the file recording the last successful
+// verification of the volume's repository. Volumes sharing a repository
+// share the file, kept in the state directory. It is in the volume when
+// there is no state directory or the target is unknown.
+func (c *Conplicity) lastCheckPath(vol *volume.Volume) string {
+	if vol.Target == "" {
+		return vol.Mountpoint + "/" + lastCheckFile
+	}
+	dir := c.getStateDir()
+	if dir == "" {
+		return vol.Mountpoint + "/" + lastCheckFile
+	}
+	sum := sha256.Sum256([]byte(vol.Target))
+	return dir + "/" + lastCheckFile + "_" + hex.EncodeToString(sum[:])
+}
+
+// seedLastCheck creates the missing last check file of the volume's
+// repository with the date of the last check recorded in the volume, so
+// that checks are not delayed when switching to the repository's file
+func (c *Conplicity) seedLastCheck(vol *volume.Volume, path string) {
+	volumePath := vol.Mountpoint + "/" + lastCheckFile
+	if c.Config.DryRun || path == volumePath {
+		return
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return
+	}
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	f.Close()
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+// getStateDir returns the directory storing the state shared by volumes:
+// the state-dir setting, or the mountpoint of the self volume. It is empty
+// when neither is available.
+func (c *Conplicity) getStateDir() string {
+	c.stateDirOnce.Do(func() {
+		if c.Config.StateDir != "" {
+			c.stateDir = c.Config.StateDir
+			return
+		}
+		if c.Client == nil {
+			return
+		}
+		self, err := c.GetSelfVolume()
+		if err == nil && self.MountByName {
+			err = fmt.Errorf("volume %s has no local mountpoint", self.Name)
+		}
+		if err != nil {
+			log.Warningf("No state directory, the last check of repositories is recorded in each volume: %v", err)
+			return
+		}
+		c.stateDir = self.Mountpoint
+	})
+	return c.stateDir
+}
+
+func (c *Conplicity) isTargetChecked(target string) bool {
+	if target == "" {
+		return false
+	}
+	c.checkedMutex.Lock()
+	defer c.checkedMutex.Unlock()
+	return c.checkedTargets[target]
 }
 
 func (c *Conplicity) blacklistedVolume(vol *volume.Volume) (bool, string, string) {
+	// The blacklist wins over the whitelist
+	if p, ok := matchingPattern(c.Config.VolumeBlacklist, vol.Name); ok {
+		return true, "blacklisted", fmt.Sprintf("volume blacklist pattern %s", p)
+	}
+
+	if len(c.Config.VolumeWhitelist) > 0 {
+		if _, ok := matchingPattern(c.Config.VolumeWhitelist, vol.Name); !ok {
+			return true, "not whitelisted", "volume whitelist"
+		}
+	}
+
 	if utf8.RuneCountInString(vol.Name) == 64 || vol.Name == "duplicity_cache" || vol.Name == "lost+found" {
 		return true, "unnamed", ""
 	}
 
+	if vol.Name == c.Config.Restic.CacheVolume {
+		return true, "cache", ""
+	}
+
+	if c.Config.BackupSelf && vol.Name == c.Config.SelfVolume {
+		return true, "self", "backup self config"
+	}
+
 	list := c.Config.VolumesBlacklist
 	i := sort.SearchStrings(list, vol.Name)
 	if i < len(list) && list[i] == vol.Name {
@@ -165,6 +738,17 @@ func (c *Conplicity) blacklistedVolume(vol *volume.Volume) (bool, string, string
 	return false, "", ""
 }
 
+// matchingPattern returns the first of the patterns matching name.
+// Invalid patterns are rejected when validating the config and never match.
+func matchingPattern(patterns []string, name string) (string, bool) {
+	for _, p := range patterns {
+		if ok, err := regexp.MatchString(p, name); err == nil && ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
 func (c *Conplicity) setupLoglevel() (err error) {
 	switch c.Config.Loglevel {
 	case "debug":
@@ -184,8 +768,10 @@ func (c *Conplicity) setupLoglevel() (err error) {
 		err = errors.New(errMsg)
 	}
 
-	if c.Config.JSON {
+	if c.Config.JSON || c.Config.LogFormat == "json" {
 		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
 	}
 
 	return
@@ -1,14 +1,25 @@
 package handler
 
 import (
+	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/camptocamp/conplicity/util"
 	"github.com/camptocamp/conplicity/volume"
 	"github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
 	"golang.org/x/net/context"
 
 	log "github.com/Sirupsen/logrus"
@@ -56,7 +67,7 @@ func TestSetup(t *testing.T) {
 func TestSchedulerVolumeNoVerify(t *testing.T) {
 	fakeMountpoint, err := ioutil.TempDir("", "testConplicity")
 	if err != nil {
-		t.Fatal("Cannot create temporary directory: %v", err)
+		t.Fatalf("Cannot create temporary directory: %v", err)
 	}
 
 	defer os.RemoveAll(fakeMountpoint)
@@ -82,7 +93,7 @@ func TestSchedulerVolumeNoVerify(t *testing.T) {
 func TestSchedulerVolumePermissionDenied(t *testing.T) {
 	fakeMountpoint, err := ioutil.TempDir("", "testConplicity")
 	if err != nil {
-		t.Fatal("Cannot create temporary directory: %v", err)
+		t.Fatalf("Cannot create temporary directory: %v", err)
 	}
 
 	defer os.RemoveAll(fakeMountpoint)
@@ -115,7 +126,7 @@ func TestSchedulerVolumePermissionDenied(t *testing.T) {
 func TestSchedulerVolumeInvalidCheckEvery(t *testing.T) {
 	fakeMountpoint, err := ioutil.TempDir("", "testConplicity")
 	if err != nil {
-		t.Fatal("Cannot create temporary directory: %v", err)
+		t.Fatalf("Cannot create temporary directory: %v", err)
 	}
 
 	defer os.RemoveAll(fakeMountpoint)
@@ -147,7 +158,7 @@ func TestSchedulerVolumeInvalidCheckEvery(t *testing.T) {
 func TestSchedulerVolumeVerifyNotRequired(t *testing.T) {
 	fakeMountpoint, err := ioutil.TempDir("", "testConplicity")
 	if err != nil {
-		t.Fatal("Cannot create temporary directory: %v", err)
+		t.Fatalf("Cannot create temporary directory: %v", err)
 	}
 
 	defer os.RemoveAll(fakeMountpoint)
@@ -177,7 +188,7 @@ func TestSchedulerVolumeVerifyNotRequired(t *testing.T) {
 func TestSchedulerVolumeVerifyRequired(t *testing.T) {
 	fakeMountpoint, err := ioutil.TempDir("", "testConplicity")
 	if err != nil {
-		t.Fatal("Cannot create temporary directory: %v", err)
+		t.Fatalf("Cannot create temporary directory: %v", err)
 	}
 
 	defer os.RemoveAll(fakeMountpoint)
@@ -207,3 +218,562 @@ func TestSchedulerVolumeVerifyRequired(t *testing.T) {
 		t.Fatal("Expected true, got false.")
 	}
 }
+
+func TestSchedulerResticCheckEvery(t *testing.T) {
+	fakeMountpoint, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(fakeMountpoint)
+
+	vol := volume.Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: fakeMountpoint,
+		},
+		Config: &volume.Config{
+			Engine: "restic",
+		},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	c := Conplicity{
+		Config: &config.Config{
+			CheckEvery: "1h",
+		},
+	}
+	c.Config.Restic.CheckEvery = "168h"
+
+	// Volumes never checked have no last check age
+	c.IsCheckScheduled(&vol)
+	if _, ok := vol.MetricsHandler.Metrics["conplicity_lastCheckAge"]; ok {
+		t.Fatal("Expected no last check age for a volume never checked")
+	}
+
+	h := time.Now().Local().AddDate(0, 0, -2)
+	os.Chtimes(fakeMountpoint+"/.conplicity_last_check", h, h)
+	if result, _ := c.IsCheckScheduled(&vol); result != false {
+		t.Fatal("Expected restic check not to be scheduled before restic-check-every, got true.")
+	}
+	age, _ := strconv.Atoi(vol.MetricsHandler.Metrics["conplicity_lastCheckAge"].Events[0].Value)
+	if age < 172800 || age > 172900 {
+		t.Fatalf("Expected last check age of about 172800 seconds, got %d", age)
+	}
+
+	vol.Config.Engine = "duplicity"
+	if result, _ := c.IsCheckScheduled(&vol); result != true {
+		t.Fatal("Expected duplicity check to be scheduled after check-every, got false.")
+	}
+
+	c.SetLastCheck(&vol)
+	if age := vol.MetricsHandler.Metrics["conplicity_lastCheckAge"].Events[0].Value; age != "0" {
+		t.Fatalf("Expected last check age to be reset, got %s", age)
+	}
+}
+
+func TestSchedulerSharedTargetCheckedOnce(t *testing.T) {
+	fakeMountpoint1, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(fakeMountpoint1)
+
+	fakeMountpoint2, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(fakeMountpoint2)
+
+	stateDir, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	// The repository's last check starts from the one recorded in the volumes
+	h := time.Now().Local().AddDate(0, 0, -1)
+	for _, m := range []string{fakeMountpoint1, fakeMountpoint2} {
+		os.OpenFile(m+"/.conplicity_last_check", os.O_RDONLY|os.O_CREATE, 0644)
+		os.Chtimes(m+"/.conplicity_last_check", h, h)
+	}
+
+	vol1 := volume.Volume{
+		Volume: &types.Volume{
+			Name:       "vol1",
+			Mountpoint: fakeMountpoint1,
+		},
+		Target: "s3:s3.amazonaws.com/bucket/repo",
+		Config: &volume.Config{},
+	}
+	vol2 := volume.Volume{
+		Volume: &types.Volume{
+			Name:       "vol2",
+			Mountpoint: fakeMountpoint2,
+		},
+		Target: "s3:s3.amazonaws.com/bucket/repo",
+		Config: &volume.Config{},
+	}
+
+	c := Conplicity{
+		Config: &config.Config{
+			CheckEvery: "1h",
+			StateDir:   stateDir,
+		},
+	}
+
+	if result, _ := c.IsCheckScheduled(&vol1); result != true {
+		t.Fatal("Expected true for a repository checked a day ago, got false.")
+	}
+	c.SetLastCheck(&vol1)
+
+	if result, _ := c.IsCheckScheduled(&vol2); result != false {
+		t.Fatal("Expected false for an already checked repository, got true.")
+	}
+
+	// The last check of the repository is kept between runs
+	c.ResetRun()
+	if result, _ := c.IsCheckScheduled(&vol2); result != false {
+		t.Fatal("Expected false for a repository checked during the previous run, got true.")
+	}
+
+	files, _ := filepath.Glob(stateDir + "/.conplicity_last_check_*")
+	if len(files) != 1 {
+		t.Fatalf("Expected a single last check file for the repository, got %v", files)
+	}
+	h = time.Now().Local().Add(-2 * time.Hour)
+	os.Chtimes(files[0], h, h)
+	if result, _ := c.IsCheckScheduled(&vol2); result != true {
+		t.Fatal("Expected true for a repository checked more than check-every ago, got false.")
+	}
+
+	info, err := os.Stat(fakeMountpoint2 + "/.conplicity_last_check")
+	if err != nil {
+		t.Fatalf("Failed to stat last check file: %v", err)
+	}
+	if info.ModTime().After(time.Now().Add(-time.Hour)) {
+		t.Fatal("Expected the last check file of the volume to be left untouched")
+	}
+}
+
+func TestPullImageOnce(t *testing.T) {
+	var mutex sync.Mutex
+	pulls := map[string]int{}
+	fail := true
+	pullImage = func(_ context.Context, _ *docker.Client, image string, force bool, auth string) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		pulls[image]++
+		if image == "broken" && fail {
+			return "", errors.New("registry unavailable")
+		}
+		return "sha256:" + image, nil
+	}
+	defer func() { pullImage = util.PullImage }()
+
+	c := Conplicity{
+		Config: &config.Config{},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if digest, err := c.PullImage("restic"); err != nil || digest != "sha256:restic" {
+				t.Errorf("Expected digest sha256:restic, got %s, %v", digest, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if pulls["restic"] != 1 {
+		t.Fatalf("Expected a single pull, got %d", pulls["restic"])
+	}
+
+	// Failed pulls are attempted again
+	if _, err := c.PullImage("broken"); err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+	fail = false
+	if _, err := c.PullImage("broken"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if pulls["broken"] != 2 {
+		t.Fatalf("Expected 2 pulls of the broken image, got %d", pulls["broken"])
+	}
+
+	// The next run pulls again
+	c.ResetRun()
+	c.PullImage("restic")
+	if pulls["restic"] != 2 {
+		t.Fatalf("Expected a pull in the next run, got %d pulls", pulls["restic"])
+	}
+}
+
+func TestRepositoryID(t *testing.T) {
+	c := Conplicity{}
+	if _, ok := c.RepositoryID("s3:s3.amazonaws.com/bucket/repo"); ok {
+		t.Fatal("Expected no repository ID before it is read")
+	}
+	c.SetRepositoryID("s3:s3.amazonaws.com/bucket/repo", "40dc1520")
+	if id, ok := c.RepositoryID("s3:s3.amazonaws.com/bucket/repo"); !ok || id != "40dc1520" {
+		t.Fatalf("Expected repository ID 40dc1520, got %s", id)
+	}
+
+	// The next run reads the ID again, the repository may have been replaced
+	c.ResetRun()
+	if _, ok := c.RepositoryID("s3:s3.amazonaws.com/bucket/repo"); ok {
+		t.Fatal("Expected the repository ID to be forgotten in the next run")
+	}
+}
+
+func TestIsScheduled(t *testing.T) {
+	fakeMountpoint, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(fakeMountpoint)
+
+	vol := volume.Volume{
+		Volume: &types.Volume{
+			Mountpoint: fakeMountpoint,
+		},
+		Config: &volume.Config{},
+	}
+	c := Conplicity{
+		Config: &config.Config{
+			DryRun: true,
+		},
+	}
+
+	// Dry runs do not create missing state files
+	if result, _ := c.IsScheduled(&vol, ".conplicity_test", "1h"); result != true {
+		t.Fatal("Expected true in dry run mode, got false.")
+	}
+	if _, err := os.Stat(fakeMountpoint + "/.conplicity_test"); !os.IsNotExist(err) {
+		t.Fatal("Expected no state file to be created in dry run mode")
+	}
+	c.Config.DryRun = false
+
+	// A missing state file is created with the current date
+	if result, _ := c.IsScheduled(&vol, ".conplicity_test", "1h"); result != false {
+		t.Fatal("Expected false, got true.")
+	}
+
+	h := time.Now().Local().AddDate(0, 0, -1)
+	os.Chtimes(fakeMountpoint+"/.conplicity_test", h, h)
+	if result, _ := c.IsScheduled(&vol, ".conplicity_test", "1h"); result != true {
+		t.Fatal("Expected true, got false.")
+	}
+
+	c.TouchStateFile(&vol, ".conplicity_test")
+	if result, _ := c.IsScheduled(&vol, ".conplicity_test", "1h"); result != false {
+		t.Fatal("Expected false after touching the state file, got true.")
+	}
+
+	if _, err := c.IsScheduled(&vol, ".conplicity_test", "foo"); err == nil {
+		t.Fatal("Expected an error for an invalid duration, got nil.")
+	}
+}
+
+func TestBlacklistedCacheVolume(t *testing.T) {
+	c := Conplicity{
+		Config: &config.Config{},
+	}
+	c.Config.Restic.CacheVolume = "restic_cache"
+
+	vol := volume.Volume{
+		Volume: &types.Volume{
+			Name: "restic_cache",
+		},
+		Config: &volume.Config{},
+	}
+	if b, r, _ := c.blacklistedVolume(&vol); !b || r != "cache" {
+		t.Fatalf("Expected cache volume to be ignored, got %v, %s", b, r)
+	}
+
+	vol.Name = "foo"
+	if b, _, _ := c.blacklistedVolume(&vol); b {
+		t.Fatal("Expected volume not to be ignored")
+	}
+}
+
+func TestExtraPathVolumes(t *testing.T) {
+	c := Conplicity{
+		Config:   &config.Config{},
+		Hostname: "host",
+	}
+	c.Config.ExtraPaths = []string{"etc:/etc", "srv:/srv/data"}
+
+	vols, err := c.extraPathVolumes()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(vols) != 2 || vols[1].Name != "srv" || vols[1].Mountpoint != "/srv/data" || !vols[1].HostPath {
+		t.Fatalf("Expected host path volumes etc and srv, got %v", vols)
+	}
+
+	c.Config.ExtraPaths = []string{"/etc"}
+	if _, err := c.extraPathVolumes(); err == nil {
+		t.Fatal("Expected an error for an invalid extra path, got nil")
+	}
+}
+
+func TestNewDockerClient(t *testing.T) {
+	c := Conplicity{
+		Config: &config.Config{},
+	}
+	c.Config.Docker.Endpoint = "unix:///var/run/docker.sock"
+
+	if _, err := c.NewDockerClient(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	c.Config.Docker.Host = "foo"
+	if _, err := c.NewDockerClient(); err == nil {
+		t.Fatal("Expected an error for an invalid Docker host, got nil")
+	}
+
+	dir, err := ioutil.TempDir("", "conplicity_certs")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c.Config.Docker.Host = "tcp://127.0.0.1:2376"
+	c.Config.Docker.TLSVerify = "1"
+	c.Config.Docker.CertPath = dir
+	if _, err := c.NewDockerClient(); err == nil {
+		t.Fatal("Expected an error for missing certificates, got nil")
+	}
+}
+
+func TestVolumePatterns(t *testing.T) {
+	c := Conplicity{
+		Config: &config.Config{},
+	}
+	c.Config.VolumeWhitelist = []string{"^db_", "_data$"}
+	c.Config.VolumeBlacklist = []string{"^db_test"}
+
+	for name, expected := range map[string]string{
+		"db_prod":      "",
+		"app_data":     "",
+		"db_test_data": "blacklisted", // matches both lists
+		"cache":        "not whitelisted",
+	} {
+		vol := volume.Volume{
+			Volume: &types.Volume{
+				Name: name,
+			},
+			Config: &volume.Config{},
+		}
+		b, r, s := c.blacklistedVolume(&vol)
+		if b != (expected != "") || r != expected {
+			t.Fatalf("Expected %s to be ignored as %q, got %v, %q", name, expected, b, r)
+		}
+		if r == "blacklisted" && s != "volume blacklist pattern ^db_test" {
+			t.Fatalf("Expected the matched pattern in the source, got %s", s)
+		}
+	}
+
+	// Without whitelist, all volumes but the blacklisted ones are backed up
+	c.Config.VolumeWhitelist = nil
+	vol := volume.Volume{
+		Volume: &types.Volume{
+			Name: "cache",
+		},
+		Config: &volume.Config{},
+	}
+	if b, _, _ := c.blacklistedVolume(&vol); b {
+		t.Fatal("Expected volume not to be ignored without whitelist")
+	}
+}
+
+func TestSetupLogFormat(t *testing.T) {
+	c := Conplicity{
+		Config: &config.Config{
+			Loglevel:  "info",
+			LogFormat: "json",
+		},
+	}
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	if err := c.setupLoglevel(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); !ok {
+		t.Fatalf("Expected JSON formatter, got %T", log.StandardLogger().Formatter)
+	}
+
+	c.Config.LogFormat = "text"
+	if err := c.setupLoglevel(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.TextFormatter); !ok {
+		t.Fatalf("Expected text formatter, got %T", log.StandardLogger().Formatter)
+	}
+
+	c.Config.JSON = true
+	if err := c.setupLoglevel(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); !ok {
+		t.Fatalf("Expected --json to select the JSON formatter, got %T", log.StandardLogger().Formatter)
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	c := Conplicity{}
+	if c.Context().Err() != nil {
+		t.Fatal("Expected a usable context before handling signals")
+	}
+
+	sigs := make(chan os.Signal)
+	exited := make(chan int, 1)
+	c.handleSignals(sigs, func(code int) {
+		exited <- code
+	})
+
+	sigs <- syscall.SIGTERM
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the context to be canceled after a signal")
+	}
+	if len(exited) != 0 {
+		t.Fatal("Expected not to exit after the first signal")
+	}
+
+	sigs <- syscall.SIGINT
+	select {
+	case code := <-exited:
+		if code == 0 {
+			t.Fatal("Expected a non-zero exit code")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected to exit after a second signal")
+	}
+}
+
+// fakeContainersAPI serves a container list with containers aaa (using
+// volume foo), bbb (using volume bar) and ccc (paused, using volume foo),
+// recording the other calls. Calls on container ddd fail.
+func fakeContainersAPI() (ts *httptest.Server, calls *[]string) {
+	calls = &[]string{}
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/containers/json" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[
+				{"Id": "aaa", "State": "running", "Mounts": [{"Type": "volume", "Name": "foo"}]},
+				{"Id": "bbb", "State": "running", "Mounts": [{"Type": "volume", "Name": "bar"}]},
+				{"Id": "ccc", "State": "paused", "Mounts": [{"Type": "volume", "Name": "foo"}]}
+			]`))
+			return
+		}
+		*calls = append(*calls, r.Method+" "+r.URL.Path)
+		if strings.HasPrefix(r.URL.Path, "/containers/ddd/") {
+			http.Error(w, `{"message": "no such container"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return
+}
+
+func TestQuiesceContainers(t *testing.T) {
+	ts, calls := fakeContainersAPI()
+	defer ts.Close()
+
+	cli, err := docker.NewClient("tcp://"+strings.TrimPrefix(ts.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create Docker client: %v", err)
+	}
+	c := Conplicity{
+		Client: cli,
+		Config: &config.Config{},
+	}
+	vol := &volume.Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		Config: &volume.Config{
+			QuiesceMode: "pause",
+		},
+	}
+
+	ids, err := c.QuiesceContainers(vol)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "aaa" {
+		t.Fatalf("Expected running container aaa to be quiesced, got %v", ids)
+	}
+	if failed := c.ResumeContainers(vol, ids); failed != 0 {
+		t.Fatalf("Expected no failure, got %d", failed)
+	}
+	expected := "POST /containers/aaa/pause, POST /containers/aaa/unpause"
+	if got := strings.Join(*calls, ", "); got != expected {
+		t.Fatalf("Expected calls %s, got %s", expected, got)
+	}
+
+	*calls = nil
+	vol.Config.QuiesceMode = "stop"
+	ids, _ = c.QuiesceContainers(vol)
+	c.ResumeContainers(vol, ids)
+	expected = "POST /containers/aaa/stop, POST /containers/aaa/start"
+	if got := strings.Join(*calls, ", "); got != expected {
+		t.Fatalf("Expected calls %s, got %s", expected, got)
+	}
+
+	// All containers are resumed even when one fails
+	*calls = nil
+	if failed := c.ResumeContainers(vol, []string{"ddd", "aaa"}); failed != 1 {
+		t.Fatalf("Expected 1 failure, got %d", failed)
+	}
+	if len(*calls) != 2 {
+		t.Fatalf("Expected all containers to be resumed, got %v", *calls)
+	}
+
+	// Unknown modes quiesce nothing
+	*calls = nil
+	vol.Config.QuiesceMode = "freeze"
+	if _, err := c.QuiesceContainers(vol); err == nil || len(*calls) != 0 {
+		t.Fatalf("Expected an error for an unknown quiesce mode, got %v and calls %v", err, *calls)
+	}
+	vol.Config.QuiesceMode = "stop"
+
+	// Nothing is changed in dry run mode
+	*calls = nil
+	c.Config.DryRun = true
+	if ids, _ := c.QuiesceContainers(vol); len(ids) != 0 || len(*calls) != 0 {
+		t.Fatalf("Expected no container to be quiesced in dry run mode, got %v", *calls)
+	}
+}
+
+func TestPauseProject(t *testing.T) {
+	ts, calls := fakeContainersAPI()
+	defer ts.Close()
+
+	cli, err := docker.NewClient("tcp://"+strings.TrimPrefix(ts.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create Docker client: %v", err)
+	}
+	c := Conplicity{
+		Client: cli,
+		Config: &config.Config{},
+	}
+
+	paused, err := c.PauseProject("app")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := strings.Join(paused, ","); got != "aaa,bbb" {
+		t.Fatalf("Expected running containers aaa and bbb to be paused, got %s", got)
+	}
+
+	// Nothing is paused in dry run mode
+	*calls = nil
+	c.Config.DryRun = true
+	if paused, _ := c.PauseProject("app"); len(paused) != 0 || len(*calls) != 0 {
+		t.Fatalf("Expected no container to be paused in dry run mode, got %v", *calls)
+	}
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// InfluxDB is an InfluxDB server receiving the metrics as line protocol
+type InfluxDB struct {
+	URL string
+	// Database is the InfluxDB 1.x database, or the InfluxDB 2.x bucket
+	Database string
+	// Org selects the InfluxDB 2.x write API when set
+	Org   string
+	Token string
+}
+
+// measurementPrefix is removed from metric names to name measurements
+const measurementPrefix = "conplicity_"
+
+// influxEscaper escapes measurements, tag keys and tag values
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// lineProtocol returns the metrics of the handlers as InfluxDB line protocol
+// points at time t. Measurements are named after the metrics, without their
+// conplicity_ prefix, and tagged with the labels of their events.
+// Events without a numeric value are skipped.
+func lineProtocol(handlers []*PrometheusMetrics, t time.Time) string {
+	var lines []string
+	for _, p := range handlers {
+		volume := map[string]string{
+			"volume": p.Volume,
+		}
+		p.each(func(m *Metric) {
+			for _, e := range m.Events {
+				value, err := strconv.ParseFloat(e.Value, 64)
+				if err != nil {
+					continue
+				}
+				e = p.withLabels(e).withLabels(volume)
+
+				var tags []string
+				for l, v := range e.Labels {
+					if v == "" || contains(p.DropLabels, l) {
+						continue
+					}
+					tags = append(tags, influxEscaper.Replace(l)+"="+influxEscaper.Replace(v))
+				}
+				// InfluxDB recommends sorting tags by key
+				sort.Strings(tags)
+
+				point := influxEscaper.Replace(strings.TrimPrefix(e.Name, measurementPrefix))
+				if len(tags) > 0 {
+					point += "," + strings.Join(tags, ",")
+				}
+				point += fmt.Sprintf(" value=%s %d", strconv.FormatFloat(value, 'f', -1, 64), t.UnixNano())
+				lines = append(lines, point)
+			}
+		})
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// writeURL returns the URL of the write API of the server
+func (i *InfluxDB) writeURL() string {
+	params := url.Values{}
+	params.Set("precision", "ns")
+	if i.Org != "" {
+		params.Set("org", i.Org)
+		params.Set("bucket", i.Database)
+		return strings.TrimRight(i.URL, "/") + "/api/v2/write?" + params.Encode()
+	}
+	params.Set("db", i.Database)
+	return strings.TrimRight(i.URL, "/") + "/write?" + params.Encode()
+}
+
+// WriteInflux writes the metrics of all registered volumes to InfluxDB
+func WriteInflux(i *InfluxDB) (err error) {
+	registry.Lock()
+	handlers := append([]*PrometheusMetrics(nil), registry.handlers...)
+	registry.Unlock()
+
+	data := lineProtocol(handlers, time.Now())
+	if data == "" {
+		log.Debug("No metrics to write to InfluxDB")
+		return
+	}
+
+	req, err := http.NewRequest("POST", i.writeURL(), bytes.NewBufferString(data))
+	if err != nil {
+		err = fmt.Errorf("failed to create HTTP request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.Token != "" {
+		req.Header.Set("Authorization", "Token "+i.Token)
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to get HTTP response: %v", err)
+		return
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to read HTTP response: %v", err)
+		return
+	}
+
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("InfluxDB returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineProtocol(t *testing.T) {
+	p := NewMetrics("host", "foo bar", "")
+	p.Labels = map[string]string{
+		"engine":   "restic",
+		"hostname": "host",
+	}
+	p.DropLabels = []string{"repo_id"}
+	p.NewMetric("conplicity_backupExitCode", "gauge").UpdateEvent(&Event{
+		Labels: map[string]string{},
+		Value:  "0",
+	})
+	p.NewMetric("conplicity_bytesAdded", "gauge").UpdateEvent(&Event{
+		Labels: map[string]string{
+			"repo_id": "4bba301e",
+		},
+		Value: "1048576",
+	})
+	p.NewMetric("conplicity_backupDuration", "gauge").UpdateEvent(&Event{
+		Labels: map[string]string{},
+		Value:  "12.50",
+	})
+	p.NewMetric("conplicity_imageDigest", "gauge").UpdateEvent(&Event{
+		Labels: map[string]string{
+			"image": "restic/restic:0.9.6",
+		},
+		Value: "sha256:abc",
+	})
+
+	expected := `backupDuration,engine=restic,hostname=host,volume=foo\ bar value=12.5 1488333612000000000
+backupExitCode,engine=restic,hostname=host,volume=foo\ bar value=0 1488333612000000000
+bytesAdded,engine=restic,hostname=host,volume=foo\ bar value=1048576 1488333612000000000`
+	if got := lineProtocol([]*PrometheusMetrics{p}, time.Unix(1488333612, 0)); got != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestWriteInflux(t *testing.T) {
+	var query, auth, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Path + "?" + r.URL.RawQuery
+		auth = r.Header.Get("Authorization")
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	Reset()
+	defer Reset()
+	p := NewMetrics("host", "foo", "")
+	Register(p)
+	p.NewMetric("conplicity_verifyExitCode", "gauge").UpdateEvent(&Event{
+		Labels: map[string]string{},
+		Value:  "0",
+	})
+
+	if err := WriteInflux(&InfluxDB{URL: ts.URL, Database: "backups", Org: "ops", Token: "secret"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if query != "/api/v2/write?bucket=backups&org=ops&precision=ns" {
+		t.Fatalf("Expected the 2.x write API, got %s", query)
+	}
+	if auth != "Token secret" {
+		t.Fatalf("Expected the token, got %s", auth)
+	}
+	if !strings.HasPrefix(body, "verifyExitCode,volume=foo value=0 ") {
+		t.Fatalf("Expected a verifyExitCode point, got %s", body)
+	}
+
+	if err := WriteInflux(&InfluxDB{URL: ts.URL + "/", Database: "backups"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if query != "/write?db=backups&precision=ns" {
+		t.Fatalf("Expected the 1.x write API, got %s", query)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -16,6 +17,13 @@ type PrometheusMetrics struct {
 	Volume         string
 	PushgatewayURL string
 	Metrics        map[string]*Metric
+	// DropLabels are removed from events when pushing them,
+	// to limit the metrics cardinality
+	DropLabels []string
+	// Labels are added to all events when pushing them
+	Labels map[string]string
+
+	mutex sync.Mutex
 }
 
 // Metric is a Prometheus Metric
@@ -23,6 +31,8 @@ type Metric struct {
 	Name   string
 	Events []*Event
 	Type   string
+
+	mutex sync.Mutex
 }
 
 // Event is a Prometheus Metric Event
@@ -44,13 +54,30 @@ func NewMetrics(instance, volume, pushgatewayURL string) *PrometheusMetrics {
 
 // String formats an event for printing
 func (e *Event) String() string {
+	return e.StringWithout(nil)
+}
+
+// StringWithout formats an event for printing, without the dropped labels
+func (e *Event) StringWithout(drop []string) string {
 	var labels []string
 	for l, v := range e.Labels {
+		if contains(drop, l) {
+			continue
+		}
 		labels = append(labels, fmt.Sprintf("%s=\"%s\"", l, v))
 	}
 	return fmt.Sprintf("%s{%s} %s", e.Name, strings.Join(labels, ","), e.Value)
 }
 
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Equals checks if two Events refer to the same Prometheus event
 func (e *Event) Equals(newEvent *Event) bool {
 	if e.Name != newEvent.Name {
@@ -64,8 +91,12 @@ func (e *Event) Equals(newEvent *Event) bool {
 	return true
 }
 
-// UpdateEvent adds an event, or updates it if the event already exists
+// UpdateEvent adds an event, or updates it if the event already exists.
+// It is safe to call while the metrics are pushed or served.
 func (m *Metric) UpdateEvent(event *Event) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if event.Name == "" {
 		event.Name = m.Name
 	}
@@ -95,6 +126,9 @@ func (m *Metric) UpdateEvent(event *Event) error {
 // NewMetric adds a new metric if it doesn't exist yet
 // or returns the existing matching metric otherwise
 func (p *PrometheusMetrics) NewMetric(name, mType string) (m *Metric) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	m, ok := p.Metrics[name]
 	if !ok {
 		m = &Metric{
@@ -106,24 +140,60 @@ func (p *PrometheusMetrics) NewMetric(name, mType string) (m *Metric) {
 	return
 }
 
+// withLabels returns the event with the labels added to all events
+func (p *PrometheusMetrics) withLabels(e *Event) *Event {
+	return e.withLabels(p.Labels)
+}
+
+// withLabels returns a copy of the event with the labels added,
+// or the event itself if there is no label to add
+func (e *Event) withLabels(labels map[string]string) *Event {
+	if len(labels) == 0 {
+		return e
+	}
+	labeled := &Event{
+		Name:   e.Name,
+		Labels: make(map[string]string),
+		Value:  e.Value,
+	}
+	for l, v := range e.Labels {
+		labeled.Labels[l] = v
+	}
+	for l, v := range labels {
+		labeled.Labels[l] = v
+	}
+	return labeled
+}
+
+// each calls fn for each metric with its events, holding their locks
+func (p *PrometheusMetrics) each(fn func(m *Metric)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, m := range p.Metrics {
+		m.mutex.Lock()
+		fn(m)
+		m.mutex.Unlock()
+	}
+}
+
 // Push sends metrics to a Prometheus push gateway
 func (p *PrometheusMetrics) Push() (err error) {
 	if p.PushgatewayURL == "" {
 		log.Debug("No Pushgateway URL specified, not pushing metrics")
 		return
 	}
-	metrics := p.Metrics
 	url := p.PushgatewayURL + "/metrics/job/conplicity/instance/" + p.Instance + "/volume/" + p.Volume
 
 	var data string
-	for _, m := range metrics {
+	p.each(func(m *Metric) {
 		if m.Type != "" {
 			data += fmt.Sprintf("# TYPE %s %s\n", m.Name, m.Type)
 		}
 		for _, e := range m.Events {
-			data += fmt.Sprintf("%s\n", e)
+			data += fmt.Sprintf("%s\n", p.withLabels(e).StringWithout(p.DropLabels))
 		}
-	}
+	})
 	data += "\n"
 
 	log.WithFields(log.Fields{
@@ -157,5 +227,8 @@ func (p *PrometheusMetrics) Push() (err error) {
 		"resp": string(body),
 	}).Debug("Received Prometheus response")
 
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("push gateway returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
 	return
 }
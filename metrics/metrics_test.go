@@ -63,6 +63,21 @@ func TestEventString(t *testing.T) {
 	}
 }
 
+func TestEventStringWithout(t *testing.T) {
+	e := &Event{
+		Name: "foo",
+		Labels: map[string]string{
+			"volume":  "baz",
+			"repo_id": "qux",
+		},
+		Value: "bar",
+	}
+	expected := "foo{volume=\"baz\"} bar"
+	if got := e.StringWithout([]string{"repo_id"}); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
+
 func TestNewMetrics(t *testing.T) {
 	p := NewMetrics("foo", "bar", "http://foo:9091")
 
@@ -192,3 +207,29 @@ func TestMetricUpdateEvent(t *testing.T) {
 		t.Fatalf("Expected two events, got %v", len(m.Events))
 	}
 }
+
+func TestWithLabels(t *testing.T) {
+	p := NewMetrics("foo", "bar", "")
+	e := &Event{
+		Name: "foo",
+		Labels: map[string]string{
+			"volume": "bar",
+		},
+		Value: "1",
+	}
+
+	if got := p.withLabels(e); got != e {
+		t.Fatalf("Expected the event itself without labels, got %v", got)
+	}
+
+	p.Labels = map[string]string{
+		"dryrun": "true",
+	}
+	got := p.withLabels(e)
+	if got.Labels["dryrun"] != "true" || got.Labels["volume"] != "bar" || got.Value != "1" {
+		t.Fatalf("Expected labels to be added, got %v", got)
+	}
+	if _, ok := e.Labels["dryrun"]; ok {
+		t.Fatal("Expected the original event to be left unchanged")
+	}
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// registry holds the metrics of all volumes, to serve them together
+var registry struct {
+	sync.Mutex
+	handlers []*PrometheusMetrics
+}
+
+// Register adds the metrics of a volume to the ones served at /metrics
+func Register(p *PrometheusMetrics) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.handlers = append(registry.handlers, p)
+}
+
+// Reset forgets the metrics of all registered volumes,
+// before a new backup run
+func Reset() {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.handlers = nil
+}
+
+// PushAll pushes the metrics of all registered volumes, including the
+// volumes whose backup failed. Metrics are grouped by volume.
+func PushAll() error {
+	registry.Lock()
+	handlers := append([]*PrometheusMetrics(nil), registry.handlers...)
+	registry.Unlock()
+
+	var failed []string
+	for _, p := range handlers {
+		if err := p.Push(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", p.Volume, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to push metrics of volumes %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// WriteTextfile writes the metrics of all registered volumes to file,
+// for the textfile collector of the node exporter. The file is replaced
+// atomically, so the collector never reads a partial file.
+func WriteTextfile(file string) (err error) {
+	registry.Lock()
+	handlers := append([]*PrometheusMetrics(nil), registry.handlers...)
+	registry.Unlock()
+
+	// The temporary file must be on the same filesystem to be renamed
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary metrics file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(exposition(handlers))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write metrics file: %v", err)
+	}
+
+	err = os.Rename(tmp.Name(), file)
+	if err != nil {
+		err = fmt.Errorf("failed to replace metrics file: %v", err)
+	}
+	return
+}
+
+// exposition returns the metrics of the handlers in the Prometheus
+// text exposition format. Events are labeled with their volume.
+func exposition(handlers []*PrometheusMetrics) string {
+	types := make(map[string]string)
+	samples := make(map[string][]string)
+	for _, p := range handlers {
+		volume := map[string]string{
+			"volume": p.Volume,
+		}
+		p.each(func(m *Metric) {
+			if m.Type != "" {
+				types[m.Name] = m.Type
+			}
+			for _, e := range m.Events {
+				s := p.withLabels(e).withLabels(volume).StringWithout(p.DropLabels)
+				samples[m.Name] = append(samples[m.Name], s)
+			}
+		})
+	}
+
+	var names []string
+	for name := range samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		if t, ok := types[name]; ok {
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", name, t)
+		}
+		for _, s := range samples[name] {
+			fmt.Fprintf(&buf, "%s\n", s)
+		}
+	}
+	return buf.String()
+}
+
+// serveMetrics writes the registered metrics
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	registry.Lock()
+	handlers := append([]*PrometheusMetrics(nil), registry.handlers...)
+	registry.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, exposition(handlers))
+}
+
+// Serve starts serving the registered metrics at /metrics on addr.
+// Use the server's Shutdown method to stop it.
+func Serve(addr string) (s *http.Server, err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("failed to listen on %s: %v", addr, err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	s = &http.Server{
+		Handler: mux,
+	}
+	go s.Serve(l)
+	return
+}
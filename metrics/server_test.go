@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	foo := NewMetrics("host", "foo", "")
+	foo.NewMetric("conplicity_backupExitCode", "gauge").UpdateEvent(&Event{
+		Labels: map[string]string{},
+		Value:  "0",
+	})
+	bar := NewMetrics("host", "bar", "")
+	bar.NewMetric("conplicity_backupExitCode", "gauge").UpdateEvent(&Event{
+		Labels: map[string]string{
+			"volume": "bar",
+		},
+		Value: "1",
+	})
+
+	expected := `# TYPE conplicity_backupExitCode gauge
+conplicity_backupExitCode{volume="foo"} 0
+conplicity_backupExitCode{volume="bar"} 1
+`
+	if got := exposition([]*PrometheusMetrics{foo, bar}); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testConplicity")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	Reset()
+	defer Reset()
+	for _, volume := range []string{"foo", "bar"} {
+		p := NewMetrics("host", volume, "")
+		Register(p)
+		p.NewMetric("conplicity_backupExitCode", "gauge").UpdateEvent(&Event{
+			Labels: map[string]string{},
+			Value:  "0",
+		})
+	}
+
+	file := filepath.Join(dir, "conplicity.prom")
+	if err := ioutil.WriteFile(file, []byte("stale"), 0644); err != nil {
+		t.Fatalf("Cannot write metrics file: %v", err)
+	}
+	if err := WriteTextfile(file); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Cannot read metrics file: %v", err)
+	}
+	if n := strings.Count(string(data), "# TYPE conplicity_backupExitCode gauge"); n != 1 {
+		t.Fatalf("Expected a single TYPE line, got %d in %s", n, data)
+	}
+	if !strings.Contains(string(data), `conplicity_backupExitCode{volume="bar"} 0`) {
+		t.Fatalf("Expected the metrics of volume bar, got %s", data)
+	}
+
+	// Only the metrics file is left
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected no temporary file left, got %v, %v", files, err)
+	}
+
+	if err := WriteTextfile(filepath.Join(dir, "missing", "conplicity.prom")); err == nil {
+		t.Fatal("Expected an error writing to a missing directory, got no error")
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	p := NewMetrics("host", "baz", "")
+	Register(p)
+	p.NewMetric("conplicity_lastBackup", "counter").UpdateEvent(&Event{
+		Labels: map[string]string{},
+		Value:  "1488333612",
+	})
+
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Fatalf("Expected text exposition format, got %s", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `conplicity_lastBackup{volume="baz"} 1488333612`) {
+		t.Fatalf("Expected the metrics of volume baz, got %s", body)
+	}
+}
+
+func TestPushAll(t *testing.T) {
+	var paths, bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			t.Errorf("Expected a PUT request, got %s", r.Method)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		paths = append(paths, r.URL.Path)
+		bodies = append(bodies, string(body))
+		if strings.HasSuffix(r.URL.Path, "/volume/broken") {
+			http.Error(w, "bad metrics", http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	Reset()
+
+	p := NewMetrics("host", "qux", ts.URL)
+	Register(p)
+	p.NewMetric("conplicity_backupExitCode", "gauge").UpdateEvent(&Event{
+		Labels: map[string]string{
+			"volume": "qux",
+		},
+		Value: "2",
+	})
+
+	if err := PushAll(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/metrics/job/conplicity/instance/host/volume/qux" {
+		t.Fatalf("Expected a push for volume qux, got %v", paths)
+	}
+	expected := "# TYPE conplicity_backupExitCode gauge\nconplicity_backupExitCode{volume=\"qux\"} 2\n\n"
+	if bodies[0] != expected {
+		t.Fatalf("Expected body %q, got %q", expected, bodies[0])
+	}
+
+	Register(NewMetrics("host", "broken", ts.URL))
+	err := PushAll()
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Expected an error for volume broken, got %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	Register(NewMetrics("host", "foo", ""))
+	Reset()
+
+	registry.Lock()
+	defer registry.Unlock()
+	if len(registry.handlers) != 0 {
+		t.Fatalf("Expected no registered metrics after reset, got %d", len(registry.handlers))
+	}
+}
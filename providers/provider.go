@@ -3,14 +3,16 @@ package providers
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/conplicity/engines"
 	"github.com/camptocamp/conplicity/handler"
 	"github.com/camptocamp/conplicity/volume"
 	"github.com/docker/docker/api/types"
-	docker "github.com/docker/docker/client"
 )
 
 // A Provider is an interface for providers
@@ -30,107 +32,222 @@ type BaseProvider struct {
 	backupDir string
 }
 
-// GetProvider detects which provider suits the passed volume and returns it
+// GetProvider detects which provider suits the passed volume and returns it.
+// The provider label of the volume takes precedence over detection.
 func GetProvider(c *handler.Conplicity, vol *volume.Volume) Provider {
 	v := vol
-	log.WithFields(log.Fields{
-		"volume": v.Name,
-	}).Info("Detecting provider")
+	v.Log().Info("Detecting provider")
 	p := &BaseProvider{
 		handler: c,
 		vol:     v,
 	}
+
+	if v.Config != nil && v.Config.Provider != "" {
+		if provider := newProvider(p, v.Config.Provider); provider != nil {
+			return provider
+		}
+		v.Log().WithFields(log.Fields{
+			"provider": v.Config.Provider,
+		}).Warn("Unknown provider, detecting it instead")
+	}
+
 	if f, err := os.Stat(v.Mountpoint + "/PG_VERSION"); err == nil && f.Mode().IsRegular() {
-		log.WithFields(log.Fields{
-			"volume": v.Name,
-		}).Debug("PG_VERSION file found, this should be a PostgreSQL datadir")
+		v.Log().Debug("PG_VERSION file found, this should be a PostgreSQL datadir")
+		return newProvider(p, "postgresql")
+	} else if f, err := os.Stat(v.Mountpoint + "/mysql"); err == nil && f.Mode().IsDir() {
+		v.Log().Debug("mysql directory found, this should be MySQL datadir")
+		return newProvider(p, "mysql")
+	} else if f, err := os.Stat(v.Mountpoint + "/ibdata1"); err == nil && f.Mode().IsRegular() {
+		v.Log().Debug("ibdata1 file found, this should be MySQL datadir")
+		return newProvider(p, "mysql")
+	} else if f, err := os.Stat(v.Mountpoint + "/DB_CONFIG"); err == nil && f.Mode().IsRegular() {
+		v.Log().Debug("DB_CONFIG file found, this should be and OpenLDAP datadir")
+		return newProvider(p, "openldap")
+	}
+
+	return newProvider(p, "default")
+}
+
+// newProvider returns the provider with the passed name,
+// or nil if there is no such provider
+func newProvider(p *BaseProvider, name string) Provider {
+	switch strings.ToLower(name) {
+	case "postgresql":
 		return &PostgreSQLProvider{
 			BaseProvider: p,
 		}
-	} else if f, err := os.Stat(v.Mountpoint + "/mysql"); err == nil && f.Mode().IsDir() {
-		log.WithFields(log.Fields{
-			"volume": v.Name,
-		}).Debug("mysql directory found, this should be MySQL datadir")
+	case "mysql":
 		return &MySQLProvider{
 			BaseProvider: p,
 		}
-	} else if f, err := os.Stat(v.Mountpoint + "/DB_CONFIG"); err == nil && f.Mode().IsRegular() {
-		log.WithFields(log.Fields{
-			"volume": v.Name,
-		}).Debug("DB_CONFIG file found, this should be and OpenLDAP datadir")
+	case "openldap":
 		return &OpenLDAPProvider{
 			BaseProvider: p,
 		}
+	case "default":
+		return &DefaultProvider{
+			BaseProvider: p,
+		}
 	}
-
-	return &DefaultProvider{
-		BaseProvider: p,
-	}
+	return nil
 }
 
-// PrepareBackup sets up the data before backup
+// PrepareBackup sets up the data before backup. The volume's prepare
+// command runs in a container with the volume mounted, otherwise the
+// provider's dump command runs in the containers using the volume.
+// Database volumes fail when no container could dump them.
 func PrepareBackup(p Provider) (err error) {
 	p.SetVolumeBackupDir()
 
 	c := p.GetHandler()
 	vol := p.GetVolume()
-	containers, err := c.ContainerList(context.Background(), types.ContainerListOptions{})
+
+	if pc := vol.Config.PreCommand; pc != "" {
+		return runPrepareCommand(c, vol, pc)
+	}
+
+	// The run context is canceled when conplicity is asked to stop,
+	// and prepare commands are bounded by the volume's timeout
+	ctx := c.Context()
+	timeout, err := vol.Timeout()
+	if err != nil {
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	containers, err := c.ContainerList(ctx, types.ContainerListOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to list containers: %v", err)
 	}
 
+	interval, err := time.ParseDuration(c.Config.Docker.PollInterval)
+	if err != nil {
+		return fmt.Errorf("failed to parse the parameter 'docker-poll-interval': %v", err)
+	}
+
 	// Work around https://github.com/docker/engine-api/issues/303
-	client, err := docker.NewClient(c.Config.Docker.Endpoint, "", nil, nil)
+	client, err := c.NewDockerClient()
 	if err != nil {
 		return fmt.Errorf("failed to create new Docker client: %v", err)
 	}
 
+	var dumped bool
 	for _, container := range containers {
-		container, err := client.ContainerInspect(context.Background(), container.ID)
+		container, err := client.ContainerInspect(ctx, container.ID)
 		if err != nil {
 			return fmt.Errorf("failed to inspect container %v: %v", container.ID, err)
 		}
 		for _, mount := range container.Mounts {
 			if mount.Name == vol.Name {
-				log.WithFields(log.Fields{
-					"volume":    vol.Name,
+				vol.Log().WithFields(log.Fields{
 					"container": container.ID,
 				}).Debug("Container found using volume")
 
 				cmd := p.GetPrepareCommand(&mount)
-				if cmd != nil {
-					exec, err := client.ContainerExecCreate(context.Background(), container.ID, types.ExecConfig{
-						Cmd: p.GetPrepareCommand(&mount),
+				if cmd != nil && c.Config.DryRun {
+					vol.Log().WithFields(log.Fields{
+						"container": container.ID,
+						"command":   strings.Join(cmd, " "),
+					}).Info("Dry run, not executing prepare command")
+					dumped = true
+				} else if cmd != nil {
+					exec, err := client.ContainerExecCreate(ctx, container.ID, types.ExecConfig{
+						Cmd: cmd,
 					},
 					)
 					if err != nil {
 						return fmt.Errorf("failed to create exec: %v", err)
 					}
 
-					err = client.ContainerExecStart(context.Background(), exec.ID, types.ExecStartCheck{})
+					err = client.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{})
 					if err != nil {
 						return fmt.Errorf("failed to start exec: %v", err)
 					}
 
-					inspect, err := client.ContainerExecInspect(context.Background(), exec.ID)
+					code, err := waitExec(ctx, client, exec.ID, interval)
 					if err != nil {
 						return fmt.Errorf("failed to check prepare command exit code: %v", err)
 					}
-					if c := inspect.ExitCode; c != 0 {
-						return fmt.Errorf("prepare command exited with code %v", c)
+					if code != 0 {
+						return fmt.Errorf("prepare command exited with code %v", code)
 					}
+					dumped = true
 				} else {
-					log.WithFields(log.Fields{
-						"volume":    vol.Name,
+					vol.Log().WithFields(log.Fields{
 						"container": container.ID,
 					}).Info("No prepare command to execute in container")
 				}
 			}
 		}
 	}
+
+	// The data files of a database are not consistent, only its dump is
+	if !dumped && isDatabase(p) {
+		return fmt.Errorf("no running container uses the %s volume %s to dump it, set the io.conplicity.precommand label to dump it otherwise", p.GetName(), vol.Name)
+	}
 	return
 }
 
+// isDatabase tells whether the provider's volumes are only backed up
+// through a dump, i.e. whether it has a prepare command
+func isDatabase(p Provider) bool {
+	return p.GetPrepareCommand(&types.MountPoint{}) != nil
+}
+
+// runPrepareCommand runs the volume's prepare command with sh -c in a
+// container of the hook image, with the volume mounted at its backup path
+func runPrepareCommand(c *handler.Conplicity, vol *volume.Volume, command string) (err error) {
+	vol.Log().WithFields(log.Fields{
+		"command": command,
+	}).Info("Running prepare command")
+	// LaunchContainer bounds the command by the volume's timeout,
+	// and only logs it in dry run mode
+	state, _, stderr, err := engines.LaunchContainer(
+		c, vol, c.Config.HookImage,
+		[]string{"sh", "-c", command},
+		[]string{vol.MountSource() + ":" + vol.ContainerPath()},
+		[]string{
+			"CONPLICITY_VOLUME=" + vol.Name,
+			"CONPLICITY_VOLUME_PATH=" + vol.ContainerPath(),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to launch prepare command: %v", err)
+	}
+	if state != 0 {
+		err = fmt.Errorf("prepare command exited with state %v: %s", state, strings.TrimSpace(stderr))
+	}
+	return
+}
+
+// execInspector inspects execs
+type execInspector interface {
+	ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error)
+}
+
+// waitExec inspects the exec every interval until it finished,
+// and returns its exit code. It gives up when the context is done.
+func waitExec(ctx context.Context, cli execInspector, id string, interval time.Duration) (code int, err error) {
+	for {
+		inspect, err := cli.ContainerExecInspect(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("stopped waiting for exec %s: %v", id, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
 // GetHandler returns the handler associated with the provider
 func (p *BaseProvider) GetHandler() *handler.Conplicity {
 	return p.handler
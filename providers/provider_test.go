@@ -2,8 +2,14 @@ package providers
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/camptocamp/conplicity/config"
@@ -90,6 +96,7 @@ func TestPrepareBackup(t *testing.T) {
 					Driver:     "local",
 					Mountpoint: "/mnt",
 				},
+				Config: &volume.Config{},
 			},
 		},
 	}
@@ -98,6 +105,7 @@ func TestPrepareBackup(t *testing.T) {
 	p.handler.Config = &config.Config{} // Init Config
 	p.handler.Config.Duplicity.Image = "camptocamp/duplicity:latest"
 	p.handler.Config.Docker.Endpoint = "unix:///var/run/docker.sock"
+	p.handler.Config.Docker.PollInterval = "1s"
 	p.handler.Hostname, _ = os.Hostname()
 	p.handler.SetupDocker()
 
@@ -110,6 +118,44 @@ func TestPrepareBackup(t *testing.T) {
 	}
 }
 
+func TestPrepareBackupDatabaseNotRunning(t *testing.T) {
+	// No container uses the volume
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	c := &handler.Conplicity{
+		Config: &config.Config{},
+	}
+	c.Config.Docker.Endpoint = "tcp://" + strings.TrimPrefix(ts.URL, "http://")
+	c.Config.Docker.PollInterval = "1s"
+	cli, err := c.NewDockerClient()
+	if err != nil {
+		t.Fatalf("Failed to create Docker client: %v", err)
+	}
+	c.Client = cli
+
+	vol := &volume.Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		Config: &volume.Config{},
+	}
+	base := &BaseProvider{
+		handler: c,
+		vol:     vol,
+	}
+
+	if err := PrepareBackup(&DefaultProvider{BaseProvider: base}); err != nil {
+		t.Fatalf("Expected no error for a files volume, got %v", err)
+	}
+	if err := PrepareBackup(&PostgreSQLProvider{BaseProvider: base}); err == nil {
+		t.Fatal("Expected an error for a database volume which could not be dumped, got nil")
+	}
+}
+
 func TestBaseGetHandler(t *testing.T) {
 	expected := ""
 
@@ -125,13 +171,90 @@ func TestBaseGetHandler(t *testing.T) {
 func TestBaseGetVolume(t *testing.T) {
 	got := (&BaseProvider{}).GetVolume()
 	if got != nil {
-		t.Fatalf("Expected to get nil, got %s", got)
+		t.Fatalf("Expected to get nil, got %v", got)
 	}
 }
 
 func TestBaseGetBackupDir(t *testing.T) {
 	got := (&BaseProvider{}).GetBackupDir()
 	if got != "" {
-		t.Fatalf("Expected to get nil, got %s", got)
+		t.Fatalf("Expected to get nil, got %v", got)
+	}
+}
+
+func TestGetProviderFromLabel(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "test_get_provider_label")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/PG_VERSION", []byte{}, 0644)
+
+	vol := &volume.Volume{
+		Volume: &types.Volume{
+			Mountpoint: dir,
+		},
+		Config: &volume.Config{
+			Provider: "MySQL",
+		},
+	}
+	if got := GetProvider(&handler.Conplicity{}, vol).GetName(); got != "MySQL" {
+		t.Fatalf("Expected provider MySQL, got %s", got)
+	}
+
+	// Unknown providers fall back to detection
+	vol.Config.Provider = "foo"
+	if got := GetProvider(&handler.Conplicity{}, vol).GetName(); got != "PostgreSQL" {
+		t.Fatalf("Expected provider PostgreSQL, got %s", got)
+	}
+}
+
+func TestGetProviderInnoDB(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "test_get_provider_innodb")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/ibdata1", []byte{}, 0644)
+
+	p := GetProvider(&handler.Conplicity{}, &volume.Volume{
+		Volume: &types.Volume{
+			Mountpoint: dir,
+		}})
+	if got := p.GetName(); got != "MySQL" {
+		t.Fatalf("Expected provider MySQL, got %s", got)
+	}
+}
+
+// fakeExecInspector reports an exec running for a number of inspections
+type fakeExecInspector struct {
+	running  int
+	exitCode int
+}
+
+func (f *fakeExecInspector) ContainerExecInspect(ctx context.Context, id string) (types.ContainerExecInspect, error) {
+	if f.running > 0 {
+		f.running--
+		return types.ContainerExecInspect{Running: true}, nil
+	}
+	return types.ContainerExecInspect{ExitCode: f.exitCode}, nil
+}
+
+func TestWaitExec(t *testing.T) {
+	cli := &fakeExecInspector{running: 2, exitCode: 3}
+	code, err := waitExec(context.Background(), cli, "foo", time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if code != 3 {
+		t.Fatalf("Expected exit code 3, got %d", code)
+	}
+	if cli.running != 0 {
+		t.Fatal("Expected to wait for the exec to finish")
+	}
+
+	// Execs running past the deadline are not waited for
+	cli = &fakeExecInspector{running: 1000}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := waitExec(ctx, cli, "foo", time.Millisecond); err == nil {
+		t.Fatal("Expected an error once the context is done, got nil")
+	}
+	if cli.running == 0 {
+		t.Fatal("Expected to stop waiting before the exec finished")
 	}
 }
@@ -0,0 +1,72 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Mailer sends run summaries through an SMTP server.
+// STARTTLS is used when the server supports it.
+type Mailer struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+// emailMessage returns the email summarizing the run, with a table of
+// the volume results followed by the errors of failed volumes
+func (r *Run) emailMessage(from string, to []string) []byte {
+	title, results := r.Summary()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", title)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(&buf, "%s\r\n\r\n", title)
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprint(w, "VOLUME\tENGINE\tSTATUS\tDURATION\r\n")
+	for _, res := range results {
+		status := "success"
+		if !res.Success {
+			status = "FAILURE"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\r\n", res.Volume, res.Engine, status, res.Elapsed())
+	}
+	w.Flush()
+
+	for _, res := range results {
+		if !res.Success {
+			fmt.Fprintf(&buf, "\r\n%s: %s\r\n", res.Volume, res.Error)
+		}
+	}
+	return buf.Bytes()
+}
+
+// SendEmail sends the summary of the run by email
+func (r *Run) SendEmail(m *Mailer) (err error) {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %s: %v", m.Addr, err)
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	err = smtp.SendMail(m.Addr, auth, m.From, m.To, r.emailMessage(m.From, m.To))
+	if err != nil {
+		err = fmt.Errorf("failed to send email: %v", err)
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package report
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP accepts a single mail and sends its data on the returned channel
+func fakeSMTP(t *testing.T) (addr string, data chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	data = make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) {
+			conn.Write([]byte(s + "\r\n"))
+		}
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				reply("250 OK")
+			case "DATA":
+				reply("354 Go ahead")
+				var msg []string
+				for {
+					l, _ := r.ReadString('\n')
+					if l == ".\r\n" {
+						break
+					}
+					msg = append(msg, l)
+				}
+				data <- strings.Join(msg, "")
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), data
+}
+
+func TestSendEmail(t *testing.T) {
+	addr, data := fakeSMTP(t)
+
+	run := NewRun("host")
+	ok := NewBackupResult("foo")
+	ok.Engine = "restic"
+	ok.Finish(nil)
+	run.Add(ok)
+	ko := NewBackupResult("bar")
+	ko.Engine = "duplicity"
+	ko.Finish(errors.New("failed to backup volume: exit code 1"))
+	run.Add(ko)
+
+	err := run.SendEmail(&Mailer{
+		Addr: addr,
+		From: "conplicity@example.com",
+		To:   []string{"ops@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	msg := <-data
+	for _, e := range []string{
+		"To: ops@example.com\r\n",
+		"Subject: Backup of host: 2 volume(s), 1 failure(s)\r\n",
+		"bar     duplicity  FAILURE  0s\r\n",
+		"foo     restic     success  0s\r\n",
+		"bar: failed to backup volume: exit code 1\r\n",
+	} {
+		if !strings.Contains(msg, e) {
+			t.Fatalf("Expected %q in message, got %q", e, msg)
+		}
+	}
+	if strings.Index(msg, "bar ") > strings.Index(msg, "foo ") {
+		t.Fatalf("Expected failed volumes first, got %q", msg)
+	}
+}
+
+func TestSendEmailError(t *testing.T) {
+	err := NewRun("host").SendEmail(&Mailer{
+		Addr:     "localhost",
+		Username: "foo",
+	})
+	if err == nil {
+		t.Fatal("Expected an error for an address without port, got nil")
+	}
+}
@@ -0,0 +1,120 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// BackupResult is the outcome of a volume backup
+type BackupResult struct {
+	Volume    string    `json:"volume"`
+	Project   string    `json:"project,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	Engine    string    `json:"engine,omitempty"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Duration  float64   `json:"duration"`
+}
+
+// Run is the summary of a backup run
+type Run struct {
+	Hostname        string          `json:"hostname"`
+	StartTime       time.Time       `json:"start_time"`
+	EndTime         time.Time       `json:"end_time"`
+	Results         []*BackupResult `json:"results"`
+	Failures        int             `json:"failures"`
+	PostRunExitCode *int            `json:"post_run_exit_code,omitempty"`
+
+	mutex sync.Mutex
+}
+
+// NewRun returns a new Run for a host, starting now
+func NewRun(hostname string) *Run {
+	return &Run{
+		Hostname:  hostname,
+		StartTime: time.Now(),
+	}
+}
+
+// Add adds a volume backup result to the run.
+// It is safe to call from concurrent backups.
+func (r *Run) Add(res *BackupResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Results = append(r.Results, res)
+	if !res.Success {
+		r.Failures++
+	}
+}
+
+// FailedVolumes returns the volumes whose backup failed
+func (r *Run) FailedVolumes() (vols []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, res := range r.Results {
+		if !res.Success {
+			vols = append(vols, res.Volume)
+		}
+	}
+	return
+}
+
+// Summary returns the headline of the run and the results of its
+// volumes, failed volumes first. Notifiers build their messages from it.
+func (r *Run) Summary() (title string, results []*BackupResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	title = fmt.Sprintf("Backup of %s: %d volume(s), %d failure(s)", r.Hostname, len(r.Results), r.Failures)
+	for _, res := range r.Results {
+		if !res.Success {
+			results = append(results, res)
+		}
+	}
+	for _, res := range r.Results {
+		if res.Success {
+			results = append(results, res)
+		}
+	}
+	return
+}
+
+// Finish marks the run as ended
+func (r *Run) Finish() {
+	r.EndTime = time.Now()
+}
+
+// NewBackupResult returns a new BackupResult for a volume, starting now
+func NewBackupResult(volume string) *BackupResult {
+	return &BackupResult{
+		Volume:    volume,
+		StartTime: time.Now(),
+	}
+}
+
+// Finish marks the backup as ended, successful unless err is not nil
+func (r *BackupResult) Finish(err error) {
+	r.EndTime = time.Now()
+	r.Duration = r.EndTime.Sub(r.StartTime).Seconds()
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Elapsed returns the duration of the backup, rounded to the second
+func (r *BackupResult) Elapsed() time.Duration {
+	return time.Duration(r.Duration+0.5) * time.Second
+}
+
+// WriteJSON writes the result as a single JSON line
+func (r *BackupResult) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
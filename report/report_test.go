@@ -0,0 +1,79 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFinish(t *testing.T) {
+	r := NewBackupResult("foo")
+	r.Finish(nil)
+	if !r.Success {
+		t.Fatal("Expected backup to be successful")
+	}
+	if r.EndTime.Before(r.StartTime) {
+		t.Fatalf("Expected end time after start time, got %v < %v", r.EndTime, r.StartTime)
+	}
+
+	r = NewBackupResult("foo")
+	r.Finish(errors.New("failed to backup volume"))
+	if r.Success {
+		t.Fatal("Expected backup to have failed")
+	}
+	if r.Error != "failed to backup volume" {
+		t.Fatalf("Expected error to be recorded, got %v", r.Error)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	for _, v := range []string{"foo", "bar"} {
+		r := NewBackupResult(v)
+		r.Engine = "Restic"
+		r.Finish(nil)
+		if err := r.WriteJSON(&buf); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %v", len(lines))
+	}
+
+	var got BackupResult
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil {
+		t.Fatalf("Failed to decode JSON line: %v", err)
+	}
+	if got.Volume != "bar" || got.Engine != "Restic" || !got.Success {
+		t.Fatalf("Unexpected result: %+v", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	run := NewRun("foo")
+
+	r := NewBackupResult("bar")
+	r.Finish(nil)
+	run.Add(r)
+
+	r = NewBackupResult("baz")
+	r.Finish(errors.New("failed to backup volume"))
+	run.Add(r)
+
+	run.Finish()
+
+	if len(run.Results) != 2 {
+		t.Fatalf("Expected 2 results, got %v", len(run.Results))
+	}
+	if run.Failures != 1 {
+		t.Fatalf("Expected 1 failure, got %v", run.Failures)
+	}
+	if failed := run.FailedVolumes(); len(failed) != 1 || failed[0] != "baz" {
+		t.Fatalf("Expected volume baz to have failed, got %v", failed)
+	}
+}
@@ -0,0 +1,92 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// slackMessage is the payload of a Slack incoming webhook
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// slackAttachment describes the result of a volume backup
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title"`
+	Text     string       `json:"text,omitempty"`
+	Fields   []slackField `json:"fields"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// slackMessage returns the Slack message summarizing the run.
+// Failed volumes come first, with their error.
+func (r *Run) slackMessage() *slackMessage {
+	title, results := r.Summary()
+	msg := &slackMessage{
+		Text: ":white_check_mark: " + title,
+	}
+
+	for _, res := range results {
+		a := slackAttachment{
+			Title: res.Volume,
+			Fields: []slackField{
+				{Title: "Engine", Value: res.Engine, Short: true},
+				{Title: "Duration", Value: res.Elapsed().String(), Short: true},
+			},
+		}
+		if res.Success {
+			a.Color = "good"
+			a.Fallback = fmt.Sprintf("%s: success", res.Volume)
+		} else {
+			msg.Text = ":x: " + title
+			a.Color = "danger"
+			a.Text = res.Error
+			a.Fallback = fmt.Sprintf("%s: failure (%s)", res.Volume, res.Error)
+		}
+		msg.Attachments = append(msg.Attachments, a)
+	}
+	return msg
+}
+
+// NotifySlack posts the summary of the run to a Slack incoming webhook
+func (r *Run) NotifySlack(webhookURL string) (err error) {
+	data, err := json.Marshal(r.slackMessage())
+	if err != nil {
+		err = fmt.Errorf("failed to encode Slack message: %v", err)
+		return
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		err = fmt.Errorf("failed to get HTTP response: %v", err)
+		return
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to read HTTP response: %v", err)
+		return
+	}
+
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("Slack returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotifySlack(t *testing.T) {
+	var got map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected JSON content type, got %s", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("Failed to decode payload: %v", err)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	run := NewRun("host")
+	ok := NewBackupResult("foo")
+	ok.Engine = "restic"
+	ok.Finish(nil)
+	run.Add(ok)
+	ko := NewBackupResult("bar")
+	ko.Engine = "duplicity"
+	ko.Finish(errors.New("failed to backup volume: exit code 1"))
+	run.Add(ko)
+
+	if err := run.NotifySlack(ts.URL); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if text, _ := got["text"].(string); !strings.Contains(text, "host: 2 volume(s), 1 failure(s)") {
+		t.Fatalf("Unexpected text: %v", got["text"])
+	}
+	attachments, _ := got["attachments"].([]interface{})
+	if len(attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %v", got["attachments"])
+	}
+	first := attachments[0].(map[string]interface{})
+	if first["title"] != "bar" || first["color"] != "danger" || first["text"] != "failed to backup volume: exit code 1" {
+		t.Fatalf("Expected the failure first, got %v", first)
+	}
+	fields, _ := first["fields"].([]interface{})
+	if len(fields) != 2 || fields[0].(map[string]interface{})["value"] != "duplicity" {
+		t.Fatalf("Expected engine and duration fields, got %v", first["fields"])
+	}
+	if second := attachments[1].(map[string]interface{}); second["title"] != "foo" || second["color"] != "good" {
+		t.Fatalf("Expected the success second, got %v", second)
+	}
+}
+
+func TestNotifySlackError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	err := NewRun("host").NotifySlack(ts.URL)
+	if err == nil || !strings.Contains(err.Error(), "invalid_token") {
+		t.Fatalf("Expected the Slack error, got %v", err)
+	}
+}
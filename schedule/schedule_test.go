@@ -0,0 +1,71 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInterval(t *testing.T) {
+	s, err := Parse("6h")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	now := time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)
+	if next := s.Next(now); !next.Equal(now.Add(6 * time.Hour)) {
+		t.Fatalf("Expected next run in 6h, got %v", next)
+	}
+
+	if _, err := Parse("-1h"); err == nil {
+		t.Fatal("Expected an error for a negative interval, got nil")
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	// Wednesday
+	now := time.Date(2017, 3, 1, 2, 30, 15, 0, time.UTC)
+	for spec, expected := range map[string]time.Time{
+		"0 2 * * *":      time.Date(2017, 3, 2, 2, 0, 0, 0, time.UTC),
+		"*/15 * * * *":   time.Date(2017, 3, 1, 2, 45, 0, 0, time.UTC),
+		"31 2 * * *":     time.Date(2017, 3, 1, 2, 31, 0, 0, time.UTC),
+		"0 3-5 * * *":    time.Date(2017, 3, 1, 3, 0, 0, 0, time.UTC),
+		"0 0 * * 0":      time.Date(2017, 3, 5, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 7":      time.Date(2017, 3, 5, 0, 0, 0, 0, time.UTC),
+		"0 0 1 * *":      time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 1,15 * *":   time.Date(2017, 3, 15, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":     time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 0 10 * 5":     time.Date(2017, 3, 3, 0, 0, 0, 0, time.UTC), // Friday before the 10th
+		"0 12 * 6-8 1-5": time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+	} {
+		s, err := Parse(spec)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", spec, err)
+		}
+		if next := s.Next(now); !next.Equal(expected) {
+			t.Fatalf("Expected next run of %s at %v, got %v", spec, expected, next)
+		}
+	}
+
+	s, _ := Parse("0 0 31 2 *")
+	if next := s.Next(now); !next.IsZero() {
+		t.Fatalf("Expected no next run for an impossible date, got %v", next)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"daily",
+		"0 2 * *",
+		"60 2 * * *",
+		"0 24 * * *",
+		"0 0 0 * *",
+		"0 0 * 13 *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", spec)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// dockerHubServer is the key of Docker Hub credentials in docker config files
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// registryHost returns the registry of an image, empty for Docker Hub
+func registryHost(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return ""
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return ""
+	}
+	return host
+}
+
+// normalizeRegistryHost returns host, empty for the names of Docker Hub
+func normalizeRegistryHost(host string) string {
+	switch host = strings.TrimSuffix(host, "/"); host {
+	case "docker.io", "index.docker.io", strings.TrimSuffix(dockerHubServer, "/"):
+		return ""
+	}
+	return host
+}
+
+// RegistryAuth returns the encoded credentials pulling image: the given
+// user name and password when the image comes from the registry at host
+// (Docker Hub when empty), else the credentials of the image's registry in
+// the docker config file at configPath. It is empty for anonymous pulls.
+func RegistryAuth(username, password, host, configPath, image string) (auth string, err error) {
+	server := registryHost(image)
+	if server == "" {
+		server = dockerHubServer
+	}
+
+	// Never send the credentials of a registry to another one
+	if normalizeRegistryHost(host) != normalizeRegistryHost(registryHost(image)) {
+		username, password = "", ""
+	}
+
+	if username == "" && configPath != "" {
+		username, password, err = configCredentials(configPath, server)
+		if err != nil {
+			return "", fmt.Errorf("failed to read registry credentials: %v", err)
+		}
+	}
+	if username == "" {
+		return "", nil
+	}
+
+	log.WithFields(log.Fields{
+		"image":    image,
+		"registry": server,
+		"username": username,
+	}).Debug("Authenticating to registry")
+
+	data, err := json.Marshal(types.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: server,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode registry credentials: %v", err)
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// configCredentials returns the credentials of server in a docker config file
+func configCredentials(path, server string) (username, password string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var config struct {
+		Auths map[string]types.AuthConfig `json:"auths"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		err = fmt.Errorf("invalid docker config file %s: %v", path, err)
+		return
+	}
+
+	for key, a := range config.Auths {
+		host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://"), "/")
+		if key != server && host != server {
+			continue
+		}
+		if a.Username != "" {
+			return a.Username, a.Password, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid credentials of %s in %s: %v", key, path, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("invalid credentials of %s in %s", key, path)
+		}
+		return parts[0], parts[1], nil
+	}
+	return
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"golang.org/x/net/context"
+)
+
+func TestRegistryHost(t *testing.T) {
+	for image, expected := range map[string]string{
+		"alpine":                          "",
+		"restic/restic:0.16.0":            "",
+		"registry.example.com/restic":     "registry.example.com",
+		"localhost:5000/backup/restic":    "localhost:5000",
+		"localhost/restic@sha256:abcdef0": "localhost",
+	} {
+		if got := registryHost(image); got != expected {
+			t.Fatalf("Expected registry %q for %s, got %q", expected, image, got)
+		}
+	}
+}
+
+// decodeAuth decodes encoded registry credentials
+func decodeAuth(t *testing.T, auth string) (a types.AuthConfig) {
+	data, err := base64.URLEncoding.DecodeString(auth)
+	if err != nil {
+		t.Fatalf("Failed to decode credentials %s: %v", auth, err)
+	}
+	if err := json.Unmarshal(data, &a); err != nil {
+		t.Fatalf("Failed to decode credentials %s: %v", data, err)
+	}
+	return
+}
+
+func TestRegistryAuth(t *testing.T) {
+	if auth, err := RegistryAuth("", "", "", "", "restic/restic"); err != nil || auth != "" {
+		t.Fatalf("Expected anonymous pulls, got %q, %v", auth, err)
+	}
+
+	auth, err := RegistryAuth("backup", "secret", "registry.example.com", "", "registry.example.com/restic")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if a := decodeAuth(t, auth); a.Username != "backup" || a.Password != "secret" || a.ServerAddress != "registry.example.com" {
+		t.Fatalf("Expected the configured credentials, got %+v", a)
+	}
+
+	// Credentials are not sent to other registries
+	for _, c := range []struct{ host, image string }{
+		{"registry.example.com", "restic/restic"},
+		{"registry.example.com", "other.example.com/restic"},
+		{"", "registry.example.com/restic"},
+	} {
+		if auth, err := RegistryAuth("backup", "secret", c.host, "", c.image); err != nil || auth != "" {
+			t.Fatalf("Expected anonymous pulls of %s with credentials of %q, got %q, %v", c.image, c.host, auth, err)
+		}
+	}
+	if auth, err := RegistryAuth("backup", "secret", "docker.io", "", "restic/restic"); err != nil || decodeAuth(t, auth).Username != "backup" {
+		t.Fatalf("Expected the configured credentials for Docker Hub, got %q, %v", auth, err)
+	}
+
+	f, err := ioutil.TempFile("", "conplicity-docker-config")
+	if err != nil {
+		t.Fatalf("Failed to create docker config file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("hub:hubsecret")) + `"},
+		"registry.example.com": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("ci:cisecret")) + `"}
+	}}`)
+	f.Close()
+
+	for image, username := range map[string]string{
+		"restic/restic":               "hub",
+		"registry.example.com/restic": "ci",
+		"other.example.com/restic":    "",
+	} {
+		auth, err := RegistryAuth("", "", "", f.Name(), image)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", image, err)
+		}
+		if username == "" {
+			if auth != "" {
+				t.Fatalf("Expected anonymous pulls for %s, got %s", image, auth)
+			}
+			continue
+		}
+		if a := decodeAuth(t, auth); a.Username != username || a.Password != username+"secret" {
+			t.Fatalf("Expected the credentials of %s for %s, got %+v", username, image, a)
+		}
+	}
+
+	if _, err := RegistryAuth("", "", "", f.Name()+".missing", "restic/restic"); err == nil {
+		t.Fatal("Expected an error for a missing docker config file, got no error")
+	}
+}
+
+func TestPullImageAuth(t *testing.T) {
+	var pulled bool
+	var authHeader string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			pulled = true
+			authHeader = r.Header.Get("X-Registry-Auth")
+			w.Write([]byte(`{"status":"Pull complete","id":"aaa"}`))
+		case strings.HasSuffix(r.URL.Path, "/json") && pulled:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"Id": "sha256:aaa", "RepoDigests": ["registry.example.com/restic@sha256:bbb"]}`))
+		default:
+			http.Error(w, `{"message": "no such image"}`, http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := docker.NewClient("tcp://"+strings.TrimPrefix(ts.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create Docker client: %v", err)
+	}
+
+	auth, _ := RegistryAuth("backup", "secret", "registry.example.com", "", "registry.example.com/restic")
+	digest, err := PullImage(context.Background(), cli, "registry.example.com/restic", false, auth)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if digest != "sha256:bbb" {
+		t.Fatalf("Expected digest sha256:bbb, got %s", digest)
+	}
+	if authHeader != auth {
+		t.Fatalf("Expected the registry credentials in the X-Registry-Auth header, got %q", authHeader)
+	}
+}
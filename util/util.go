@@ -1,9 +1,12 @@
 package util
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math/rand"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -49,34 +52,149 @@ func GetVolumeLabel(vol *types.Volume, key string) (value string, err error) {
 	return
 }
 
-// PullImage pulls an image from the registry
-func PullImage(c *docker.Client, image string) (err error) {
-	if _, _, err = c.ImageInspectWithRaw(context.Background(), image); err != nil {
-		// TODO: output pull to logs
+// PullImage pulls an image from the registry unless it is already present
+// and force is false, and returns its digest. auth holds the encoded
+// registry credentials, see RegistryAuth. The pull stops when ctx is done.
+func PullImage(ctx context.Context, c *docker.Client, image string, force bool, auth string) (digest string, err error) {
+	img, _, err := c.ImageInspectWithRaw(ctx, image)
+	if err != nil || force {
 		log.WithFields(log.Fields{
 			"image": image,
 		}).Info("Pulling image")
-		resp, err := c.ImagePull(context.Background(), image, types.ImagePullOptions{})
+		resp, err := c.ImagePull(ctx, image, types.ImagePullOptions{
+			RegistryAuth: auth,
+		})
 		if err != nil {
 			log.Errorf("ImagePull returned an error: %v", err)
-			return err
+			return "", err
 		}
 		defer resp.Close()
-		body, err := ioutil.ReadAll(resp)
+		if err := logPullProgress(resp, image); err != nil {
+			return "", fmt.Errorf("failed to pull image %s: %v", image, err)
+		}
+
+		img, _, err = c.ImageInspectWithRaw(ctx, image)
 		if err != nil {
-			log.Errorf("Failed to read from ImagePull response: %v", err)
-			return err
+			return "", fmt.Errorf("failed to inspect pulled image: %v", err)
 		}
-		log.Debugf("Pull image response body: %v", string(body))
 	} else {
 		log.WithFields(log.Fields{
 			"image": image,
 		}).Debug("Image already pulled, not pulling")
 	}
 
+	return imageDigest(image, img), nil
+}
+
+// pullMessage is a message of the progress stream of an image pull
+type pullMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+// layerProgress is the progress of the pull of an image layer
+type layerProgress struct {
+	current, total int64
+	done           bool
+}
+
+// pullProgressInterval is the minimum time between two progress logs of a pull
+var pullProgressInterval = 5 * time.Second
+
+// logPullProgress decodes the progress stream of the pull of image and logs
+// the number of pulled layers and the downloaded percentage, throttled to
+// one line every pullProgressInterval. Errors reported in the stream are returned.
+func logPullProgress(r io.Reader, image string) error {
+	layers := map[string]*layerProgress{}
+	var last time.Time
+
+	dec := json.NewDecoder(r)
+	for {
+		var m pullMessage
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to decode pull progress: %v", err)
+		}
+		if m.Error != "" {
+			return errors.New(m.Error)
+		}
+		log.Debugf("Pull progress of %s: %s %s", image, m.ID, m.Status)
+
+		l, ok := layers[m.ID]
+		switch m.Status {
+		case "Pulling fs layer", "Waiting", "Downloading", "Verifying Checksum",
+			"Download complete", "Extracting", "Pull complete", "Already exists":
+			if !ok {
+				l = &layerProgress{}
+				layers[m.ID] = l
+			}
+		default:
+			// Not a layer, e.g. the final status of the pull
+			continue
+		}
+		switch m.Status {
+		case "Downloading":
+			l.current, l.total = m.Progress.Current, m.Progress.Total
+		case "Download complete", "Extracting":
+			l.current = l.total
+		case "Pull complete", "Already exists":
+			l.current, l.done = l.total, true
+		}
+
+		if time.Since(last) < pullProgressInterval {
+			continue
+		}
+		last = time.Now()
+		logLayers(image, layers)
+	}
+	if len(layers) > 0 {
+		logLayers(image, layers)
+	}
 	return nil
 }
 
+// logLayers logs the progress of the pull of the layers of image
+func logLayers(image string, layers map[string]*layerProgress) {
+	var done int
+	var current, total int64
+	for _, l := range layers {
+		if l.done {
+			done++
+		}
+		current += l.current
+		total += l.total
+	}
+
+	fields := log.Fields{
+		"image":  image,
+		"layers": fmt.Sprintf("%d/%d", done, len(layers)),
+	}
+	if total > 0 {
+		fields["downloaded"] = fmt.Sprintf("%d%%", current*100/total)
+	}
+	log.WithFields(fields).Info("Pull progress")
+}
+
+// imageDigest returns the digest of an image: the digest pinned in its
+// reference, else its registry digest, else its ID for local images
+func imageDigest(image string, img types.ImageInspect) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[i+1:]
+	}
+	for _, d := range img.RepoDigests {
+		if i := strings.Index(d, "@"); i >= 0 {
+			return d[i+1:]
+		}
+	}
+	return img.ID
+}
+
 // RemoveContainer removes a container
 func RemoveContainer(c *docker.Client, id string) {
 	log.WithFields(log.Fields{
@@ -89,21 +207,75 @@ func RemoveContainer(c *docker.Client, id string) {
 	CheckErr(err, "Failed to remove container "+id+": %v", "error")
 }
 
-// Retry retry on error
+// PermanentError is an error which must not be retried
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// sleep waits between attempts, it is replaced in tests
+var sleep = time.Sleep
+
+// maxBackoff caps the delay between attempts
+const maxBackoff = 10 * time.Minute
+
+// Retry retry on error, unless the error is a PermanentError
 func Retry(attempts int, callback func() error) (err error) {
+	return retry(attempts, func(int) time.Duration {
+		return 2 * time.Second
+	}, callback)
+}
+
+// RetryWithBackoff retries on error like Retry, waiting delay after the
+// first attempt then twice as long after each failed attempt, with jitter
+func RetryWithBackoff(attempts int, delay time.Duration, callback func() error) (err error) {
+	return retry(attempts, func(i int) time.Duration {
+		return Backoff(delay, i)
+	}, callback)
+}
+
+// Backoff returns the delay after the failed attempt i (from 0): between
+// half and all of delay*2^i, so that concurrent retries spread out
+func Backoff(delay time.Duration, i int) time.Duration {
+	d := delay
+	for ; i > 0 && d < maxBackoff; i-- {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retry calls callback up to attempts times, waiting delay(i)
+// after the failed attempt i
+func retry(attempts int, delay func(int) time.Duration, callback func() error) (err error) {
 	for i := 0; ; i++ {
 		err = callback()
 		if err == nil {
 			return nil
 		}
 
+		if perr, ok := err.(*PermanentError); ok {
+			return perr.Err
+		}
+
 		if i >= (attempts - 1) {
 			break
 		}
 
-		time.Sleep(2 * time.Second)
-
-		log.Println("retrying...")
+		d := delay(i)
+		log.WithFields(log.Fields{
+			"attempt": i + 1,
+			"delay":   d,
+		}).Infof("Retrying after error: %v", err)
+		sleep(d)
 	}
 	return fmt.Errorf("after %d attempts, last error: %s", attempts, err)
 }
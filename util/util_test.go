@@ -1,9 +1,14 @@
 package util
 
 import (
+	"bytes"
 	"errors"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types"
 )
 
@@ -51,3 +56,144 @@ func TestVolumeLabelNotFound(t *testing.T) {
 		t.Fatalf("Expected %v, got %v", expectedErr, err)
 	}
 }
+
+func TestRetryPermanentError(t *testing.T) {
+	calls := 0
+	fakeErr := errors.New("Fake error")
+	err := Retry(3, func() error {
+		calls++
+		return &PermanentError{Err: fakeErr}
+	})
+	if calls != 1 {
+		t.Fatalf("Expected 1 call, got %v", calls)
+	}
+	if err != fakeErr {
+		t.Fatalf("Expected %v, got %v", fakeErr, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	delay := time.Second
+	prev := time.Duration(0)
+	for i := 0; i < 5; i++ {
+		max := delay << uint(i)
+		d := Backoff(delay, i)
+		if d < max/2 || d > max {
+			t.Fatalf("Expected backoff %d between %v and %v, got %v", i, max/2, max, d)
+		}
+		// The lowest possible delay is the highest possible previous one
+		if d < prev {
+			t.Fatalf("Expected backoff to grow, got %v after %v", d, prev)
+		}
+		prev = d
+	}
+
+	if d := Backoff(time.Hour, 10); d > maxBackoff {
+		t.Fatalf("Expected backoff to be capped to %v, got %v", maxBackoff, d)
+	}
+	if d := Backoff(0, 3); d != 0 {
+		t.Fatalf("Expected no backoff without delay, got %v", d)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	var delays []time.Duration
+	sleep = func(d time.Duration) {
+		delays = append(delays, d)
+	}
+	defer func() {
+		sleep = time.Sleep
+	}()
+
+	calls := 0
+	err := RetryWithBackoff(5, time.Second, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("Fake error")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("Expected retries to stop after success on attempt 3, got %v calls", calls)
+	}
+	if len(delays) != 2 || delays[1] < delays[0] {
+		t.Fatalf("Expected 2 growing delays, got %v", delays)
+	}
+
+	calls = 0
+	err = RetryWithBackoff(2, time.Second, func() error {
+		calls++
+		return errors.New("Fake error")
+	})
+	if err == nil || calls != 2 {
+		t.Fatalf("Expected an error after 2 attempts, got %v after %v calls", err, calls)
+	}
+}
+
+func TestImageDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	img := types.ImageInspect{
+		ID:          "sha256:" + strings.Repeat("b", 64),
+		RepoDigests: []string{"restic/restic@" + digest},
+	}
+
+	if got := imageDigest("restic/restic:0.16.0", img); got != digest {
+		t.Fatalf("Expected the registry digest %s, got %s", digest, got)
+	}
+
+	pinned := "sha256:" + strings.Repeat("c", 64)
+	if got := imageDigest("restic/restic@"+pinned, img); got != pinned {
+		t.Fatalf("Expected the pinned digest %s, got %s", pinned, got)
+	}
+
+	img.RepoDigests = nil
+	if got := imageDigest("local/restic", img); got != img.ID {
+		t.Fatalf("Expected the image ID %s, got %s", img.ID, got)
+	}
+}
+
+func TestLogPullProgress(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	stream := `{"status":"Pulling from restic/restic","id":"latest"}
+{"status":"Already exists","id":"aaa"}
+{"status":"Pulling fs layer","id":"bbb"}
+{"status":"Downloading","progressDetail":{"current":50,"total":200},"id":"bbb"}
+{"status":"Download complete","id":"bbb"}
+{"status":"Pull complete","id":"bbb"}
+{"status":"Status: Downloaded newer image for restic/restic:latest"}
+`
+	if err := logPullProgress(strings.NewReader(stream), "restic/restic:latest"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Only the first message and the summary are logged within the interval
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 progress lines, got %q", out.String())
+	}
+	if last := lines[1]; !strings.Contains(last, `layers="2/2"`) || !strings.Contains(last, `downloaded="100%"`) {
+		t.Fatalf("Expected all layers to be pulled, got %q", last)
+	}
+
+	pullProgressInterval = 0
+	defer func() { pullProgressInterval = 5 * time.Second }()
+	out.Reset()
+	logPullProgress(strings.NewReader(stream), "restic/restic:latest")
+	if n := strings.Count(out.String(), "Pull progress"); n != 6 {
+		t.Fatalf("Expected 6 progress lines without throttling, got %d", n)
+	}
+	if !strings.Contains(out.String(), `downloaded="25%"`) {
+		t.Fatalf("Expected the download percentage, got %q", out.String())
+	}
+
+	err := logPullProgress(strings.NewReader(`{"error":"manifest unknown"}`), "restic/restic:foo")
+	if err == nil || err.Error() != "manifest unknown" {
+		t.Fatalf("Expected the error of the stream, got %v", err)
+	}
+}
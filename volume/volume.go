@@ -1,10 +1,18 @@
 package volume
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -21,27 +29,87 @@ type Volume struct {
 	Target         string
 	BackupDir      string
 	Mount          string
+	MountByName    bool
+	HostPath       bool
 	Config         *Config
 	MetricsHandler *metrics.PrometheusMetrics
 }
 
+// lastBackupFile records the date of the last successful backup in the volume
+const lastBackupFile = ".conplicity_last_backup"
+
+// signatureFile records the signature of the data of the last successful backup
+const signatureFile = ".conplicity_signature"
+
+// composeProjectLabel is set by Docker Compose on the volumes of a project
+const composeProjectLabel = "com.docker.compose.project"
+
+// mountByNamePath is where volumes mounted by name are found in backup containers
+const mountByNamePath = "/backup"
+
 // Config is the volume's configuration parameters
 type Config struct {
 	Engine    string `label:"engine" ini:"engine" config:"Engine"`
 	NoVerify  bool   `label:"no_verify" ini:"no_verify" config:"NoVerify"`
 	Ignore    bool   `label:"ignore" ini:"ignore" default:"false"`
+	Priority  bool   `label:"priority" ini:"priority" default:"false"`
 	TargetURL string `label:"target_url" ini:"target_url" config:"TargetURL"`
+	Timeout   string `label:"timeout" ini:"timeout" config:"Timeout"`
+	Frequency string `label:"frequency" ini:"frequency" config:"Frequency"`
+	Comment   string `label:"comment" ini:"comment" config:"Comment"`
+	// GPGPassphrase enables the encryption of duplicity backups.
+	// Secrets are kept out of the JSON state conplicity backs up.
+	GPGPassphrase string `label:"gpg_passphrase" ini:"gpg_passphrase" config:"GPGPassphrase" json:"-"`
+	EncryptKey    string `label:"encrypt_key" ini:"encrypt_key" config:"EncryptKey" json:"-"`
+	// StopContainers quiesces the containers using the volume during its backup
+	StopContainers bool `label:"stop_containers" ini:"stop_containers" default:"false"`
+	// QuiesceMode is how containers are quiesced: 'pause' (default) or 'stop'
+	QuiesceMode string `label:"quiesce_mode" ini:"quiesce_mode" config:"QuiesceMode"`
+	// Provider forces the provider preparing the data, e.g. postgresql
+	Provider string `label:"provider" ini:"provider"`
+	// PreCommand replaces the provider's prepare command, run with sh -c
+	// in the containers using the volume
+	PreCommand string `label:"precommand" ini:"precommand"`
+	// PreBackupCommand and PostBackupCommand are run with sh -c before and
+	// after the backup, in a container with the volume mounted
+	PreBackupCommand  string `label:"pre_command" ini:"pre_command" config:"PreBackupCommand"`
+	PostBackupCommand string `label:"post_command" ini:"post_command" config:"PostBackupCommand"`
+	// Tags is a comma-separated list of tags of the volume's snapshots
+	Tags string `label:"tags" ini:"tags"`
+	// Excludes is a list of patterns of files not to backup, one per line
+	Excludes string `label:"excludes" ini:"excludes"`
+	// BackupDirs is a comma-separated list of subpaths backed up together
+	BackupDirs string `label:"backup_dirs" ini:"backup_dirs"`
+
+	SkipUnchanged     bool `label:"skip_unchanged" ini:"skip_unchanged" config:"SkipUnchanged"`
+	BackupEmpty       bool `label:"backup_empty" ini:"backup_empty" config:"BackupEmpty"`
+	AllowEngineChange bool `label:"allow_engine_change" ini:"allow_engine_change" config:"AllowEngineChange"`
 
 	Duplicity struct {
 		FullIfOlderThan string `label:"full_if_older_than" ini:"full_if_older_than" config:"FullIfOlderThan"`
 		RemoveOlderThan string `label:"remove_older_than" ini:"remove_older_than" config:"RemoveOlderThan"`
+		// ExtraArgs are appended to the options of duplicity commands
+		ExtraArgs []string `label:"args" ini:"args" config:"ExtraArgs"`
 	} `label:"duplicity" ini:"duplicity" config:"Duplicity"`
 
 	RClone struct {
 	} `label:"rclone" ini:"rclone" config:"RClone"`
 
 	Restic struct {
+		KeepLast    string `label:"keep_last" ini:"keep_last" config:"KeepLast"`
+		KeepDaily   string `label:"keep_daily" ini:"keep_daily" config:"KeepDaily"`
+		KeepWeekly  string `label:"keep_weekly" ini:"keep_weekly" config:"KeepWeekly"`
+		KeepMonthly string `label:"keep_monthly" ini:"keep_monthly" config:"KeepMonthly"`
+		KeepWithin  string `label:"keep_within" ini:"keep_within" config:"KeepWithin"`
 	} `label:"restic" ini:"restic" config:"Restic"`
+
+	Borg struct {
+		KeepLast    string `label:"keep_last" ini:"keep_last" config:"KeepLast"`
+		KeepDaily   string `label:"keep_daily" ini:"keep_daily" config:"KeepDaily"`
+		KeepWeekly  string `label:"keep_weekly" ini:"keep_weekly" config:"KeepWeekly"`
+		KeepMonthly string `label:"keep_monthly" ini:"keep_monthly" config:"KeepMonthly"`
+		KeepWithin  string `label:"keep_within" ini:"keep_within" config:"KeepWithin"`
+	} `label:"borg" ini:"borg" config:"Borg"`
 }
 
 // NewVolume returns a new Volume for a given types.Volume struct
@@ -61,9 +129,148 @@ func NewVolume(v *types.Volume, c *config.Config, h string) *Volume {
 		log.Error(err)
 	}
 
+	for _, d := range c.MountByNameDrivers {
+		if d == v.Driver {
+			vol.MountByName = true
+			break
+		}
+	}
+
+	return vol
+}
+
+// NewHostPathVolume returns a new Volume backing up a host path like
+// a Docker volume named name
+func NewHostPathVolume(name, path string, c *config.Config, h string) *Volume {
+	vol := NewVolume(&types.Volume{
+		Name:       name,
+		Mountpoint: path,
+		Labels:     map[string]string{},
+	}, c, h)
+	vol.HostPath = true
+	vol.MountByName = false
 	return vol
 }
 
+// MountSource returns the source of the volume's binds in backup
+// containers: its name, or its path for host paths
+func (v *Volume) MountSource() string {
+	if v.HostPath {
+		return v.Mountpoint
+	}
+	return v.Name
+}
+
+// IsMountedBy tells whether the mount point is a mount of the volume
+func (v *Volume) IsMountedBy(m types.MountPoint) bool {
+	if v.HostPath {
+		return m.Type == "bind" && m.Source == v.Mountpoint
+	}
+	return m.Name == v.Name
+}
+
+// Log returns a logger adding the name of the volume to the log fields,
+// so that logs can be filtered by volume
+func (v *Volume) Log() *log.Entry {
+	return log.WithField("volume", v.Name)
+}
+
+// ContainerPath returns the path of the volume inside backup containers.
+// Volumes using a remote/plugin driver have no usable host mountpoint,
+// so they are mounted by name on a fixed path instead.
+func (v *Volume) ContainerPath() string {
+	if v.MountByName {
+		return mountByNamePath
+	}
+	return v.Mountpoint
+}
+
+// BackupPaths returns the paths to backup inside backup containers:
+// the backup_dirs subpaths if set, the backup dir otherwise.
+// Missing subpaths are skipped with a warning.
+func (v *Volume) BackupPaths() (paths []string, err error) {
+	if v.Config.BackupDirs == "" {
+		return []string{v.ContainerPath() + "/" + v.BackupDir}, nil
+	}
+
+	for _, dir := range strings.Split(v.Config.BackupDirs, ",") {
+		dir = path.Clean(strings.TrimSpace(dir))
+		if dir == "." {
+			continue
+		}
+		if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+			err = fmt.Errorf("backup dir %s of volume %s is not a subpath of the volume", dir, v.Name)
+			return
+		}
+		// The data of volumes mounted by name is not reachable from the host
+		if !v.MountByName {
+			if _, statErr := os.Stat(v.Mountpoint + "/" + dir); os.IsNotExist(statErr) {
+				v.Log().WithFields(log.Fields{
+					"backup_dir": dir,
+				}).Warning("Backup dir not found in volume, skipping it")
+				continue
+			}
+		}
+		paths = append(paths, v.ContainerPath()+"/"+dir)
+	}
+	if len(paths) == 0 {
+		err = fmt.Errorf("no backup dir found in %s for volume %s", v.Config.BackupDirs, v.Name)
+	}
+	return
+}
+
+// StateFiles returns the modification times of conplicity's state files
+// in the volume, by file name
+func (v *Volume) StateFiles() (files map[string]time.Time) {
+	files = make(map[string]time.Time)
+	if v.MountByName {
+		return
+	}
+
+	infos, err := ioutil.ReadDir(v.Mountpoint)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".conplicity_") {
+			files[info.Name()] = info.ModTime()
+		}
+	}
+	return
+}
+
+// ComposeProject returns the Docker Compose project of the volume, if any
+func (v *Volume) ComposeProject() string {
+	return v.Labels[composeProjectLabel]
+}
+
+// Timeout returns the maximum run time of the volume's backup containers,
+// or 0 if they are not limited
+func (v *Volume) Timeout() (timeout time.Duration, err error) {
+	if v.Config.Timeout == "" {
+		return
+	}
+	timeout, err = time.ParseDuration(v.Config.Timeout)
+	if err != nil {
+		err = fmt.Errorf("failed to parse timeout for volume %s: %v", v.Name, err)
+	}
+	return
+}
+
+// TargetURL returns the URL the volume is backed up to,
+// from its target_url label or the global target URL
+func (v *Volume) TargetURL() (u *url.URL, err error) {
+	u, err = url.Parse(v.Config.TargetURL)
+	if err != nil {
+		err = fmt.Errorf("failed to parse target URL of volume %s: %v", v.Name, err)
+		return
+	}
+	if u.Scheme == "" {
+		err = fmt.Errorf("invalid target URL %q of volume %s: missing scheme", v.Config.TargetURL, v.Name)
+	}
+	return
+}
+
 // LogTime adds a new metric even with the current time
 func (v *Volume) LogTime(event string) (err error) {
 	metricName := fmt.Sprintf("conplicity_%s", event)
@@ -76,15 +283,302 @@ func (v *Volume) LogTime(event string) (err error) {
 			Value: strconv.FormatInt(time.Now().Unix(), 10),
 		},
 	)
+	return
+}
+
+// LogResult records the end of the volume's processing, successful or
+// not, for dead man's switch alerts: its time in conplicity_lastRun and
+// its success (1) or failure (0) in conplicity_success
+func (v *Volume) LogResult(success bool) (err error) {
+	err = v.LogTime("lastRun")
+	if err != nil {
+		return
+	}
+
+	value := "0"
+	if success {
+		value = "1"
+	}
+	metric := v.MetricsHandler.NewMetric("conplicity_success", "gauge")
+	err = metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: value,
+		},
+	)
+	return
+}
+
+// SetLastBackup records a successful backup of the volume,
+// along with the engine used to perform it
+func (v *Volume) SetLastBackup() (err error) {
+	if v.MountByName {
+		return
+	}
+
+	path := v.Mountpoint + "/" + lastBackupFile
+	err = ioutil.WriteFile(path, []byte(v.Config.Engine+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return v.LogBackedUp()
+}
+
+// CheckEngine makes sure the volume's engine did not change since its last
+// backup, as this would orphan the previous backups. A change can be allowed
+// with the allow_engine_change setting.
+func (v *Volume) CheckEngine() (err error) {
+	if v.MountByName {
+		return
+	}
+
+	content, err := ioutil.ReadFile(v.Mountpoint + "/" + lastBackupFile)
+	if err != nil {
+		// Never backed up
+		return nil
+	}
+	lastEngine := strings.TrimSpace(string(content))
+	changed := lastEngine != "" && lastEngine != v.Config.Engine
+
+	value := "0"
+	if changed {
+		value = "1"
+	}
+	metric := v.MetricsHandler.NewMetric("conplicity_engineChanged", "gauge")
+	err = metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: value,
+		},
+	)
+	if err != nil || !changed {
+		return
+	}
+
+	v.Log().WithFields(log.Fields{
+		"last_engine": lastEngine,
+		"engine":      v.Config.Engine,
+	}).Warning("Engine changed since last backup, previous backups will not be rotated nor verified anymore")
+
+	if !v.Config.AllowEngineChange {
+		err = fmt.Errorf("engine changed from %s to %s since last backup, set allow_engine_change to proceed", lastEngine, v.Config.Engine)
+	}
+	return
+}
+
+// IsDue checks whether the volume's backup frequency elapsed since
+// its last successful backup. Volumes without a frequency are always due.
+func (v *Volume) IsDue() (due bool, err error) {
+	if v.Config.Frequency == "" || v.MountByName {
+		return true, nil
+	}
+
+	frequency, err := time.ParseDuration(v.Config.Frequency)
+	if err != nil {
+		err = fmt.Errorf("failed to parse frequency for volume %s: %v", v.Name, err)
+		return
+	}
+
+	due = true
+	if info, err := os.Stat(v.Mountpoint + "/" + lastBackupFile); err == nil {
+		due = !time.Now().Before(info.ModTime().Add(frequency))
+	}
+
+	value := "0"
+	if !due {
+		value = "1"
+	}
+	metric := v.MetricsHandler.NewMetric("conplicity_backupNotDue", "gauge")
+	err = metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: value,
+		},
+	)
+	return
+}
+
+// LogBackedUp sets the conplicity_neverBackedUp metric to 1
+// if the volume was never successfully backed up, 0 otherwise
+func (v *Volume) LogBackedUp() (err error) {
+	// Volumes mounted by name have no local mountpoint to record backups in
+	if v.MountByName {
+		return
+	}
+
+	value := "0"
+	if _, err := os.Stat(v.Mountpoint + "/" + lastBackupFile); os.IsNotExist(err) {
+		value = "1"
+	}
+
+	metric := v.MetricsHandler.NewMetric("conplicity_neverBackedUp", "gauge")
+	err = metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: value,
+		},
+	)
+	return
+}
+
+// IsUnchanged checks whether the data to backup changed since the last
+// successful backup, and returns its current signature
+func (v *Volume) IsUnchanged() (unchanged bool, signature string, err error) {
+	if v.MountByName {
+		return
+	}
+
+	signature, err = v.Signature()
+	if err != nil {
+		return
+	}
+
+	last, _ := ioutil.ReadFile(v.Mountpoint + "/" + signatureFile)
+	unchanged = strings.TrimSpace(string(last)) == signature
+
+	value := "0"
+	if unchanged {
+		value = "1"
+	}
+	metric := v.MetricsHandler.NewMetric("conplicity_volumeUnchanged", "gauge")
+	err = metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: value,
+		},
+	)
+	return
+}
+
+// errNotEmpty stops walking a volume as soon as a file is found
+var errNotEmpty = errors.New("volume is not empty")
+
+// IsEmpty checks whether the data to backup contains no file,
+// ignoring conplicity's own state files
+func (v *Volume) IsEmpty() (empty bool, err error) {
+	if v.MountByName {
+		return
+	}
+
+	root := v.Mountpoint + "/" + v.BackupDir
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(rel, ".conplicity") {
+			return nil
+		}
+		return errNotEmpty
+	})
+	if err == errNotEmpty {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("failed to list files in %s: %v", root, err)
+		return
+	} else {
+		empty = true
+	}
+
+	value := "0"
+	if empty {
+		value = "1"
+	}
+	metric := v.MetricsHandler.NewMetric("conplicity_volumeEmpty", "gauge")
+	err = metric.UpdateEvent(
+		&metrics.Event{
+			Labels: map[string]string{
+				"volume": v.Name,
+			},
+			Value: value,
+		},
+	)
+	return
+}
+
+// Signature returns a hash of the names, sizes, modes and modification times
+// of the files to backup. It is cheap to compute but relies on mtimes being
+// updated when data changes.
+func (v *Volume) Signature() (signature string, err error) {
+	root := v.Mountpoint + "/" + v.BackupDir
+	hash := sha1.New()
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		// Ignore conplicity's own state files, and the root directory
+		// whose modification time they update
+		if rel == "." || strings.HasPrefix(rel, ".conplicity_") {
+			return nil
+		}
+		fmt.Fprintf(hash, "%s\t%d\t%d\t%v\n", rel, info.Size(), info.ModTime().UnixNano(), info.Mode())
+		return nil
+	})
 	if err != nil {
+		err = fmt.Errorf("failed to compute signature of %s: %v", root, err)
 		return
 	}
-	err = v.MetricsHandler.Push()
+	signature = hex.EncodeToString(hash.Sum(nil))
 	return
 }
 
+// SetSignature records the signature of the backed up data
+func (v *Volume) SetSignature(signature string) (err error) {
+	path := v.Mountpoint + "/" + signatureFile
+	err = ioutil.WriteFile(path, []byte(signature+"\n"), 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return
+}
+
+// metricsLabels returns the labels added to all the metrics of the volume,
+// so that they can be sliced by host, engine and storage backend
+func (v *Volume) metricsLabels(c *config.Config, h string) map[string]string {
+	labels := map[string]string{
+		"volume":         v.Name,
+		"engine":         v.Config.Engine,
+		"hostname":       h,
+		"target_backend": targetBackend(v.Config.TargetURL),
+	}
+	if c.DryRun {
+		labels["dryrun"] = "true"
+	}
+	return labels
+}
+
+// targetBackend returns the storage backend of a target URL, e.g. s3 for
+// both s3:s3.amazonaws.com/bucket and s3+http://bucket
+func targetBackend(targetURL string) string {
+	u, err := url.Parse(targetURL)
+	if err != nil || u.Scheme == "" {
+		return "unknown"
+	}
+	return strings.SplitN(u.Scheme, "+", 2)[0]
+}
+
 func (v *Volume) setupMetrics(c *config.Config, h string) (err error) {
 	v.MetricsHandler = metrics.NewMetrics(h, v.Volume.Name, c.Metrics.PushgatewayURL)
+	v.MetricsHandler.DropLabels = c.Metrics.DropLabels
+	v.MetricsHandler.Labels = v.metricsLabels(c, h)
+	metrics.Register(v.MetricsHandler)
 	util.CheckErr(err, "Failed to set up metrics: %v", "fatal")
 	return
 }
@@ -209,6 +703,12 @@ func setField(field reflect.Value, fieldType reflect.StructField, value interfac
 			return err
 		}
 		field.SetBool(bvalue)
+	case reflect.Slice:
+		// Lists are separated by spaces
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		field.Set(reflect.ValueOf(strings.Fields(value.(string))))
 	default:
 		return fmt.Errorf("unsupported type %s", field.Kind())
 	}
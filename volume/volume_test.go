@@ -1,6 +1,17 @@
 package volume
 
-import "testing"
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/conplicity/config"
+	"github.com/camptocamp/conplicity/metrics"
+	"github.com/docker/docker/api/types"
+)
 
 // Set up fake volume
 var fakeVol = Volume{
@@ -35,3 +46,529 @@ func TestNewVolume(t *testing.T) {
 		t.Fatalf("Volume RemoveOlderThan is wrong. Expected 1Y, got %v", fakeVol.Config.Duplicity.RemoveOlderThan)
 	}
 }
+
+func TestLog(t *testing.T) {
+	v := Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+	}
+	entry := v.Log().WithField("engine", "restic")
+	if entry.Data["volume"] != "foo" || entry.Data["engine"] != "restic" {
+		t.Fatalf("Expected volume and engine fields, got %v", entry.Data)
+	}
+}
+
+func TestNewHostPathVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conplicity_host_path")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		TargetURL: "s3:s3.amazonaws.com/backups",
+	}
+	v := NewHostPathVolume("etc", dir, c, "host")
+	if !v.HostPath || v.Name != "etc" {
+		t.Fatalf("Expected host path volume etc, got %+v", v)
+	}
+	if v.MountSource() != dir || v.ContainerPath() != dir {
+		t.Fatalf("Expected %s to be bound on itself, got %s:%s", dir, v.MountSource(), v.ContainerPath())
+	}
+	if v.MetricsHandler == nil || v.MetricsHandler.Volume != "etc" {
+		t.Fatalf("Expected metrics for volume etc, got %+v", v.MetricsHandler)
+	}
+	if u, err := v.TargetURL(); err != nil || u.String() != "s3:s3.amazonaws.com/backups" {
+		t.Fatalf("Expected the global target URL, got %v, %v", u, err)
+	}
+
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: "/var/lib/docker/volumes/foo/_data",
+		},
+	}
+	if vol.MountSource() != "foo" {
+		t.Fatalf("Expected Docker volumes to be bound by name, got %s", vol.MountSource())
+	}
+}
+
+func TestDuplicityExtraArgs(t *testing.T) {
+	c := &config.Config{
+		TargetURL: "s3:s3.amazonaws.com/backups",
+	}
+	c.Duplicity.ExtraArgs = []string{"--num-retries", "5"}
+
+	v := NewVolume(&types.Volume{Name: "foo"}, c, "host")
+	if args := strings.Join(v.Config.Duplicity.ExtraArgs, " "); args != "--num-retries 5" {
+		t.Fatalf("Expected the global extra arguments, got '%s'", args)
+	}
+
+	v = NewVolume(&types.Volume{
+		Name: "foo",
+		Labels: map[string]string{
+			"io.conplicity.duplicity.args": "--volsize 100  --asynchronous-upload",
+		},
+	}, c, "host")
+	if args := v.Config.Duplicity.ExtraArgs; len(args) != 3 || args[1] != "100" || args[2] != "--asynchronous-upload" {
+		t.Fatalf("Expected the label's extra arguments, got %v", args)
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	c := &config.Config{
+		Engine:    "restic",
+		TargetURL: "s3:s3.amazonaws.com/backups",
+	}
+	v := NewVolume(&types.Volume{Name: "foo"}, c, "host")
+
+	expected := map[string]string{
+		"volume":         "foo",
+		"engine":         "restic",
+		"hostname":       "host",
+		"target_backend": "s3",
+	}
+	if len(v.MetricsHandler.Labels) != len(expected) {
+		t.Fatalf("Expected labels %v, got %v", expected, v.MetricsHandler.Labels)
+	}
+	for l, value := range expected {
+		if v.MetricsHandler.Labels[l] != value {
+			t.Fatalf("Expected label %s=%s, got %v", l, value, v.MetricsHandler.Labels)
+		}
+	}
+
+	c.DryRun = true
+	v = NewVolume(&types.Volume{Name: "foo"}, c, "host")
+	if v.MetricsHandler.Labels["dryrun"] != "true" {
+		t.Fatalf("Expected dryrun label, got %v", v.MetricsHandler.Labels)
+	}
+}
+
+func TestTargetBackend(t *testing.T) {
+	for target, backend := range map[string]string{
+		"s3:s3.amazonaws.com/backups":   "s3",
+		"s3+http://backups":             "s3",
+		"swift://backups":               "swift",
+		"b2:bucket:backups":             "b2",
+		"gs:bucket:/backups":            "gs",
+		"azure:backups:/":               "azure",
+		"sftp:user@host:/srv/restic":    "sftp",
+		"rest:https://host:8000/restic": "rest",
+		"/srv/restic":                   "unknown",
+		"":                              "unknown",
+	} {
+		if b := targetBackend(target); b != backend {
+			t.Fatalf("Expected backend %s for %s, got %s", backend, target, b)
+		}
+	}
+}
+
+func TestIsMountedBy(t *testing.T) {
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: "/var/lib/docker/volumes/foo/_data",
+		},
+	}
+	if !vol.IsMountedBy(types.MountPoint{Type: "volume", Name: "foo"}) {
+		t.Fatal("Expected volume foo to be mounted by name")
+	}
+	if vol.IsMountedBy(types.MountPoint{Type: "volume", Name: "bar"}) {
+		t.Fatal("Expected volume bar not to be a mount of foo")
+	}
+
+	vol.HostPath = true
+	vol.Mountpoint = "/srv/data"
+	if !vol.IsMountedBy(types.MountPoint{Type: "bind", Source: "/srv/data"}) {
+		t.Fatal("Expected host path to be bind-mounted")
+	}
+	if vol.IsMountedBy(types.MountPoint{Type: "volume", Name: "foo"}) {
+		t.Fatal("Expected host path not to be mounted by name")
+	}
+}
+
+// TestContainerPath checks the path of the volume in backup containers
+func TestContainerPath(t *testing.T) {
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: "/var/lib/docker/volumes/foo/_data",
+		},
+	}
+
+	if got := vol.ContainerPath(); got != "/var/lib/docker/volumes/foo/_data" {
+		t.Fatalf("Expected host mountpoint, got %v", got)
+	}
+
+	vol.MountByName = true
+	if got := vol.ContainerPath(); got != "/backup" {
+		t.Fatalf("Expected /backup, got %v", got)
+	}
+}
+
+// TestTimeout checks the parsing of the volume timeout
+func TestTimeout(t *testing.T) {
+	vol := Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		Config: &Config{},
+	}
+
+	if got, err := vol.Timeout(); err != nil || got != 0 {
+		t.Fatalf("Expected no timeout, got %v (%v)", got, err)
+	}
+
+	vol.Config.Timeout = "90m"
+	if got, err := vol.Timeout(); err != nil || got != 90*time.Minute {
+		t.Fatalf("Expected 90m timeout, got %v (%v)", got, err)
+	}
+
+	vol.Config.Timeout = "fake"
+	if _, err := vol.Timeout(); err == nil {
+		t.Fatal("Expected an error, got no error")
+	}
+}
+
+func TestTargetURL(t *testing.T) {
+	vol := Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		Config: &Config{
+			TargetURL: "s3://s3.amazonaws.com/bar",
+		},
+	}
+
+	u, err := vol.TargetURL()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if u.String() != "s3://s3.amazonaws.com/bar" {
+		t.Fatalf("Expected s3://s3.amazonaws.com/bar, got %s", u)
+	}
+
+	for _, target := range []string{"", "/bar", "%gh&%ij"} {
+		vol.Config.TargetURL = target
+		_, err = vol.TargetURL()
+		if err == nil {
+			t.Fatalf("Expected an error for target URL %q, got no error", target)
+		}
+		if !strings.Contains(err.Error(), "volume foo") {
+			t.Fatalf("Expected the error to name the volume, got %v", err)
+		}
+	}
+}
+
+// TestSetLastBackup checks the neverBackedUp metric
+func TestLogResult(t *testing.T) {
+	v := Volume{
+		Volume: &types.Volume{
+			Name: "foo",
+		},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	if err := v.LogResult(false); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if value := v.MetricsHandler.Metrics["conplicity_success"].Events[0].Value; value != "0" {
+		t.Fatalf("Expected failure, got %s", value)
+	}
+	if _, ok := v.MetricsHandler.Metrics["conplicity_lastRun"]; !ok {
+		t.Fatal("Expected the last run time to be recorded")
+	}
+
+	v.LogResult(true)
+	if value := v.MetricsHandler.Metrics["conplicity_success"].Events[0].Value; value != "1" {
+		t.Fatalf("Expected success, got %s", value)
+	}
+}
+
+func TestSetLastBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_set_last_backup")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: dir,
+		},
+		Config:         &Config{},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	vol.LogBackedUp()
+	if got := vol.MetricsHandler.Metrics["conplicity_neverBackedUp"].Events[0].Value; got != "1" {
+		t.Fatalf("Expected volume to never have been backed up, got %v", got)
+	}
+
+	if err := vol.SetLastBackup(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := vol.MetricsHandler.Metrics["conplicity_neverBackedUp"].Events[0].Value; got != "0" {
+		t.Fatalf("Expected volume to have been backed up, got %v", got)
+	}
+}
+
+// TestCheckEngine checks the detection of engine changes
+func TestCheckEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_check_engine")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: dir,
+		},
+		Config: &Config{
+			Engine: "duplicity",
+		},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	if err := vol.CheckEngine(); err != nil {
+		t.Fatalf("Expected no error for a volume never backed up, got %v", err)
+	}
+
+	vol.SetLastBackup()
+	if err := vol.CheckEngine(); err != nil {
+		t.Fatalf("Expected no error for an unchanged engine, got %v", err)
+	}
+
+	vol.Config.Engine = "restic"
+	if err := vol.CheckEngine(); err == nil {
+		t.Fatal("Expected an error for a changed engine, got no error")
+	}
+	if got := vol.MetricsHandler.Metrics["conplicity_engineChanged"].Events[0].Value; got != "1" {
+		t.Fatalf("Expected engineChanged metric to be 1, got %v", got)
+	}
+
+	vol.Config.AllowEngineChange = true
+	if err := vol.CheckEngine(); err != nil {
+		t.Fatalf("Expected no error when engine change is allowed, got %v", err)
+	}
+}
+
+// TestIsUnchanged checks the detection of unchanged volumes
+func TestIsUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_is_unchanged")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/data", []byte("foo"), 0644)
+
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: dir,
+		},
+		Config:         &Config{},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	unchanged, signature, err := vol.IsUnchanged()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if unchanged {
+		t.Fatal("Expected a volume never backed up to be changed")
+	}
+
+	vol.SetSignature(signature)
+	vol.SetLastBackup()
+	if unchanged, _, _ = vol.IsUnchanged(); !unchanged {
+		t.Fatal("Expected volume to be unchanged")
+	}
+	if got := vol.MetricsHandler.Metrics["conplicity_volumeUnchanged"].Events[0].Value; got != "1" {
+		t.Fatalf("Expected volumeUnchanged metric to be 1, got %v", got)
+	}
+
+	ioutil.WriteFile(dir+"/data", []byte("foobar"), 0644)
+	if unchanged, _, _ = vol.IsUnchanged(); unchanged {
+		t.Fatal("Expected volume to be changed")
+	}
+}
+
+func TestIsDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_is_due")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: dir,
+		},
+		Config:         &Config{},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	if due, _ := vol.IsDue(); !due {
+		t.Fatal("Expected a volume without frequency to be due")
+	}
+
+	vol.Config.Frequency = "1h"
+	if due, _ := vol.IsDue(); !due {
+		t.Fatal("Expected a volume never backed up to be due")
+	}
+
+	vol.SetLastBackup()
+	if due, _ := vol.IsDue(); due {
+		t.Fatal("Expected a volume just backed up not to be due")
+	}
+	if got := vol.MetricsHandler.Metrics["conplicity_backupNotDue"].Events[0].Value; got != "1" {
+		t.Fatalf("Expected conplicity_backupNotDue to be 1, got %s", got)
+	}
+
+	h := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(dir+"/"+lastBackupFile, h, h)
+	if due, _ := vol.IsDue(); !due {
+		t.Fatal("Expected a volume backed up 2 hours ago to be due")
+	}
+
+	vol.Config.Frequency = "weekly"
+	if _, err := vol.IsDue(); err == nil {
+		t.Fatal("Expected an error for an invalid frequency, got nil")
+	}
+}
+
+func TestBackupPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conplicity_backup_paths")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/data", 0755)
+	os.Mkdir(dir+"/conf", 0755)
+
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: dir,
+		},
+		BackupDir: "dump",
+		Config:    &Config{},
+	}
+
+	paths, err := vol.BackupPaths()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(paths) != 1 || paths[0] != dir+"/dump" {
+		t.Fatalf("Unexpected paths %v", paths)
+	}
+
+	vol.Config.BackupDirs = "data, conf/ ,"
+	paths, err = vol.BackupPaths()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(paths) != 2 || paths[0] != dir+"/data" || paths[1] != dir+"/conf" {
+		t.Fatalf("Unexpected paths %v", paths)
+	}
+
+	// Missing dirs are skipped
+	vol.Config.BackupDirs = "data,missing"
+	paths, err = vol.BackupPaths()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(paths) != 1 || paths[0] != dir+"/data" {
+		t.Fatalf("Expected the missing dir to be skipped, got %v", paths)
+	}
+
+	for _, dirs := range []string{"../bar", "data,/etc", ",", "missing"} {
+		vol.Config.BackupDirs = dirs
+		if _, err := vol.BackupPaths(); err == nil {
+			t.Fatalf("Expected an error for %s, got nil", dirs)
+		}
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_is_empty")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/sub", 0755)
+
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: dir,
+		},
+		Config:         &Config{},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+	vol.SetLastBackup()
+
+	if empty, err := vol.IsEmpty(); err != nil || !empty {
+		t.Fatalf("Expected volume with only directories and state files to be empty, got %v, %v", empty, err)
+	}
+	if got := vol.MetricsHandler.Metrics["conplicity_volumeEmpty"].Events[0].Value; got != "1" {
+		t.Fatalf("Expected conplicity_volumeEmpty to be 1, got %s", got)
+	}
+
+	ioutil.WriteFile(dir+"/sub/data", []byte("foo"), 0644)
+	if empty, err := vol.IsEmpty(); err != nil || empty {
+		t.Fatalf("Expected volume not to be empty, got %v, %v", empty, err)
+	}
+}
+
+func TestStateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_state_files")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/data", []byte("foo"), 0644)
+
+	vol := Volume{
+		Volume: &types.Volume{
+			Name:       "foo",
+			Mountpoint: dir,
+		},
+		Config:         &Config{},
+		MetricsHandler: metrics.NewMetrics("host", "foo", ""),
+	}
+
+	if files := vol.StateFiles(); len(files) != 0 {
+		t.Fatalf("Expected no state file, got %v", files)
+	}
+
+	vol.SetLastBackup()
+	files := vol.StateFiles()
+	if _, ok := files[lastBackupFile]; len(files) != 1 || !ok {
+		t.Fatalf("Expected %s only, got %v", lastBackupFile, files)
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	c := Config{
+		Engine:        "duplicity",
+		GPGPassphrase: "s3cr3t-gpg",
+		EncryptKey:    "s3cr3t-key",
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if strings.Contains(string(data), "s3cr3t") {
+		t.Fatalf("Expected secrets to be left out, got %s", data)
+	}
+	if !strings.Contains(string(data), "duplicity") {
+		t.Fatalf("Expected the engine to be encoded, got %s", data)
+	}
+}